@@ -68,6 +68,10 @@ func loadCredentials(filename string) (map[string]string, error) {
 		lastInd := strings.LastIndex(line, ":")
 		username := line[:lastInd]
 		password := line[lastInd+1:]
+		if username == config.ControlUser {
+			log.Error("ignore credentials of reserved user, the control api executes as this user", "user", username)
+			continue
+		}
 
 		credentials[username] = password
 	}
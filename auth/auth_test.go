@@ -4,11 +4,24 @@ import (
 	"github.com/mrlauy/ghome-mqtt/config"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func TestLoadCredentialsReservedUser(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".credentials")
+	require.NoError(t, os.WriteFile(filename, []byte("alice:secret\nmqtt:secret\n"), 0600))
+
+	credentials, err := loadCredentials(filename)
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"alice": "secret"}, credentials, "the control api executes as mqtt")
+}
+
 func TestAuthorizeRequest(t *testing.T) {
 	// GET https://myservice.example.com/auth?client_id=GOOGLE_CLIENT_ID&redirect_uri=REDIRECT_URI&state=STATE_STRING&scope=REQUESTED_SCOPES&response_type=code&user_locale=LOCALE
 	expected := ``
@@ -16,7 +29,7 @@ func TestAuthorizeRequest(t *testing.T) {
 	redirectLocation := "/login"
 
 	url := "https://myservice.example.com/oauth/authorize?client_id=CLIENT_ID&redirect_uri=REDIRECT_URI&state=STATE_STRING&scope=REQUESTED_SCOPES&response_type=code&user_locale=LOCALE"
-	auth := NewAuth(authConfig())
+	auth := NewAuth(authConfig(t))
 
 	request, err := http.NewRequest(http.MethodGet, url, nil)
 	assert.Nil(t, err, "failed to create request")
@@ -37,7 +50,7 @@ func TestAuthorizeRequest(t *testing.T) {
 	}
 }
 
-func authConfig() config.AuthConfig {
+func authConfig(t *testing.T) config.AuthConfig {
 	return config.AuthConfig{
 		Client: struct {
 			Id     string `yaml:"id" env:"CLIENT_ID" env-default:"000000"`
@@ -51,6 +64,6 @@ func authConfig() config.AuthConfig {
 			Id: "CLIENT_ID", Secret: "client-secret", Domain: "http://localhost",
 		}),
 		Credientials: ".credentials",
-		TokenStore:   ".tokenstore",
+		TokenStore:   filepath.Join(t.TempDir(), ".tokenstore"),
 	}
 }
@@ -0,0 +1,18 @@
+package auth
+
+import "context"
+
+type contextKey string
+
+const userIdKey contextKey = "userId"
+
+// WithUserId returns a copy of the context carrying the authenticated user
+func WithUserId(ctx context.Context, userId string) context.Context {
+	return context.WithValue(ctx, userIdKey, userId)
+}
+
+// UserId returns the authenticated user stored in the context by ValidateToken
+func UserId(ctx context.Context) (string, bool) {
+	userId, ok := ctx.Value(userIdKey).(string)
+	return userId, ok && userId != ""
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/go-session/session"
 	log "log/slog"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -36,7 +37,7 @@ func (a *Auth) Authorize(w http.ResponseWriter, r *http.Request) {
 		redirectUri, redirectUriFound := sessionStore.Get("redirectUri")
 		if !stateFound || !redirectUriFound {
 			sessionStore.Delete("LoggedInUserID")
-			log.Error("logged in user, but no state or redirectUri in session", "user", userId, "session", sessionStore)
+			log.Error("logged in user, but no state or redirectUri in session", "user", userId)
 			w.Header().Set("Location", "/login")
 			w.WriteHeader(http.StatusFound)
 			return
@@ -50,11 +51,10 @@ func (a *Auth) Authorize(w http.ResponseWriter, r *http.Request) {
 		}
 
 		log.Info("/authorize", "user", userId)
-		log.Debug("/authorize generate code", "code", authorizationCode)
 
 		client, clientFound := sessionStore.Get("client")
 		if !clientFound {
-			log.Error("failed to find client in session", "session", sessionStore)
+			log.Error("failed to find client in session", "user", userId)
 			http.Error(w, "server side error: #3204", http.StatusInternalServerError)
 			return
 		}
@@ -73,7 +73,10 @@ func (a *Auth) Authorize(w http.ResponseWriter, r *http.Request) {
 		}
 
 		responseUrl := fmt.Sprintf("%s?code=%s&state=%s", redirectUri, authorizationCode, state)
-		log.Info("/authorize redirect", "location", responseUrl)
+		// the location holds the authorization code, only where it redirects to is logged
+		if location, err := url.Parse(responseUrl); err == nil {
+			log.Info("/authorize redirect", "host", location.Host, "path", location.Path)
+		}
 
 		w.Header().Set("Location", responseUrl)
 		w.WriteHeader(http.StatusFound)
@@ -138,7 +141,7 @@ func (a *Auth) Token(w http.ResponseWriter, r *http.Request) {
 	client := getInput(r, "client_id")
 	secret := getInput(r, "client_secret")
 	if client != a.clientId || secret != a.clientSecret {
-		log.Error("invalid client", "client", client, "secret", secret)
+		log.Error("invalid client", "client", client)
 		http.Error(w, "invalid_client", http.StatusInternalServerError)
 		return
 	}
@@ -150,13 +153,13 @@ func (a *Auth) Token(w http.ResponseWriter, r *http.Request) {
 
 		authorizationCode, ok := a.codes[client]
 		if !ok {
-			log.Error("failed to find authorizationCode in session", "client", client, "codes", a.codes)
+			log.Error("failed to find authorizationCode in session", "client", client)
 			http.Error(w, "server side error: #3301", http.StatusInternalServerError)
 			return
 		}
 
 		if code != authorizationCode {
-			log.Error("invalid code", "client", client, "code", code)
+			log.Error("invalid code", "client", client)
 			http.Error(w, "invalid code", http.StatusInternalServerError)
 			return
 		}
@@ -183,7 +186,7 @@ func (a *Auth) Token(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Debug("/token grant token", "client", client)
-	log.Info("/token grant", "grantType", grantType, "response", response)
+	log.Info("/token grant", "grantType", grantType, "expiresIn", response["expires_in"])
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 	w.Header().Set("Cache-Control", "no-store")
@@ -213,7 +216,7 @@ func (a *Auth) generateAuthorizationToken(client, secret string, redirectUri str
 		return nil, err
 	}
 
-	log.Info("token info", "info", tokenInfo)
+	log.Info("token info", "user", tokenInfo.GetUserID(), "expiresIn", tokenInfo.GetAccessExpiresIn())
 
 	response := map[string]interface{}{
 		"token_type":   "bearer",
@@ -246,7 +249,7 @@ func (a *Auth) generateRefreshToken(client, secret string, refreshToken string,
 		return nil, err
 	}
 
-	log.Info("token info", "info", tokenInfo)
+	log.Info("token info", "user", tokenInfo.GetUserID(), "expiresIn", tokenInfo.GetAccessExpiresIn())
 
 	response := map[string]interface{}{
 		"token_type":   "bearer",
@@ -17,14 +17,21 @@ func (a *Auth) ValidateToken(next http.Handler) http.Handler {
 
 		tokenInfo, err := a.manager.LoadAccessToken(r.Context(), token)
 		if err != nil {
-			log.Warn("unauthorized", "token", token, err)
+			log.Warn("unauthorized", "error", err)
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		log.Info("grant access", "URL", r.URL, "token", tokenInfo)
+		userId := tokenInfo.GetUserID()
+		if userId == "" {
+			log.Warn("unauthorized: no user in token", "URL", r.URL)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		log.Info("grant access", "URL", r.URL, "user", userId)
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(WithUserId(r.Context(), userId)))
 	})
 }
 
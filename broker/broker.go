@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"net"
+	"strconv"
+)
+
+// bridgeUsername is the user the bridge connects with when the broker has users, its password is generated on start
+const bridgeUsername = "ghome-mqtt"
+
+// Broker is an embedded MQTT broker, devices connect to its listener and the bridge connects to it like any broker
+type Broker struct {
+	server   *server.Server
+	listener *listeners.TCP
+	username string
+	password string
+}
+
+func NewBroker(cfg config.BrokerConfig) (*Broker, error) {
+	b := &Broker{
+		server: server.New(&server.Options{Logger: log.Default()}),
+	}
+
+	if len(cfg.Users) == 0 {
+		if err := b.server.AddHook(new(auth.AllowHook), nil); err != nil {
+			return nil, fmt.Errorf("failed to allow anonymous clients: %v", err)
+		}
+	} else {
+		if _, ok := cfg.Users[bridgeUsername]; ok {
+			return nil, fmt.Errorf("user %s is reserved for the bridge", bridgeUsername)
+		}
+		password, err := generatePassword()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate the password of the bridge: %v", err)
+		}
+		b.username, b.password = bridgeUsername, password
+
+		users := auth.Users{bridgeUsername: {Username: bridgeUsername, Password: auth.RString(password)}}
+		for username, password := range cfg.Users {
+			users[username] = auth.UserRule{Username: auth.RString(username), Password: auth.RString(password)}
+		}
+		// the rule without filters lets every user publish and subscribe to all topics
+		ledger := &auth.Ledger{Users: users, ACL: auth.ACLRules{{}}}
+		if err := b.server.AddHook(new(auth.Hook), &auth.Options{Ledger: ledger}); err != nil {
+			return nil, fmt.Errorf("failed to add the users: %v", err)
+		}
+	}
+
+	if cfg.Persistence != "" {
+		if err := b.server.AddHook(new(bolt.Hook), &bolt.Options{Path: cfg.Persistence}); err != nil {
+			return nil, fmt.Errorf("failed to open persistence %s: %v", cfg.Persistence, err)
+		}
+	}
+
+	b.listener = listeners.NewTCP(listeners.Config{ID: "tcp", Address: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))})
+	if err := b.server.AddListener(b.listener); err != nil {
+		_ = b.server.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %v", b.listener.Address(), err)
+	}
+	if err := b.server.Serve(); err != nil {
+		_ = b.server.Close()
+		return nil, fmt.Errorf("failed to start the broker: %v", err)
+	}
+
+	log.Info("started embedded mqtt broker", "address", b.listener.Address(), "users", len(cfg.Users), "persistence", cfg.Persistence)
+	return b, nil
+}
+
+// Address is the address the broker listens on, with the port it picked when the configured port is 0
+func (b *Broker) Address() string {
+	return b.listener.Address()
+}
+
+// Connect points the mqtt config to the embedded broker, the host, port and brokers are replaced
+func (b *Broker) Connect(cfg config.MqttConfig) config.MqttConfig {
+	host, port, _ := net.SplitHostPort(b.Address())
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	cfg.Brokers = []string{"tcp://" + net.JoinHostPort(host, port)}
+	cfg.Host = host
+	cfg.Port, _ = strconv.Atoi(port)
+	cfg.Tls = false
+	cfg.Username = b.username
+	cfg.Password = b.password
+	return cfg
+}
+
+func (b *Broker) Close() {
+	if err := b.server.Close(); err != nil {
+		log.Error("failed to close the embedded mqtt broker", "error", err)
+	}
+}
+
+func generatePassword() (string, error) {
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(password), nil
+}
@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/mrlauy/ghome-mqtt/fullfillment"
+	mqtt2 "github.com/mrlauy/ghome-mqtt/mqtt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerUsers(t *testing.T) {
+	tests := []struct {
+		name          string
+		users         map[string]string
+		username      string
+		password      string
+		expectedError string
+	}{
+		{name: "Anonymous without users"},
+		{name: "User with password", users: map[string]string{"sensor": "secret"}, username: "sensor", password: "secret"},
+		{name: "Wrong password", users: map[string]string{"sensor": "secret"}, username: "sensor", password: "wrong", expectedError: "not Authorized"},
+		{name: "Anonymous with users", users: map[string]string{"sensor": "secret"}, expectedError: "not Authorized"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newBroker(t, config.BrokerConfig{Users: test.users})
+
+			bridge, err := mqtt2.NewMqtt(broker.Connect(config.MqttConfig{}))
+			require.NoError(t, err, "the bridge connects with its own user")
+			defer bridge.Close()
+
+			_, err = connect(broker, test.username, test.password)
+			if test.expectedError != "" {
+				assert.ErrorContains(t, err, test.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestBrokerReservedUser(t *testing.T) {
+	_, err := NewBroker(config.BrokerConfig{Host: "127.0.0.1", Users: map[string]string{bridgeUsername: "secret"}})
+
+	assert.EqualError(t, err, "user ghome-mqtt is reserved for the bridge")
+}
+
+func TestBrokerPersistence(t *testing.T) {
+	cfg := config.BrokerConfig{Host: "127.0.0.1", Persistence: filepath.Join(t.TempDir(), "broker.db")}
+
+	broker, err := NewBroker(cfg)
+	require.NoError(t, err)
+	client, err := connect(broker, "", "")
+	require.NoError(t, err)
+	token := client.Publish("zigbee2mqtt/lamp", 1, true, `{"state":"ON"}`)
+	token.Wait()
+	require.NoError(t, token.Error())
+	client.Disconnect(0)
+	broker.Close()
+
+	client, err = connect(newBroker(t, cfg), "", "")
+	require.NoError(t, err)
+	defer client.Disconnect(0)
+	retained := make(chan string, 1)
+	client.Subscribe("zigbee2mqtt/lamp", 1, func(client mqtt.Client, message mqtt.Message) {
+		retained <- string(message.Payload())
+	})
+
+	select {
+	case payload := <-retained:
+		assert.Equal(t, `{"state":"ON"}`, payload)
+	case <-time.After(time.Second):
+		t.Fatal("retained message isn't kept")
+	}
+}
+
+func TestDiscoveryWithRetainedStates(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages func(i int) map[string]string
+		discover func(bridge *mqtt2.Mqtt, listener mqtt2.DiscoveryListener) error
+	}{
+		{
+			name: "zigbee2mqtt",
+			messages: func(i int) map[string]string {
+				return map[string]string{fmt.Sprintf("zigbee2mqtt/plug%d", i): `{"state":"ON"}`}
+			},
+			discover: func(bridge *mqtt2.Mqtt, listener mqtt2.DiscoveryListener) error {
+				return bridge.DiscoverZigbee2mqtt(config.DiscoverySource{Enabled: true}, nil, listener)
+			},
+		},
+		{
+			name: "homeassistant",
+			messages: func(i int) map[string]string {
+				return map[string]string{
+					fmt.Sprintf("homeassistant/switch/plug%d/config", i): fmt.Sprintf(`{"name":"Plug %d","cmd_t":"plug%d/set","stat_t":"plug%d/state"}`, i, i, i),
+					fmt.Sprintf("plug%d/state", i):                       "ON",
+				}
+			},
+			discover: func(bridge *mqtt2.Mqtt, listener mqtt2.DiscoveryListener) error {
+				return bridge.DiscoverHomeassistant(config.DiscoverySource{Enabled: true}, listener)
+			},
+		},
+		{
+			name: "tasmota",
+			messages: func(i int) map[string]string {
+				return map[string]string{
+					fmt.Sprintf("tasmota/discovery/DC4F220A1B%02d/config", i): fmt.Sprintf(`{"dn":"Plug %d","fn":["Plug %d"],"hn":"plug%d","mac":"DC4F220A1B%02d","md":"Sonoff Basic","sw":"13.2.0",`+
+						`"t":"plug%d","ft":"%%prefix%%/%%topic%%/","tp":["cmnd","stat","tele"],"rl":[1,0,0,0],"lt_st":0,"so":{"4":0,"17":0},"ver":1}`, i, i, i, i, i),
+					fmt.Sprintf("stat/plug%d/RESULT", i): `{"POWER":"ON"}`,
+				}
+			},
+			discover: func(bridge *mqtt2.Mqtt, listener mqtt2.DiscoveryListener) error {
+				return bridge.DiscoverTasmota(config.DiscoverySource{Enabled: true}, nil, listener)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newBroker(t, config.BrokerConfig{})
+			device, err := connect(broker, "", "")
+			require.NoError(t, err)
+			defer device.Disconnect(0)
+
+			var devices []string
+			for i := 1; i <= 10; i++ {
+				devices = append(devices, fmt.Sprintf(`{"ieee_address":"0x%016x","type":"Router","friendly_name":"plug%d","supported":true,"interview_completed":true,`+
+					`"definition":{"model":"E1603","vendor":"IKEA","description":"Control outlet","exposes":[`+
+					`{"type":"switch","features":[{"type":"binary","name":"state","property":"state","value_on":"ON","value_off":"OFF"}]}]}}`, i, i))
+				for topic, payload := range test.messages(i) {
+					publish(t, device, topic, payload)
+				}
+			}
+			publish(t, device, "zigbee2mqtt/bridge/devices", "["+strings.Join(devices, ",")+"]")
+
+			bridge, err := mqtt2.NewMqtt(broker.Connect(config.MqttConfig{}))
+			require.NoError(t, err)
+			defer bridge.Close()
+			manager, err := fullfillment.NewFullfillment(bridge, nil, nil, nil)
+			require.NoError(t, err)
+			require.NoError(t, test.discover(bridge, manager))
+
+			assert.Eventually(t, func() bool {
+				devices := manager.Devices()
+				for _, device := range devices {
+					if device.States["on"] != true {
+						return false
+					}
+				}
+				return len(devices) == 10
+			}, 5*time.Second, 10*time.Millisecond, "all devices are discovered with their retained state")
+		})
+	}
+}
+
+// newBroker starts an embedded broker on a free port
+func newBroker(t *testing.T, cfg config.BrokerConfig) *Broker {
+	cfg.Host = "127.0.0.1"
+	broker, err := NewBroker(cfg)
+	require.NoError(t, err)
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+// connect connects a device to the broker
+func connect(broker *Broker, username string, password string) (mqtt.Client, error) {
+	client := mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker("tcp://" + broker.Address()).
+		SetUsername(username).
+		SetPassword(password))
+	token := client.Connect()
+	token.Wait()
+	return client, token.Error()
+}
+
+// publish publishes a retained message of a device
+func publish(t *testing.T, client mqtt.Client, topic string, payload string) {
+	token := client.Publish(topic, 1, true, payload)
+	token.Wait()
+	require.NoError(t, token.Error())
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sceneType  = "action.devices.types.SCENE"
+	sceneTrait = "action.devices.traits.Scene"
+)
+
+// confFile is a file of the conf dir with part of the devices, scenes and templates
+type confFile struct {
+	Devices   map[string]DeviceConfig `yaml:"devices"`
+	Scenes    map[string]DeviceConfig `yaml:"scenes"`
+	Templates map[string]string       `yaml:"templates"`
+}
+
+// mergeConfDir merges the scenes of the config and the files of the conf dir into the config,
+// a device, scene or template that is defined twice is reported with both files
+func mergeConfDir(filename string, cfg *Config) error {
+	cfg.files = []string{filename}
+	if cfg.ConfDir != "" {
+		cfg.dir = cfg.ConfDir
+		if !filepath.IsAbs(cfg.dir) {
+			cfg.dir = filepath.Join(filepath.Dir(filename), cfg.dir)
+		}
+	}
+
+	if cfg.Devices == nil {
+		cfg.Devices = map[string]DeviceConfig{}
+	}
+	if cfg.ExecutionTemplates == nil {
+		cfg.ExecutionTemplates = map[string]string{}
+	}
+	deviceFiles := map[string]string{}
+	for id := range cfg.Devices {
+		deviceFiles[id] = filename
+	}
+	templateFiles := map[string]string{}
+	for command := range cfg.ExecutionTemplates {
+		templateFiles[command] = filename
+	}
+
+	var problems []error
+	merge := func(file string, content confFile) {
+		for _, id := range sortedKeys(content.Devices) {
+			if other, ok := deviceFiles[id]; ok {
+				problems = append(problems, fmt.Errorf("%s: device `%s` is already defined in %s", file, id, other))
+				continue
+			}
+			deviceFiles[id] = file
+			cfg.Devices[id] = content.Devices[id]
+		}
+		for _, id := range sortedKeys(content.Scenes) {
+			if other, ok := deviceFiles[id]; ok {
+				problems = append(problems, fmt.Errorf("%s: scene `%s` is already defined in %s", file, id, other))
+				continue
+			}
+			deviceFiles[id] = file
+			cfg.Devices[id] = scene(content.Scenes[id])
+		}
+		for _, command := range sortedKeys(content.Templates) {
+			if other, ok := templateFiles[command]; ok {
+				problems = append(problems, fmt.Errorf("%s: template `%s` is already defined in %s", file, command, other))
+				continue
+			}
+			templateFiles[command] = file
+			cfg.ExecutionTemplates[command] = content.Templates[command]
+		}
+	}
+
+	scenes := cfg.Scenes
+	cfg.Scenes = nil
+	merge(filename, confFile{Scenes: scenes})
+
+	files, err := confDirFiles(cfg.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		cfg.files = append(cfg.files, file)
+		content, err := readConfFile(file)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		merge(file, content)
+	}
+	return errors.Join(problems...)
+}
+
+// confDirFiles returns the yaml and json files of the conf dir sorted by name
+func confDirFiles(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conf dir: %v", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || !slices.Contains([]string{".yaml", ".yml", ".json"}, ext) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readConfFile reads a file of the conf dir, unknown fields are reported to catch typos
+func readConfFile(file string) (confFile, error) {
+	var content confFile
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return content, fmt.Errorf("%s: %v", file, err)
+	}
+	data, err = interpolate(data)
+	if err != nil {
+		return content, fmt.Errorf("%s: %v", file, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&content); err != nil && !errors.Is(err, io.EOF) {
+		return content, fmt.Errorf("%s: %v", file, err)
+	}
+	return content, nil
+}
+
+// scene returns the scene as a device with the scene type and trait
+func scene(device DeviceConfig) DeviceConfig {
+	if device.Type == "" {
+		device.Type = sceneType
+	}
+	if len(device.Traits) == 0 {
+		device.Traits = []string{sceneTrait}
+	}
+	return device
+}
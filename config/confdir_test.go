@@ -0,0 +1,133 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const confDirConfig = `
+confDir: conf.d
+devices:
+  plug:
+    name: plug
+    topic: zigbee2mqtt/plug/set
+    type: action.devices.types.OUTLET
+    traits: [action.devices.traits.OnOff]
+templates:
+  action.devices.commands.OnOff: '{"state":"%s"}'
+`
+
+func TestParseConfigConfDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.yaml": confDirConfig,
+		"conf.d/1-ground-floor.yaml": `
+devices:
+  lamp:
+    profile: zigbee2mqtt-light
+    friendlyName: kitchen/lamp
+scenes:
+  movie:
+    name: movie night
+    topic: scenes/movie
+`,
+		"conf.d/2-first-floor.json": `{
+  "devices": {
+    "heater": {"name": "heater", "type": "action.devices.types.HEATER", "traits": ["action.devices.traits.OnOff"], "topic": "tasmota/heater", "willReportState": true, "subscription": "stat/heater/RESULT"}
+  },
+  "templates": {"action.devices.commands.ActivateScene": "{\"scene\":\"{{ .Device }}\"}"}
+}`,
+		"conf.d/README.md": "not a config file",
+	})
+
+	cfg, err := ReadConfigFile(filepath.Join(dir, "config.yaml"))
+
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"plug", "lamp", "movie", "heater"}, sortedKeys(cfg.Devices))
+	assert.Equal(t, "zigbee2mqtt/kitchen/lamp/set", cfg.Devices["lamp"].Topic)
+	assert.True(t, cfg.Devices["heater"].WillReportState)
+	assert.Equal(t, "action.devices.types.SCENE", cfg.Devices["movie"].Type)
+	assert.Equal(t, []string{"action.devices.traits.Scene"}, cfg.Devices["movie"].Traits)
+	assert.Equal(t, `{"scene":"{{ .Device }}"}`, cfg.ExecutionTemplates["action.devices.commands.ActivateScene"])
+	assert.Equal(t, []string{
+		filepath.Join(dir, "config.yaml"),
+		filepath.Join(dir, "conf.d/1-ground-floor.yaml"),
+		filepath.Join(dir, "conf.d/2-first-floor.json"),
+	}, cfg.files)
+}
+
+func TestParseConfigConfDirDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.yaml": confDirConfig,
+		"conf.d/a.yaml": `
+devices:
+  plug:
+    name: plug
+scenes:
+  movie:
+    name: movie
+`,
+		"conf.d/b.yaml": `
+scenes:
+  movie:
+    name: movie
+templates:
+  action.devices.commands.OnOff: 'on'
+`,
+		"conf.d/c.yaml": `
+devices:
+  fan:
+    nmae: fan
+`,
+	})
+
+	_, err := ReadConfigFile(filepath.Join(dir, "config.yaml"))
+
+	for _, expected := range []string{
+		filepath.Join(dir, "conf.d/a.yaml") + ": device `plug` is already defined in " + filepath.Join(dir, "config.yaml"),
+		filepath.Join(dir, "conf.d/b.yaml") + ": scene `movie` is already defined in " + filepath.Join(dir, "conf.d/a.yaml"),
+		filepath.Join(dir, "conf.d/b.yaml") + ": template `action.devices.commands.OnOff` is already defined in " + filepath.Join(dir, "config.yaml"),
+		filepath.Join(dir, "conf.d/c.yaml") + ": yaml: unmarshal errors:\n  line 4: field nmae not found in type config.DeviceConfig",
+	} {
+		assert.ErrorContains(t, err, expected)
+	}
+}
+
+func TestWatchConfDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"config.yaml": confDirConfig, "conf.d/.keep": ""})
+	cfg, err := ReadConfigFile(filepath.Join(dir, "config.yaml"))
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var reloaded *Config
+	watcher := Watch(cfg, 5*time.Millisecond, func(cfg *Config) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reloaded = cfg
+	})
+	defer watcher.Stop()
+
+	writeFiles(t, dir, map[string]string{"conf.d/sensors.yaml": sensorConfig("temperature")})
+
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return reloaded != nil && len(reloaded.Devices) == 2
+	}, time.Second, time.Millisecond, "a new file in the conf dir reloads the config")
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+}
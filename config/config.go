@@ -1,20 +1,37 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	log "log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
+// ControlUser executes the commands of the MQTT control api, it's reserved and can't be a login
+const ControlUser = "mqtt"
+
 type Config struct {
+	ConfDir            string                  `yaml:"confDir" env:"CONFIG_DIR"` // Directory with yaml and json files of devices, scenes and templates, relative to the config file.
 	Server             ServerConfig            `yaml:"server"`
 	Auth               AuthConfig              `yaml:"auth"`
 	Mqtt               MqttConfig              `yaml:"mqtt"`
+	Broker             BrokerConfig            `yaml:"broker"`
+	Homegraph          HomegraphConfig         `yaml:"homegraph"`
 	Devices            map[string]DeviceConfig `yaml:"devices"`
+	Scenes             map[string]DeviceConfig `yaml:"scenes"` // Scenes are merged into the devices with the scene type and trait when the config is read.
 	ExecutionTemplates map[string]string       `yaml:"templates"`
+	Users              map[string]UserConfig   `yaml:"users"`
+	Profiles           map[string]DeviceConfig `yaml:"profiles"`
+	Discovery          DiscoveryConfig         `yaml:"discovery"`
 	Log                Log                     `yaml:"log"`
+
+	files []string // config file and the files of the conf dir, watched for changes
+	dir   string   // conf dir resolved against the config file
 }
 
 type ServerConfig struct {
@@ -30,6 +47,18 @@ type AuthConfig struct {
 	} `yaml:"client"`
 	Credientials string `yaml:"credentials" env:"CREDENTIALS" env-default:".credentials"`
 	TokenStore   string `yaml:"tokenStore" env:"TOKEN_STORE" env-default:".tokenstore"`
+	LinkedUsers  string `yaml:"linkedUsers" env:"LINKED_USERS" env-default:".linkedusers"` // Users that linked their Google account, kept for HomeGraph.
+}
+
+// HomegraphConfig configures the HomeGraph API, state is only reported with a service account key file
+type HomegraphConfig struct {
+	KeyFile     string        `yaml:"keyFile" env:"HOMEGRAPH_KEY_FILE"`
+	Url         string        `yaml:"url" env:"HOMEGRAPH_URL" env-default:"https://homegraph.googleapis.com"`
+	TokenUrl    string        `yaml:"tokenUrl" env:"HOMEGRAPH_TOKEN_URL"` // Defaults to the token_uri of the key file.
+	BatchWindow time.Duration `yaml:"batchWindow" env-default:"1s"`       // State changes in the window after the first change are reported in one request per user.
+	Retries     int           `yaml:"retries" env-default:"3"`
+	RetryDelay  time.Duration `yaml:"retryDelay" env-default:"1s"`                                // Doubles after every retry.
+	SyncHash    string        `yaml:"syncHash" env:"HOMEGRAPH_SYNC_HASH" env-default:".synchash"` // Hash of the last synced devices, a sync is requested when the devices change.
 }
 
 type MqttConfig struct {
@@ -38,16 +67,144 @@ type MqttConfig struct {
 	Username string `yaml:"username" env:"MQTT_BROKER_USERNAME"`
 	Password string `yaml:"password" env:"MQTT_BROKER_PASSWORD"`
 	Tls      bool   `yaml:"tls" env:"MQTT_BROKER_TLS" env-default:"false"`
+
+	CaFile             string `yaml:"caFile" env:"MQTT_BROKER_CA_FILE"`                          // PEM bundle of the CAs that are trusted for the broker, replaces the system CAs.
+	CertFile           string `yaml:"certFile" env:"MQTT_BROKER_CERT_FILE"`                      // Client certificate for mutual TLS.
+	KeyFile            string `yaml:"keyFile" env:"MQTT_BROKER_KEY_FILE"`                        // Private key of the client certificate.
+	ServerName         string `yaml:"serverName" env:"MQTT_BROKER_SERVER_NAME"`                  // Name the broker certificate is verified against, defaults to the host.
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify" env:"MQTT_BROKER_INSECURE_SKIP_VERIFY"` // Accepts any broker certificate, only for testing.
+
+	Brokers []string          `yaml:"brokers" env:"MQTT_BROKER_URLS" env-separator:","` // Broker urls that are tried in order, replaces the host and port.
+	Headers map[string]string `yaml:"headers" env:"MQTT_BROKER_HEADERS"`                // HTTP headers of the WebSocket upgrade.
+
+	ClientId             string        `yaml:"clientId" env:"MQTT_BROKER_CLIENT_ID"`                                           // Unique client id, defaults to `ghome-mqtt-` with a random suffix.
+	KeepAlive            time.Duration `yaml:"keepAlive" env:"MQTT_BROKER_KEEP_ALIVE" env-default:"30s"`                       // Interval of the pings that detect a lost connection.
+	MaxReconnectInterval time.Duration `yaml:"maxReconnectInterval" env:"MQTT_BROKER_MAX_RECONNECT_INTERVAL" env-default:"1m"` // Reconnect attempts back off from a second up to this delay.
+
+	BaseTopic   string `yaml:"baseTopic" env:"MQTT_BASE_TOPIC" env-default:"ghome-mqtt"` // Prefix of the topics of the bridge itself.
+	StatusTopic string `yaml:"statusTopic" env:"MQTT_STATUS_TOPIC"`                      // Retained `online` or `offline` of the bridge, defaults to `<baseTopic>/status`.
+
+	Events     bool   `yaml:"events" env:"MQTT_EVENTS" env-default:"true"`    // Publish the requests of the assistant as events.
+	EventTopic string `yaml:"eventTopic" env:"MQTT_EVENT_TOPIC"`              // Events are published on `<eventTopic>/<intent>/<device>`, defaults to `<baseTopic>/events`.
+	Control    bool   `yaml:"control" env:"MQTT_CONTROL" env-default:"false"` // Handle the requests of the control api on `<baseTopic>/bridge/request/#`.
+
+	ProtocolVersion byte              `yaml:"protocolVersion" env:"MQTT_PROTOCOL_VERSION" env-default:"4"` // 3 for MQTT 3.1, 4 for MQTT 3.1.1 and 5 for MQTT 5.
+	UserProperties  map[string]string `yaml:"userProperties" env:"MQTT_USER_PROPERTIES"`                   // MQTT 5 user properties of every published message.
+	MessageExpiry   time.Duration     `yaml:"messageExpiry" env:"MQTT_MESSAGE_EXPIRY"`                     // MQTT 5 expiry of the published messages, the broker drops them when they aren't delivered in time.
+
+	QueueSize        int           `yaml:"queueSize" env:"MQTT_QUEUE_SIZE" env-default:"100"`                // Messages that are queued while the broker is gone, 0 disables the queue.
+	QueueExpiry      time.Duration `yaml:"queueExpiry" env:"MQTT_QUEUE_EXPIRY" env-default:"30s"`            // Queued messages that weren't sent in time are dropped, 0 keeps them until they're sent.
+	RetryInterval    time.Duration `yaml:"retryInterval" env:"MQTT_RETRY_INTERVAL" env-default:"1s"`         // Delay before the queued messages are sent again, doubled after every failure.
+	MaxRetryInterval time.Duration `yaml:"maxRetryInterval" env:"MQTT_MAX_RETRY_INTERVAL" env-default:"30s"` // Maximum delay before the queued messages are sent again.
+}
+
+// BrokerConfig runs an embedded MQTT broker, the bridge connects to it instead of the mqtt host
+type BrokerConfig struct {
+	Enabled     bool              `yaml:"enabled" env:"BROKER_ENABLED" env-default:"false"`
+	Host        string            `yaml:"host" env:"BROKER_HOST"`                    // Address the listener binds to, all interfaces when empty.
+	Port        int               `yaml:"port" env:"BROKER_PORT" env-default:"1883"` // Port of the listener, 0 picks a free port.
+	Users       map[string]string `yaml:"users" env:"BROKER_USERS"`                  // Passwords by username, anonymous clients are allowed without users.
+	Persistence string            `yaml:"persistence" env:"BROKER_PERSISTENCE"`      // Bolt database that keeps retained messages and sessions across restarts, in memory when empty.
 }
 
 type DeviceConfig struct {
-	Name            string         `yaml:"name"`
-	Topic           string         `yaml:"topic"`
-	Subscription    string         `yaml:"subscription"`
-	Type            string         `yaml:"type"`
-	WillReportState bool           `yaml:"willReportState"`
-	Attributes      SyncAttributes `yaml:"attributes"`
-	Traits          []string       `yaml:"traits"`
+	Profile         string                   `yaml:"profile"`      // Name of a built-in or user-defined profile the device is based on.
+	FriendlyName    string                   `yaml:"friendlyName"` // Name of the device in its integration, fills the topics of the profile.
+	Name            string                   `yaml:"name"`
+	Nicknames       []string                 `yaml:"nicknames"`
+	DefaultNames    []string                 `yaml:"defaultNames"`
+	RoomHint        string                   `yaml:"roomHint"`
+	Topic           string                   `yaml:"topic"`
+	Subscription    string                   `yaml:"subscription"`
+	Type            string                   `yaml:"type"`
+	WillReportState bool                     `yaml:"willReportState"`
+	Attributes      SyncAttributes           `yaml:"attributes"`
+	Traits          []string                 `yaml:"traits"`
+	DeviceInfo      SyncDeviceInfo           `yaml:"deviceInfo"`
+	OtherDeviceIds  []SyncOtherDeviceIds     `yaml:"otherDeviceIds"`
+	CustomData      map[string]interface{}   `yaml:"customData"`      // Free-form data returned by Google in QUERY and EXECUTE requests, maximum of 512 bytes as json.
+	Commands        map[string]CommandConfig `yaml:"commands"`        // Per command overrides of the topic and global execution template.
+	States          map[string]StateMapping  `yaml:"states"`          // Maps the state payload of the device to Google states, defaults to `on` from the `state` field.
+	Notifications   []NotificationRule       `yaml:"notifications"`   // Rules that send a notification to Google when a state payload matches, e.g. a doorbell ring.
+	Qos             byte                     `yaml:"qos"`             // QoS of the commands, a command can override it.
+	Retain          bool                     `yaml:"retain"`          // Retain the commands on the broker.
+	SubscriptionQos byte                     `yaml:"subscriptionQos"` // QoS of the subscriptions to the state topics.
+	Get             GetConfig                `yaml:"get"`             // Requests the state of the device on QUERY.
+}
+
+// GetConfig requests the state of a device that doesn't publish it periodically,
+// the device answers on its subscription topic
+type GetConfig struct {
+	Topic    string        `yaml:"topic"`    // Topic of the get request, e.g. `zigbee2mqtt/lamp/get`.
+	Template string        `yaml:"template"` // Payload of the get request, defaults to `{"state":""}`.
+	Timeout  time.Duration `yaml:"timeout"`  // How long QUERY waits for the state before answering with the cached state, defaults to 1s.
+}
+
+// CommandConfig overrides how a command is published for a single device,
+// fields that aren't set fall back on the device topic, qos and retain and the global execution template
+type CommandConfig struct {
+	Topic    string `yaml:"topic"`
+	Template string `yaml:"template"`
+	Qos      *byte  `yaml:"qos"`    // Set to override the qos of the device, also with 0.
+	Retain   *bool  `yaml:"retain"` // Set to override the retain flag of the device, also with false.
+}
+
+type SyncDeviceInfo struct {
+	Manufacturer string `yaml:"manufacturer" json:"manufacturer,omitempty"` // Especially useful when the developer is a hub for other devices. Google may provide a standard list of manufacturers here so that e.g. TP-Link and Smartthings both describe 'osram' the same way.
+	Model        string `yaml:"model" json:"model,omitempty"`               // The model or SKU identifier of the particular device.
+	HwVersion    string `yaml:"hwVersion" json:"hwVersion,omitempty"`       // Specific version number attached to the hardware if available.
+	SwVersion    string `yaml:"swVersion" json:"swVersion,omitempty"`       // Specific version number attached to the software/firmware, if available.
+}
+
+type SyncOtherDeviceIds struct {
+	AgentId  string `yaml:"agentId" json:"agentId,omitempty"` // The agent's ID. Generally, this is the project ID in the Actions console.
+	DeviceID string `yaml:"deviceId" json:"deviceId"`         // Required. Device ID defined by the agent. The device ID must be unique.
+}
+
+type DiscoveryConfig struct {
+	Zigbee2mqtt   DiscoverySource `yaml:"zigbee2mqtt"`
+	Homeassistant DiscoverySource `yaml:"homeassistant"`
+	Tasmota       DiscoverySource `yaml:"tasmota"`
+}
+
+// DiscoverySource configures a source of discovered devices, include and exclude are glob patterns
+// matched against the name and the id of a device, overrides are merged into discovered devices by name or id
+type DiscoverySource struct {
+	Enabled   bool                    `yaml:"enabled"`
+	Topic     string                  `yaml:"topic"` // Base topic or discovery prefix, defaults per source.
+	Include   []string                `yaml:"include"`
+	Exclude   []string                `yaml:"exclude"`
+	Overrides map[string]DeviceConfig `yaml:"overrides"`
+}
+
+// UserConfig restricts the devices a credential user can see and control,
+// users without an entry have access to all devices
+type UserConfig struct {
+	Devices []string `yaml:"devices"`
+}
+
+// StateMapping maps a field of the state payload of a device to a Google state, e.g. `brightness`,
+// nested Google states are separated by dots, e.g. `color.spectrumRgb`
+type StateMapping struct {
+	Field    string                 `yaml:"field"`    // Field of the json payload, nested fields are separated by dots. Payloads that aren't a json object are available as `value`.
+	Values   map[string]interface{} `yaml:"values"`   // Maps payload values to Google values, e.g. ON: true.
+	Min      float64                `yaml:"min"`      // Range of the payload value that is scaled to 0-100, scaling is disabled when max is 0.
+	Max      float64                `yaml:"max"`      //
+	Template string                 `yaml:"template"` // text/template with the payload as data, replaces field, an empty result is ignored.
+	Topic    string                 `yaml:"topic"`    // Topic the state is published on, defaults to the subscription of the device.
+}
+
+// NotificationRule sends a HomeGraph notification when a state payload of the device matches,
+// by default only when the payload starts matching so a repeated state doesn't notify again
+type NotificationRule struct {
+	Field    string                 `yaml:"field"`    // Field of the json payload, nested fields are separated by dots.
+	Value    string                 `yaml:"value"`    // Value of the field that fires the notification, e.g. ring.
+	Template string                 `yaml:"template"` // text/template with the payload as data, replaces field and value, fires when the result is `true`.
+	Topic    string                 `yaml:"topic"`    // Topic the payload is published on, defaults to the subscription of the device.
+	Trait    string                 `yaml:"trait"`    // Notification of the trait: ObjectDetection, RunCycle, SensorState or LockUnlock.
+	Priority int                    `yaml:"priority"` // Priority of the notification, 0 is the highest.
+	Payload  map[string]interface{} `yaml:"payload"`  // Content of the notification, e.g. objects: {unclassified: 1}.
+	Repeat   bool                   `yaml:"repeat"`   // Notify on every matching payload, e.g. for event fields like `action`.
 }
 
 type SyncAttributes struct {
@@ -55,9 +212,29 @@ type SyncAttributes struct {
 	ColorModel              string                    `yaml:"colorModel" json:"colorModel,omitempty"`
 	ColorTemperatureRange   SyncColorTemperatureRange `yaml:"colorTemperatureRange" json:"colorTemperatureRange,omitempty"`
 	CommandOnlyColorSetting bool                      `yaml:"commandOnlyColorSetting" json:"commandOnlyColorSetting,omitempty"`
+	// action.devices.traits.Brightness
+	CommandOnlyBrightness bool `yaml:"commandOnlyBrightness" json:"commandOnlyBrightness,omitempty"`
+	// action.devices.traits.FanSpeed
+	SupportsFanSpeedPercent bool `yaml:"supportsFanSpeedPercent" json:"supportsFanSpeedPercent,omitempty"`
+	// action.devices.traits.HumiditySetting
+	QueryOnlyHumiditySetting bool `yaml:"queryOnlyHumiditySetting" json:"queryOnlyHumiditySetting,omitempty"`
 	// action.devices.traits.OnOff
 	CommandOnlyOnOff bool `yaml:"commandOnlyOnOff" json:"commandOnlyOnOff,omitempty"`
 	QueryOnlyOnOff   bool `yaml:"queryOnlyOnOff" json:"queryOnlyOnOff,omitempty"`
+	// action.devices.traits.Scene
+	SceneReversible bool `yaml:"sceneReversible" json:"sceneReversible,omitempty"`
+	// action.devices.traits.OpenClose
+	DiscreteOnlyOpenClose bool     `yaml:"discreteOnlyOpenClose" json:"discreteOnlyOpenClose,omitempty"`
+	OpenDirection         []string `yaml:"openDirection" json:"openDirection,omitempty"`
+	QueryOnlyOpenClose    bool     `yaml:"queryOnlyOpenClose" json:"queryOnlyOpenClose,omitempty"`
+	// action.devices.traits.TemperatureControl
+	TemperatureRange            *SyncTemperatureRange `yaml:"temperatureRange" json:"temperatureRange,omitempty"`
+	TemperatureUnitForUX        string                `yaml:"temperatureUnitForUX" json:"temperatureUnitForUX,omitempty"`
+	QueryOnlyTemperatureControl bool                  `yaml:"queryOnlyTemperatureControl" json:"queryOnlyTemperatureControl,omitempty"`
+	// action.devices.traits.TemperatureSetting
+	AvailableThermostatModes    []string `yaml:"availableThermostatModes" json:"availableThermostatModes,omitempty"`
+	ThermostatTemperatureUnit   string   `yaml:"thermostatTemperatureUnit" json:"thermostatTemperatureUnit,omitempty"`
+	QueryOnlyTemperatureSetting bool     `yaml:"queryOnlyTemperatureSetting" json:"queryOnlyTemperatureSetting,omitempty"`
 	// action.devices.traits.TransportControl
 	TransportControlSupportedCommands []string `yaml:"transportControlSupportedCommands" json:"transportControlSupportedCommands,omitempty"`
 	// action.devices.traits.Volume
@@ -70,22 +247,79 @@ type SyncColorTemperatureRange struct {
 	TemperatureMaxK int `yaml:"temperatureMaxK" json:"temperatureMaxK,omitempty"`
 }
 
+type SyncTemperatureRange struct {
+	MinThresholdCelsius float64 `yaml:"minThresholdCelsius" json:"minThresholdCelsius"`
+	MaxThresholdCelsius float64 `yaml:"maxThresholdCelsius" json:"maxThresholdCelsius"`
+}
+
 type Log struct {
 	Level string `yaml:"level" env:"LOG_LEVEL" env-default:"INFO"`
 }
 
 func ReadConfig() (*Config, error) {
-	filename := getenv("CONFIG_FILE", "config.yaml")
+	return ReadConfigFile(Filename())
+}
+
+// Filename is the config file set by CONFIG_FILE, defaults to config.yaml
+func Filename() string {
+	return getenv("CONFIG_FILE", "config.yaml")
+}
+
+func ReadConfigFile(filename string) (*Config, error) {
 	var cfg Config
-	err := cleanenv.ReadConfig(filename, &cfg)
+	err := parseFile(filename, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file %s: %v", filename, err)
 	}
 
+	err = mergeConfDir(filename, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s:\n%v", filename, err)
+	}
+
+	err = applyProfiles(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+
+	err = Validate(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s:\n%v", filename, err)
+	}
+
 	log.Info("read config", "config", cfg)
 	return &cfg, nil
 }
 
+// parseFile reads the config file with the environment references replaced, then the environment variables and secret files
+func parseFile(filename string, cfg *Config) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	data, err = interpolate(data)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".yaml", ".yml", ".json":
+		// json is valid yaml, so json files use the yaml names of the fields too
+		err = cleanenv.ParseYAML(bytes.NewReader(data), cfg)
+	default:
+		return fmt.Errorf("file format '%s' isn't supported", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config file parsing error: %v", err)
+	}
+
+	err = cleanenv.ReadEnv(cfg)
+	if err != nil {
+		return err
+	}
+	return readSecretFiles(cfg)
+}
+
 func getenv(key, fallback string) string {
 	value := os.Getenv(key)
 	if len(value) == 0 {
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -29,6 +31,7 @@ func TestParseConfig(t *testing.T) {
 			},
 			Credientials: ".credentials",
 			TokenStore:   ".tokenstore",
+			LinkedUsers:  ".linkedusers",
 		},
 		Mqtt: MqttConfig{
 			Host:     "192.168.1.10",
@@ -36,6 +39,24 @@ func TestParseConfig(t *testing.T) {
 			Username: "",
 			Password: "",
 			Tls:      false,
+
+			KeepAlive:            30 * time.Second,
+			MaxReconnectInterval: time.Minute,
+			BaseTopic:            "ghome-mqtt",
+			Events:               true,
+			Control:              false,
+			ProtocolVersion:      4,
+			QueueSize:            100,
+			QueueExpiry:          30 * time.Second,
+			RetryInterval:        time.Second,
+			MaxRetryInterval:     30 * time.Second,
+		},
+		Homegraph: HomegraphConfig{
+			Url:         "https://homegraph.googleapis.com",
+			BatchWindow: time.Second,
+			Retries:     3,
+			RetryDelay:  time.Second,
+			SyncHash:    ".synchash",
 		},
 		Devices: map[string]DeviceConfig{
 			"plug": {
@@ -45,7 +66,7 @@ func TestParseConfig(t *testing.T) {
 				Type:            "action.devices.types.OUTLET",
 				WillReportState: false,
 				Attributes:      SyncAttributes{},
-				Traits:          []string{"action.devices.commands.OnOff"},
+				Traits:          []string{"action.devices.traits.OnOff"},
 			},
 		},
 		ExecutionTemplates: map[string]string{"action.devices.commands.OnOff": "{\"state\":\"%s\"}"},
@@ -58,6 +79,7 @@ func TestParseConfig(t *testing.T) {
 	assert.Equal(t, expectedConfig.Log.Level, cfg.Log.Level)
 	assert.Equal(t, expectedConfig.Auth, cfg.Auth)
 	assert.Equal(t, expectedConfig.Mqtt, cfg.Mqtt)
+	assert.Equal(t, expectedConfig.Homegraph, cfg.Homegraph)
 	assert.Equal(t, expectedConfig.Devices, cfg.Devices)
 	assert.Equal(t, expectedConfig.ExecutionTemplates, cfg.ExecutionTemplates)
 }
@@ -86,6 +108,161 @@ templates:
 	assert.Equal(t, expectedConfig.ExecutionTemplates, config.ExecutionTemplates)
 }
 
+func TestParseConfigDeviceMetadata(t *testing.T) {
+	yamlContent := `
+devices:
+  lamp:
+    name: lamp
+    type: action.devices.types.LIGHT
+    traits: [action.devices.traits.OnOff]
+    topic: lamp/set
+    nicknames: [reading lamp]
+    defaultNames: [hue bulb]
+    roomHint: office
+    deviceInfo:
+      manufacturer: signify
+      model: LCT015
+    otherDeviceIds:
+      - deviceId: local-lamp
+    customData:
+      ieee: "0x0017880104a5b6c7"
+      endpoint: 11
+      flags:
+        dimmable: true
+templates:
+  action.devices.commands.OnOff: '{"state":"%s"}'
+`
+
+	cleanUp := createTempConfig(t, yamlContent)
+	defer cleanUp()
+
+	config, err := ReadConfig()
+
+	require.NoError(t, err)
+	lamp := config.Devices["lamp"]
+	assert.Equal(t, []string{"reading lamp"}, lamp.Nicknames)
+	assert.Equal(t, []string{"hue bulb"}, lamp.DefaultNames)
+	assert.Equal(t, "office", lamp.RoomHint)
+	assert.Equal(t, SyncDeviceInfo{Manufacturer: "signify", Model: "LCT015"}, lamp.DeviceInfo)
+	assert.Equal(t, []SyncOtherDeviceIds{{DeviceID: "local-lamp"}}, lamp.OtherDeviceIds)
+	assert.Equal(t, map[string]interface{}{
+		"ieee":     "0x0017880104a5b6c7",
+		"endpoint": 11,
+		"flags":    map[string]interface{}{"dimmable": true},
+	}, lamp.CustomData)
+}
+
+func TestParseConfigCustomDataTooLarge(t *testing.T) {
+	yamlContent := `
+devices:
+  lamp:
+    name: lamp
+    customData:
+      data: "` + strings.Repeat("x", 512) + `"
+`
+
+	cleanUp := createTempConfig(t, yamlContent)
+	defer cleanUp()
+
+	_, err := ReadConfig()
+
+	assert.ErrorContains(t, err, "customData of device `lamp` is 523 bytes, maximum is 512 bytes")
+}
+
+func TestParseConfigProfiles(t *testing.T) {
+	yamlContent := `
+profiles:
+  my-relay:
+    topic: relays/%s/set
+    subscription: relays/%s
+    get:
+      topic: relays/%s/get
+      timeout: 500ms
+    type: action.devices.types.SWITCH
+    traits: [action.devices.traits.OnOff]
+    commands:
+      action.devices.commands.OnOff:
+        template: '{{ if .Params.on }}1{{ else }}0{{ end }}'
+devices:
+  lamp:
+    profile: zigbee2mqtt-light
+    friendlyName: living/lamp
+    roomHint: living room
+    commands:
+      action.devices.commands.OnOff:
+        qos: 1
+        template: '{"state":"{{ if .Params.on }}ON{{ else }}OFF{{ end }}","transition":2}'
+  pump:
+    profile: my-relay
+    name: pump
+`
+
+	cleanUp := createTempConfig(t, yamlContent)
+	defer cleanUp()
+
+	config, err := ReadConfig()
+
+	require.NoError(t, err)
+	lamp := config.Devices["lamp"]
+	assert.Equal(t, "living/lamp", lamp.Name)
+	assert.Equal(t, "living room", lamp.RoomHint)
+	assert.Equal(t, "zigbee2mqtt/living/lamp/set", lamp.Topic)
+	assert.Equal(t, "zigbee2mqtt/living/lamp", lamp.Subscription)
+	assert.Equal(t, "action.devices.types.LIGHT", lamp.Type)
+	assert.Equal(t, Profiles["zigbee2mqtt-light"].Traits, lamp.Traits)
+	assert.Equal(t, "rgb", lamp.Attributes.ColorModel)
+	assert.Equal(t, CommandConfig{Template: `{"state":"{{ if .Params.on }}ON{{ else }}OFF{{ end }}","transition":2}`, Qos: ptr(byte(1))}, lamp.Commands["action.devices.commands.OnOff"])
+	assert.Equal(t, Profiles["zigbee2mqtt-light"].Commands["action.devices.commands.BrightnessAbsolute"], lamp.Commands["action.devices.commands.BrightnessAbsolute"])
+	assert.Equal(t, Profiles["zigbee2mqtt-light"].States, lamp.States)
+
+	pump := config.Devices["pump"]
+	assert.Equal(t, "relays/pump/set", pump.Topic)
+	assert.Equal(t, "relays/pump", pump.Subscription)
+	assert.Equal(t, GetConfig{Topic: "relays/pump/get", Timeout: 500 * time.Millisecond}, pump.Get)
+	assert.Equal(t, []string{"action.devices.traits.OnOff"}, pump.Traits)
+}
+
+func TestParseConfigUnknownProfile(t *testing.T) {
+	yamlContent := `
+devices:
+  lamp:
+    profile: unknown
+    friendlyName: lamp
+`
+
+	cleanUp := createTempConfig(t, yamlContent)
+	defer cleanUp()
+
+	_, err := ReadConfig()
+
+	assert.ErrorContains(t, err, "device `lamp`: unknown profile `unknown`")
+}
+
+func TestApplyProfileCommandTopics(t *testing.T) {
+	device, err := ApplyProfile(DeviceConfig{Profile: "tasmota-dimmer", FriendlyName: "desk"}, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, "cmnd/desk/POWER", device.Topic)
+	assert.Equal(t, "stat/desk/RESULT", device.Subscription)
+	assert.Equal(t, "cmnd/desk/Dimmer", device.Commands["action.devices.commands.BrightnessAbsolute"].Topic)
+	assert.Equal(t, "cmnd/%s/Dimmer", Profiles["tasmota-dimmer"].Commands["action.devices.commands.BrightnessAbsolute"].Topic)
+}
+
+func TestApplyProfileStateAndNotificationTopics(t *testing.T) {
+	profiles := map[string]DeviceConfig{"doorbell": {
+		Subscription:  "doorbells/%s",
+		States:        map[string]StateMapping{"on": {Field: "state", Topic: "doorbells/%s/power"}},
+		Notifications: []NotificationRule{{Field: "action", Value: "ring", Topic: "doorbells/%s/action", Trait: "ObjectDetection"}},
+	}}
+
+	device, err := ApplyProfile(DeviceConfig{Profile: "doorbell", FriendlyName: "front"}, profiles)
+
+	require.NoError(t, err)
+	assert.Equal(t, "doorbells/front/power", device.States["on"].Topic)
+	assert.Equal(t, "doorbells/front/action", device.Notifications[0].Topic)
+	assert.Equal(t, "doorbells/%s/action", profiles["doorbell"].Notifications[0].Topic)
+}
+
 func createTempConfig(t *testing.T, yamlContent string) func() {
 	tempFile, err := os.CreateTemp("", "*test-config.yaml")
 	if err != nil {
@@ -108,3 +285,7 @@ func createTempConfig(t *testing.T, yamlContent string) func() {
 
 	return cleanUp
 }
+
+func ptr[T any](value T) *T {
+	return &value
+}
@@ -0,0 +1,292 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+const (
+	onOff              = "action.devices.commands.OnOff"
+	brightnessAbsolute = "action.devices.commands.BrightnessAbsolute"
+	colorAbsolute      = "action.devices.commands.ColorAbsolute"
+	openClose          = "action.devices.commands.OpenClose"
+	setpoint           = "action.devices.commands.ThermostatTemperatureSetpoint"
+	setMode            = "action.devices.commands.ThermostatSetMode"
+	lockUnlock         = "action.devices.commands.LockUnlock"
+)
+
+var onOffValues = map[string]interface{}{"ON": true, "OFF": false}
+
+// Profiles are built-in device definitions, `%s` in the topics is replaced with the friendly name of the device
+var Profiles = map[string]DeviceConfig{
+	"zigbee2mqtt-light": {
+		Topic:        "zigbee2mqtt/%s/set",
+		Subscription: "zigbee2mqtt/%s",
+		Type:         "action.devices.types.LIGHT",
+		Traits: []string{
+			"action.devices.traits.OnOff",
+			"action.devices.traits.Brightness",
+			"action.devices.traits.ColorSetting",
+		},
+		Attributes: SyncAttributes{
+			ColorModel:            "rgb",
+			ColorTemperatureRange: SyncColorTemperatureRange{TemperatureMinK: 2200, TemperatureMaxK: 6500},
+		},
+		Commands: map[string]CommandConfig{
+			onOff:              {Template: `{"state":"{{ if .Params.on }}ON{{ else }}OFF{{ end }}"}`},
+			brightnessAbsolute: {Template: `{"brightness":{{ scale .Params.brightness 0 100 0 254 | round }}}`},
+			colorAbsolute:      {Template: `{{ if .Params.color.temperature }}{"color_temp":{{ kelvinToMired .Params.color.temperature }}}{{ else }}{"color":{"hex":"#{{ spectrumToHex .Params.color.spectrumRGB }}"}}{{ end }}`},
+		},
+		States: map[string]StateMapping{
+			"on":                 {Field: "state", Values: onOffValues},
+			"brightness":         {Field: "brightness", Max: 254},
+			"color.temperatureK": {Template: `{{ if and .color_mode (eq .color_mode "color_temp") }}{{ miredToKelvin .color_temp }}{{ end }}`},
+			"color.spectrumRgb":  {Template: `{{ if and .color_mode (eq .color_mode "xy") }}{{ xyToSpectrum .color.x .color.y }}{{ end }}`},
+		},
+	},
+	"zigbee2mqtt-plug": {
+		Topic:        "zigbee2mqtt/%s/set",
+		Subscription: "zigbee2mqtt/%s",
+		Type:         "action.devices.types.OUTLET",
+		Traits:       []string{"action.devices.traits.OnOff"},
+		Commands: map[string]CommandConfig{
+			onOff: {Template: `{"state":"{{ if .Params.on }}ON{{ else }}OFF{{ end }}"}`},
+		},
+		States: map[string]StateMapping{
+			"on": {Field: "state", Values: onOffValues},
+		},
+	},
+	"zigbee2mqtt-cover": {
+		Topic:        "zigbee2mqtt/%s/set",
+		Subscription: "zigbee2mqtt/%s",
+		Type:         "action.devices.types.BLINDS",
+		Traits:       []string{"action.devices.traits.OpenClose"},
+		Commands: map[string]CommandConfig{
+			openClose: {Template: `{"position":{{ .Params.openPercent }}}`},
+		},
+		States: map[string]StateMapping{
+			"openPercent": {Field: "position"},
+		},
+	},
+	"zigbee2mqtt-thermostat": {
+		Topic:        "zigbee2mqtt/%s/set",
+		Subscription: "zigbee2mqtt/%s",
+		Type:         "action.devices.types.THERMOSTAT",
+		Traits:       []string{"action.devices.traits.TemperatureSetting"},
+		Attributes: SyncAttributes{
+			AvailableThermostatModes:  []string{"off", "heat", "auto"},
+			ThermostatTemperatureUnit: "C",
+		},
+		Commands: map[string]CommandConfig{
+			setpoint: {Template: `{"current_heating_setpoint":{{ .Params.thermostatTemperatureSetpoint }}}`},
+			setMode:  {Template: `{"system_mode":"{{ .Params.thermostatMode }}"}`},
+		},
+		States: map[string]StateMapping{
+			"thermostatMode":                {Field: "system_mode"},
+			"thermostatTemperatureSetpoint": {Field: "current_heating_setpoint"},
+			"thermostatTemperatureAmbient":  {Field: "local_temperature"},
+		},
+	},
+	"zigbee2mqtt-lock": {
+		Topic:        "zigbee2mqtt/%s/set",
+		Subscription: "zigbee2mqtt/%s",
+		Type:         "action.devices.types.LOCK",
+		Traits:       []string{"action.devices.traits.LockUnlock"},
+		Commands: map[string]CommandConfig{
+			lockUnlock: {Template: `{"state":"{{ if .Params.lock }}LOCK{{ else }}UNLOCK{{ end }}"}`},
+		},
+		States: map[string]StateMapping{
+			"isLocked": {Field: "state", Values: map[string]interface{}{"LOCK": true, "UNLOCK": false}},
+		},
+	},
+	"tasmota-relay": {
+		Topic:        "cmnd/%s/POWER",
+		Subscription: "stat/%s/RESULT",
+		Type:         "action.devices.types.SWITCH",
+		Traits:       []string{"action.devices.traits.OnOff"},
+		Commands: map[string]CommandConfig{
+			onOff: {Template: `{{ if .Params.on }}ON{{ else }}OFF{{ end }}`},
+		},
+		States: map[string]StateMapping{
+			"on": {Field: "POWER", Values: onOffValues},
+		},
+	},
+	"tasmota-dimmer": {
+		Topic:        "cmnd/%s/POWER",
+		Subscription: "stat/%s/RESULT",
+		Type:         "action.devices.types.LIGHT",
+		Traits: []string{
+			"action.devices.traits.OnOff",
+			"action.devices.traits.Brightness",
+		},
+		Commands: map[string]CommandConfig{
+			onOff:              {Template: `{{ if .Params.on }}ON{{ else }}OFF{{ end }}`},
+			brightnessAbsolute: {Topic: "cmnd/%s/Dimmer", Template: `{{ .Params.brightness }}`},
+		},
+		States: map[string]StateMapping{
+			"on":         {Field: "POWER", Values: onOffValues},
+			"brightness": {Field: "Dimmer"},
+		},
+	},
+	"shelly-gen1-relay": {
+		Topic:        "shellies/%s/relay/0/command",
+		Subscription: "shellies/%s/relay/0",
+		Type:         "action.devices.types.SWITCH",
+		Traits:       []string{"action.devices.traits.OnOff"},
+		Commands: map[string]CommandConfig{
+			onOff: {Template: `{{ if .Params.on }}on{{ else }}off{{ end }}`},
+		},
+		States: map[string]StateMapping{
+			"on": {Field: "value", Values: map[string]interface{}{"on": true, "off": false}},
+		},
+	},
+	"shelly-gen2-relay": {
+		Topic:        "%s/rpc",
+		Subscription: "%s/status/switch:0",
+		Type:         "action.devices.types.SWITCH",
+		Traits:       []string{"action.devices.traits.OnOff"},
+		Commands: map[string]CommandConfig{
+			onOff: {Template: `{"id":1,"src":"ghome-mqtt","method":"Switch.Set","params":{"id":0,"on":{{ if .Params.on }}true{{ else }}false{{ end }}}}`},
+		},
+		States: map[string]StateMapping{
+			"on": {Field: "output"},
+		},
+	},
+	"esphome-switch": {
+		Topic:        "%s/command",
+		Subscription: "%s/state",
+		Type:         "action.devices.types.SWITCH",
+		Traits:       []string{"action.devices.traits.OnOff"},
+		Commands: map[string]CommandConfig{
+			onOff: {Template: `{{ if .Params.on }}ON{{ else }}OFF{{ end }}`},
+		},
+		States: map[string]StateMapping{
+			"on": {Field: "value", Values: onOffValues},
+		},
+	},
+	"esphome-light": {
+		Topic:        "%s/command",
+		Subscription: "%s/state",
+		Type:         "action.devices.types.LIGHT",
+		Traits: []string{
+			"action.devices.traits.OnOff",
+			"action.devices.traits.Brightness",
+			"action.devices.traits.ColorSetting",
+		},
+		Attributes: SyncAttributes{
+			ColorModel: "rgb",
+		},
+		Commands: map[string]CommandConfig{
+			onOff:              {Template: `{"state":"{{ if .Params.on }}ON{{ else }}OFF{{ end }}"}`},
+			brightnessAbsolute: {Template: `{"state":"ON","brightness":{{ scale .Params.brightness 0 100 0 255 | round }}}`},
+			colorAbsolute:      {Template: `{{ $rgb := spectrumToRgb .Params.color.spectrumRGB }}{"state":"ON","color":{"r":{{ $rgb.r }},"g":{{ $rgb.g }},"b":{{ $rgb.b }}}}`},
+		},
+		States: map[string]StateMapping{
+			"on":                {Field: "state", Values: onOffValues},
+			"brightness":        {Field: "brightness", Max: 255},
+			"color.spectrumRgb": {Template: `{{ if .color }}{{ rgbToSpectrum .color.r .color.g .color.b }}{{ end }}`},
+		},
+	},
+}
+
+// ApplyProfile fills the device with the built-in or user-defined profile it refers to,
+// fields set on the device take precedence over the profile
+func ApplyProfile(device DeviceConfig, profiles map[string]DeviceConfig) (DeviceConfig, error) {
+	profile, ok := profiles[device.Profile]
+	if !ok {
+		profile, ok = Profiles[device.Profile]
+	}
+	if !ok {
+		return device, fmt.Errorf("unknown profile `%s`", device.Profile)
+	}
+
+	name := device.FriendlyName
+	if name == "" {
+		name = device.Name
+	}
+	if name == "" {
+		return device, fmt.Errorf("profile `%s` requires a friendlyName", device.Profile)
+	}
+
+	resolved := MergeDevice(instantiateProfile(profile, name), device)
+	if resolved.Name == "" {
+		resolved.Name = name
+	}
+	return resolved, nil
+}
+
+func applyProfiles(cfg *Config) error {
+	for id, device := range cfg.Devices {
+		if device.Profile == "" {
+			continue
+		}
+
+		resolved, err := ApplyProfile(device, cfg.Profiles)
+		if err != nil {
+			return fmt.Errorf("device `%s`: %v", id, err)
+		}
+		cfg.Devices[id] = resolved
+	}
+	return nil
+}
+
+// instantiateProfile returns a copy of the profile for the device with the name filled in the topics
+func instantiateProfile(profile DeviceConfig, name string) DeviceConfig {
+	profile.Topic = strings.ReplaceAll(profile.Topic, "%s", name)
+	profile.Subscription = strings.ReplaceAll(profile.Subscription, "%s", name)
+	profile.Get.Topic = strings.ReplaceAll(profile.Get.Topic, "%s", name)
+
+	commands := map[string]CommandConfig{}
+	for command, commandConfig := range profile.Commands {
+		commandConfig.Topic = strings.ReplaceAll(commandConfig.Topic, "%s", name)
+		commands[command] = commandConfig
+	}
+	profile.Commands = commands
+
+	states := map[string]StateMapping{}
+	for state, mapping := range profile.States {
+		mapping.Topic = strings.ReplaceAll(mapping.Topic, "%s", name)
+		states[state] = mapping
+	}
+	profile.States = states
+
+	notifications := slices.Clone(profile.Notifications)
+	for i := range notifications {
+		notifications[i].Topic = strings.ReplaceAll(notifications[i].Topic, "%s", name)
+	}
+	profile.Notifications = notifications
+	profile.Traits = slices.Clone(profile.Traits)
+	return profile
+}
+
+// MergeDevice returns base with all fields that are set in override replaced,
+// maps are merged by key with the values of override taking precedence.
+// Zero values like false and 0 aren't set, so an override can't turn off e.g. the willReportState of base.
+func MergeDevice(base DeviceConfig, override DeviceConfig) DeviceConfig {
+	merged := reflect.ValueOf(&base).Elem()
+	overrides := reflect.ValueOf(override)
+	for i := 0; i < overrides.NumField(); i++ {
+		field := overrides.Field(i)
+		if field.IsZero() {
+			continue
+		}
+
+		target := merged.Field(i)
+		if field.Kind() != reflect.Map || target.IsNil() {
+			target.Set(field)
+			continue
+		}
+
+		values := reflect.MakeMap(target.Type())
+		for _, maps := range []reflect.Value{target, field} {
+			iter := maps.MapRange()
+			for iter.Next() {
+				values.SetMapIndex(iter.Key(), iter.Value())
+			}
+		}
+		target.Set(values)
+	}
+	return base
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"fmt"
+	log "log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[redacted]"
+
+// envReference matches `${NAME}` and `${NAME:-default}`, `$${NAME}` escapes the reference
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate replaces the environment references in the values of the config file, a reference without default must be set,
+// the file is parsed first so a value can't change the structure of the file and references in comments are ignored
+func interpolate(data []byte) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if document.Kind == 0 {
+		return data, nil
+	}
+
+	var missing []string
+	if !interpolateNode(&document, &missing) {
+		// files without references are kept as they are, so errors point to the lines of the file
+		return data, nil
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables %s aren't set", strings.Join(missing, ", "))
+	}
+	return yaml.Marshal(&document)
+}
+
+// interpolateNode replaces the references in the values of the node and its children, it reports whether there were any
+func interpolateNode(node *yaml.Node, missing *[]string) bool {
+	replaced := false
+	if node.Kind == yaml.ScalarNode && envReference.MatchString(node.Value) {
+		replaced = true
+		node.Value = envReference.ReplaceAllStringFunc(node.Value, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+
+			match := envReference.FindStringSubmatch(reference)
+			name, hasDefault, fallback := match[1], len(match[2]) > 0, match[3]
+			if value, ok := os.LookupEnv(name); ok {
+				return value
+			}
+			if !hasDefault {
+				*missing = append(*missing, name)
+			}
+			return fallback
+		})
+		if node.Style == 0 {
+			// the type of a plain value follows the replaced value, e.g. the number of a port
+			node.Tag = ""
+		}
+	}
+	for _, child := range node.Content {
+		if interpolateNode(child, missing) {
+			replaced = true
+		}
+	}
+	return replaced
+}
+
+// readSecretFiles reads the secrets from the files in the `<NAME>_FILE` environment variables, e.g. Docker or Kubernetes secrets
+func readSecretFiles(cfg *Config) error {
+	secrets := []struct {
+		env   string
+		value *string
+	}{
+		{"CLIENT_ID", &cfg.Auth.Client.Id},
+		{"CLIENT_SECRET", &cfg.Auth.Client.Secret},
+		{"MQTT_BROKER_USERNAME", &cfg.Mqtt.Username},
+		{"MQTT_BROKER_PASSWORD", &cfg.Mqtt.Password},
+	}
+
+	for _, secret := range secrets {
+		filename := os.Getenv(secret.env + "_FILE")
+		if filename == "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(secret.env); ok {
+			return fmt.Errorf("both %s and %s_FILE are set", secret.env, secret.env)
+		}
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %v", secret.env, err)
+		}
+		*secret.value = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+// Redact hides a secret, an empty secret stays empty so it shows that it isn't set
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// String hides the client secret
+func (c AuthConfig) String() string {
+	type plain AuthConfig
+	c.Client.Secret = Redact(c.Client.Secret)
+	return fmt.Sprintf("%+v", plain(c))
+}
+
+func (c AuthConfig) LogValue() log.Value {
+	return log.GroupValue(
+		log.String("clientId", c.Client.Id),
+		log.String("clientSecret", Redact(c.Client.Secret)),
+		log.String("clientDomain", c.Client.Domain),
+		log.String("credentials", c.Credientials),
+		log.String("tokenStore", c.TokenStore),
+		log.String("linkedUsers", c.LinkedUsers),
+	)
+}
+
+// String hides the password
+func (c MqttConfig) String() string {
+	type plain MqttConfig
+	c.Password = Redact(c.Password)
+	c.Headers = redactValues(c.Headers)
+	return fmt.Sprintf("%+v", plain(c))
+}
+
+func (c MqttConfig) LogValue() log.Value {
+	return log.GroupValue(
+		log.String("host", c.Host),
+		log.Int("port", c.Port),
+		log.String("username", c.Username),
+		log.String("password", Redact(c.Password)),
+		log.Bool("tls", c.Tls),
+		log.String("caFile", c.CaFile),
+		log.String("certFile", c.CertFile),
+		log.String("keyFile", c.KeyFile),
+		log.String("serverName", c.ServerName),
+		log.Bool("insecureSkipVerify", c.InsecureSkipVerify),
+		log.Any("brokers", c.Brokers),
+		log.Any("headers", redactValues(c.Headers)),
+		log.String("clientId", c.ClientId),
+		log.Duration("keepAlive", c.KeepAlive),
+		log.Duration("maxReconnectInterval", c.MaxReconnectInterval),
+		log.String("baseTopic", c.BaseTopic),
+		log.String("statusTopic", c.StatusTopic),
+		log.Bool("events", c.Events),
+		log.String("eventTopic", c.EventTopic),
+		log.Bool("control", c.Control),
+		log.Int("protocolVersion", int(c.ProtocolVersion)),
+		log.Any("userProperties", c.UserProperties),
+		log.Duration("messageExpiry", c.MessageExpiry),
+		log.Int("queueSize", c.QueueSize),
+		log.Duration("queueExpiry", c.QueueExpiry),
+		log.Duration("retryInterval", c.RetryInterval),
+		log.Duration("maxRetryInterval", c.MaxRetryInterval),
+	)
+}
+
+// String hides the passwords of the users
+func (c BrokerConfig) String() string {
+	type plain BrokerConfig
+	c.Users = redactValues(c.Users)
+	return fmt.Sprintf("%+v", plain(c))
+}
+
+func (c BrokerConfig) LogValue() log.Value {
+	return log.GroupValue(
+		log.Bool("enabled", c.Enabled),
+		log.String("host", c.Host),
+		log.Int("port", c.Port),
+		log.Int("users", len(c.Users)),
+		log.String("persistence", c.Persistence),
+	)
+}
+
+// redactValues hides the values of the map, e.g. headers or passwords by username
+func redactValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	result := make(map[string]string, len(values))
+	for name, value := range values {
+		result[name] = Redact(value)
+	}
+	return result
+}
+
+// String hides the secrets of the config
+func (c Config) String() string {
+	type plain Config
+	return fmt.Sprintf("%+v", plain(c))
+}
+
+// LogValue logs a summary of the config without secrets
+func (c Config) LogValue() log.Value {
+	return log.GroupValue(
+		log.Any("server", c.Server),
+		log.Any("auth", c.Auth),
+		log.Any("mqtt", c.Mqtt),
+		log.Any("broker", c.Broker),
+		log.Any("homegraph", c.Homegraph),
+		log.Int("devices", len(c.Devices)),
+		log.Int("templates", len(c.ExecutionTemplates)),
+		log.Int("users", len(c.Users)),
+		log.Int("profiles", len(c.Profiles)),
+		log.Any("discovery", c.Discovery),
+		log.String("log", c.Log.Level),
+	)
+}
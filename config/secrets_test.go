@@ -0,0 +1,107 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	log "log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("BROKER_HOST", "broker.local")
+	t.Setenv("EMPTY", "")
+	t.Setenv("SECRET", "pass: word #1 \"quoted\"\nsecond line")
+
+	tests := []struct {
+		name          string
+		content       string
+		expected      map[string]interface{}
+		expectedError string
+	}{
+		{name: "Variable", content: "host: ${BROKER_HOST}", expected: map[string]interface{}{"host": "broker.local"}},
+		{name: "Default", content: "port: ${BROKER_PORT:-1883}", expected: map[string]interface{}{"port": 1883}},
+		{name: "Set variable ignores the default", content: "host: ${BROKER_HOST:-localhost}", expected: map[string]interface{}{"host": "broker.local"}},
+		{name: "Empty variable", content: "password: '${EMPTY}'", expected: map[string]interface{}{"password": ""}},
+		{name: "Escaped reference", content: "template: '$${BROKER_HOST}'", expected: map[string]interface{}{"template": "${BROKER_HOST}"}},
+		{name: "Other dollar signs", content: "template: '{{ $value := .state }}$5'", expected: map[string]interface{}{"template": "{{ $value := .state }}$5"}},
+		{name: "Value with yaml syntax", content: "password: ${SECRET}\nhost: ${BROKER_HOST}", expected: map[string]interface{}{"password": "pass: word #1 \"quoted\"\nsecond line", "host": "broker.local"}},
+		{name: "Reference in a comment", content: "# password: ${BROKER_PASSWORD}\nhost: ${BROKER_HOST}", expected: map[string]interface{}{"host": "broker.local"}},
+		{name: "Missing variables", content: "user: ${BROKER_USER}\npassword: ${BROKER_PASSWORD}", expectedError: "environment variables BROKER_USER, BROKER_PASSWORD aren't set"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := interpolate([]byte(test.content))
+
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			var values map[string]interface{}
+			require.NoError(t, yaml.Unmarshal(result, &values))
+			assert.Equal(t, test.expected, values)
+		})
+	}
+}
+
+func TestParseConfigSecrets(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "client_secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("file-secret\n"), 0600))
+	t.Setenv("CLIENT_SECRET_FILE", secretFile)
+	t.Setenv("TEST_MQTT_PASSWORD", "env-password")
+
+	cleanUp := createTempConfig(t, `
+mqtt:
+  username: bridge
+  password: ${TEST_MQTT_PASSWORD}
+`)
+	defer cleanUp()
+
+	cfg, err := ReadConfig()
+
+	require.NoError(t, err)
+	assert.Equal(t, "file-secret", cfg.Auth.Client.Secret)
+	assert.Equal(t, "bridge", cfg.Mqtt.Username)
+	assert.Equal(t, "env-password", cfg.Mqtt.Password)
+}
+
+func TestParseConfigSecretFileConflict(t *testing.T) {
+	t.Setenv("MQTT_BROKER_PASSWORD", "password")
+	t.Setenv("MQTT_BROKER_PASSWORD_FILE", "/run/secrets/mqtt_password")
+	cleanUp := createTempConfig(t, "mqtt:\n  host: localhost\n")
+	defer cleanUp()
+
+	_, err := ReadConfig()
+
+	assert.ErrorContains(t, err, "both MQTT_BROKER_PASSWORD and MQTT_BROKER_PASSWORD_FILE are set")
+}
+
+func TestRedactSecrets(t *testing.T) {
+	cfg := Config{
+		Mqtt:   MqttConfig{Host: "broker", Username: "bridge", Password: "mqtt-password"},
+		Broker: BrokerConfig{Users: map[string]string{"sensor": "broker-password"}},
+	}
+	cfg.Auth.Client.Id = "client"
+	cfg.Auth.Client.Secret = "client-secret"
+
+	var output bytes.Buffer
+	logger := log.New(log.NewTextHandler(&output, nil))
+	logger.Info("read config", "config", cfg)
+	logger.Info("read config", "config", &cfg)
+	logger.Info("read config", "mqtt", cfg.Mqtt, "auth", cfg.Auth)
+
+	for _, text := range []string{output.String(), cfg.String(), fmt.Sprintf("%v", cfg), fmt.Sprintf("%+v", &cfg)} {
+		assert.NotContains(t, text, "mqtt-password")
+		assert.NotContains(t, text, "client-secret")
+		assert.NotContains(t, text, "broker-password")
+		assert.Contains(t, text, "[redacted]")
+		assert.Contains(t, text, "broker")
+	}
+}
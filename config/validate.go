@@ -0,0 +1,371 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// maxCustomDataSize is the maximum size Google accepts for the customData of a device
+const maxCustomDataSize = 512
+
+const (
+	typePrefix    = "action.devices.types."
+	traitPrefix   = "action.devices.traits."
+	commandPrefix = "action.devices.commands."
+)
+
+// brokerSchemes are the broker url schemes the mqtt client supports
+var brokerSchemes = []string{"tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss", "unix"}
+
+// deviceTypes are the device types Google supports
+var deviceTypes = []string{
+	"AC_UNIT", "AIRCOOLER", "AIRFRESHENER", "AIRPURIFIER", "AUDIO_VIDEO_RECEIVER", "AWNING", "BATHTUB", "BED",
+	"BLENDER", "BLINDS", "BOILER", "CAMERA", "CARBON_MONOXIDE_DETECTOR", "CHARGER", "CLOSET", "COFFEE_MAKER",
+	"COOKTOP", "CURTAIN", "DEHUMIDIFIER", "DEHYDRATOR", "DISHWASHER", "DOOR", "DOORBELL", "DRAWER", "DRYER", "FAN",
+	"FAUCET", "FIREPLACE", "FREEZER", "FRYER", "GAME_CONSOLE", "GARAGE", "GATE", "GRILL", "HEATER", "HOOD",
+	"HUMIDIFIER", "KETTLE", "LIGHT", "LOCK", "MICROWAVE", "MOP", "MOWER", "MULTICOOKER", "NETWORK", "OUTLET", "OVEN",
+	"PERGOLA", "PETFEEDER", "PRESSURECOOKER", "RADIATOR", "REFRIGERATOR", "REMOTECONTROL", "ROUTER", "SCENE",
+	"SECURITYSYSTEM", "SENSOR", "SETTOP", "SHOWER", "SHUTTER", "SMOKE_DETECTOR", "SOUNDBAR", "SOUSVIDE", "SPEAKER",
+	"SPRINKLER", "STANDMIXER", "STREAMING_BOX", "STREAMING_SOUNDBAR", "STREAMING_STICK", "SWITCH", "THERMOSTAT", "TV",
+	"VACUUM", "VALVE", "WASHER", "WATERHEATER", "WATERPURIFIER", "WATERSOFTENER", "WINDOW", "YOGURTMAKER",
+}
+
+// traitCommands are the traits Google supports with the commands a device of the trait must handle,
+// commands that are optional for a trait, like ThermostatTemperatureSetRange, aren't required
+var traitCommands = map[string][]string{
+	"AppSelector":        {"appSelect"},
+	"ArmDisarm":          {"ArmDisarm"},
+	"Brightness":         {"BrightnessAbsolute"},
+	"CameraStream":       nil,
+	"Channel":            {"selectChannel"},
+	"ColorSetting":       {"ColorAbsolute"},
+	"Cook":               {"Cook"},
+	"Dispense":           {"Dispense"},
+	"Dock":               {"Dock"},
+	"EnergyStorage":      nil,
+	"FanSpeed":           {"SetFanSpeed"},
+	"Fill":               {"Fill"},
+	"HumiditySetting":    {"SetHumidity"},
+	"InputSelector":      {"SetInput"},
+	"LightEffects":       nil,
+	"Locator":            {"Locate"},
+	"LockUnlock":         {"LockUnlock"},
+	"MediaState":         nil,
+	"Modes":              {"SetModes"},
+	"NetworkControl":     nil,
+	"ObjectDetection":    nil,
+	"OnOff":              {"OnOff"},
+	"OpenClose":          {"OpenClose"},
+	"Reboot":             {"Reboot"},
+	"Rotation":           {"RotateAbsolute"},
+	"RunCycle":           nil,
+	"Scene":              {"ActivateScene"},
+	"SensorState":        nil,
+	"SoftwareUpdate":     {"SoftwareUpdate"},
+	"StartStop":          {"StartStop"},
+	"StatusReport":       nil,
+	"TemperatureControl": {"SetTemperature"},
+	"TemperatureSetting": {"ThermostatTemperatureSetpoint"},
+	"Timer":              nil,
+	"Toggles":            {"SetToggles"},
+	"TransportControl":   nil,
+	"Volume":             {"setVolume", "volumeRelative"},
+}
+
+// notificationTraits are the traits that support notifications
+var notificationTraits = []string{"ObjectDetection", "RunCycle", "SensorState", "LockUnlock"}
+
+var (
+	colorModels      = []string{"rgb", "hsv"}
+	temperatureUnits = []string{"C", "F"}
+	thermostatModes  = []string{"off", "heat", "cool", "on", "heatcool", "auto", "fan-only", "purifier", "eco", "dry"}
+	openDirections   = []string{"UP", "DOWN", "LEFT", "RIGHT", "IN", "OUT"}
+)
+
+// Validate checks the config for problems Google or the bridge can't handle, all problems are returned at once
+func Validate(cfg *Config) error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if cfg.Server.Port < 0 || cfg.Server.Port > 65535 {
+		problem("server: port %d is out of range", cfg.Server.Port)
+	}
+	if cfg.Mqtt.Port < 0 || cfg.Mqtt.Port > 65535 {
+		problem("mqtt: port %d is out of range", cfg.Mqtt.Port)
+	}
+	for _, topic := range []string{cfg.Mqtt.BaseTopic, cfg.Mqtt.StatusTopic, cfg.Mqtt.EventTopic} {
+		if strings.ContainsAny(topic, "+#") {
+			problem("mqtt: topic `%s` can't contain wildcards", topic)
+		}
+	}
+	for _, broker := range cfg.Mqtt.Brokers {
+		if err := validateBroker(broker); err != nil {
+			problem("mqtt: broker `%s`: %v", broker, err)
+		} else if cfg.Mqtt.ProtocolVersion == 5 && strings.HasPrefix(broker, "unix:") {
+			problem("mqtt: broker `%s`: unix sockets aren't supported with protocolVersion 5", broker)
+		}
+	}
+	switch cfg.Mqtt.ProtocolVersion {
+	case 0, 3, 4:
+		if len(cfg.Mqtt.UserProperties) > 0 || cfg.Mqtt.MessageExpiry != 0 {
+			problem("mqtt: userProperties and messageExpiry need protocolVersion 5")
+		}
+	case 5:
+	default:
+		problem("mqtt: protocolVersion %d isn't supported, use 3, 4 or 5", cfg.Mqtt.ProtocolVersion)
+	}
+	if cfg.Mqtt.QueueSize < 0 {
+		problem("mqtt: queueSize %d can't be negative", cfg.Mqtt.QueueSize)
+	}
+	if cfg.Mqtt.MaxRetryInterval < cfg.Mqtt.RetryInterval {
+		problem("mqtt: maxRetryInterval %s is below retryInterval %s", cfg.Mqtt.MaxRetryInterval, cfg.Mqtt.RetryInterval)
+	}
+	if cfg.Broker.Port < 0 || cfg.Broker.Port > 65535 {
+		problem("broker: port %d is out of range", cfg.Broker.Port)
+	}
+	for _, username := range sortedKeys(cfg.Broker.Users) {
+		if username == "" || cfg.Broker.Users[username] == "" {
+			problem("broker: user `%s` needs a username and password", username)
+		}
+	}
+
+	otherDeviceIds := map[string]string{}
+	for _, id := range sortedKeys(cfg.Devices) {
+		device := cfg.Devices[id]
+		for _, err := range validateDevice(id, device, cfg.ExecutionTemplates) {
+			problem("device `%s`: %v", id, err)
+		}
+		if device.CustomData != nil {
+			data, err := json.Marshal(device.CustomData)
+			if err != nil {
+				problem("customData of device `%s` can't be converted to json: %v", id, err)
+			} else if len(data) > maxCustomDataSize {
+				problem("customData of device `%s` is %d bytes, maximum is %d bytes", id, len(data), maxCustomDataSize)
+			}
+		}
+
+		for _, otherDeviceId := range device.OtherDeviceIds {
+			if other, ok := otherDeviceIds[otherDeviceId.DeviceID]; ok {
+				problem("device `%s`: otherDeviceId `%s` is already used by device `%s`", id, otherDeviceId.DeviceID, other)
+				continue
+			}
+			otherDeviceIds[otherDeviceId.DeviceID] = id
+		}
+	}
+
+	for command, template := range cfg.ExecutionTemplates {
+		if strings.TrimSpace(template) == "" {
+			problem("template `%s` is empty", command)
+		}
+	}
+	return errors.Join(problems...)
+}
+
+func validateDevice(id string, device DeviceConfig, templates map[string]string) []error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if strings.TrimSpace(id) == "" {
+		problem("id is empty")
+	}
+	if device.Name == "" {
+		problem("name is empty")
+	}
+	if device.Type == "" {
+		problem("type is empty")
+	} else if !slices.Contains(deviceTypes, strings.TrimPrefix(device.Type, typePrefix)) || !strings.HasPrefix(device.Type, typePrefix) {
+		problem("unknown type `%s`", device.Type)
+	}
+
+	if device.Qos > 2 {
+		problem("qos %d is invalid, use 0, 1 or 2", device.Qos)
+	}
+	if device.SubscriptionQos > 2 {
+		problem("subscriptionQos %d is invalid, use 0, 1 or 2", device.SubscriptionQos)
+	}
+	for _, command := range sortedKeys(device.Commands) {
+		if qos := device.Commands[command].Qos; qos != nil && *qos > 2 {
+			problem("command `%s`: qos %d is invalid, use 0, 1 or 2", command, *qos)
+		}
+	}
+
+	if len(device.Traits) == 0 {
+		problem("traits are empty")
+	}
+	for _, trait := range device.Traits {
+		name := strings.TrimPrefix(trait, traitPrefix)
+		if _, ok := traitCommands[name]; ok && strings.HasPrefix(trait, traitPrefix) {
+			continue
+		}
+		command := strings.TrimPrefix(trait, commandPrefix)
+		if _, ok := traitCommands[command]; ok && strings.HasPrefix(trait, commandPrefix) {
+			problem("`%s` is a command, not a trait, use `%s%s`", trait, traitPrefix, command)
+			continue
+		}
+		problem("unknown trait `%s`", trait)
+	}
+
+	for _, command := range requiredCommands(device) {
+		commandConfig := device.Commands[command]
+		if commandConfig.Template == "" && templates[command] == "" {
+			problem("no template for `%s`", command)
+		}
+		if commandConfig.Topic == "" && device.Topic == "" {
+			problem("no topic for `%s`", command)
+		}
+	}
+	for command := range device.Commands {
+		if !strings.HasPrefix(command, commandPrefix) {
+			problem("unknown command `%s`", command)
+		}
+	}
+
+	if device.WillReportState && len(subscriptionTopics(device)) == 0 {
+		problem("willReportState needs a subscription")
+	}
+	if device.Get.Topic != "" && device.Subscription == "" {
+		problem("get needs a subscription")
+	}
+	for _, name := range sortedKeys(device.States) {
+		mapping := device.States[name]
+		if mapping.Field == "" && mapping.Template == "" {
+			problem("state `%s` has no field or template", name)
+		}
+		if mapping.Max != 0 && mapping.Min >= mapping.Max {
+			problem("state `%s` has min %v, which isn't below max %v", name, mapping.Min, mapping.Max)
+		}
+	}
+	for i, rule := range device.Notifications {
+		if !slices.Contains(notificationTraits, rule.Trait) {
+			problem("notification %d has unknown trait `%s`, use one of %s", i+1, rule.Trait, strings.Join(notificationTraits, ", "))
+		} else if !slices.Contains(device.Traits, traitPrefix+rule.Trait) {
+			problem("notification %d needs the trait `%s%s`", i+1, traitPrefix, rule.Trait)
+		}
+		if rule.Field == "" && rule.Template == "" {
+			problem("notification %d has no field or template", i+1)
+		}
+	}
+
+	problems = append(problems, validateAttributes(device.Attributes)...)
+
+	return problems
+}
+
+func validateAttributes(attributes SyncAttributes) []error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if attributes.ColorModel != "" && !slices.Contains(colorModels, attributes.ColorModel) {
+		problem("unknown colorModel `%s`, use one of %s", attributes.ColorModel, strings.Join(colorModels, ", "))
+	}
+	colorRange := attributes.ColorTemperatureRange
+	if colorRange != (SyncColorTemperatureRange{}) && (colorRange.TemperatureMinK <= 0 || colorRange.TemperatureMinK >= colorRange.TemperatureMaxK) {
+		problem("colorTemperatureRange %dK-%dK isn't a valid range", colorRange.TemperatureMinK, colorRange.TemperatureMaxK)
+	}
+	if attributes.CommandOnlyOnOff && attributes.QueryOnlyOnOff {
+		problem("commandOnlyOnOff and queryOnlyOnOff can't both be set")
+	}
+	for _, direction := range attributes.OpenDirection {
+		if !slices.Contains(openDirections, direction) {
+			problem("unknown openDirection `%s`, use one of %s", direction, strings.Join(openDirections, ", "))
+		}
+	}
+	if temperatureRange := attributes.TemperatureRange; temperatureRange != nil && temperatureRange.MinThresholdCelsius >= temperatureRange.MaxThresholdCelsius {
+		problem("temperatureRange %v-%v isn't a valid range", temperatureRange.MinThresholdCelsius, temperatureRange.MaxThresholdCelsius)
+	}
+	if attributes.TemperatureUnitForUX != "" && !slices.Contains(temperatureUnits, attributes.TemperatureUnitForUX) {
+		problem("unknown temperatureUnitForUX `%s`, use C or F", attributes.TemperatureUnitForUX)
+	}
+	if attributes.ThermostatTemperatureUnit != "" && !slices.Contains(temperatureUnits, attributes.ThermostatTemperatureUnit) {
+		problem("unknown thermostatTemperatureUnit `%s`, use C or F", attributes.ThermostatTemperatureUnit)
+	}
+	for _, mode := range attributes.AvailableThermostatModes {
+		if !slices.Contains(thermostatModes, mode) {
+			problem("unknown thermostat mode `%s`, use one of %s", mode, strings.Join(thermostatModes, ", "))
+		}
+	}
+	return problems
+}
+
+// requiredCommands returns the commands the traits of the device imply, query only traits don't need commands
+func requiredCommands(device DeviceConfig) []string {
+	attributes := device.Attributes
+	queryOnly := map[string]bool{
+		"OnOff":              attributes.QueryOnlyOnOff,
+		"OpenClose":          attributes.QueryOnlyOpenClose,
+		"TemperatureControl": attributes.QueryOnlyTemperatureControl,
+		"TemperatureSetting": attributes.QueryOnlyTemperatureSetting,
+		"HumiditySetting":    attributes.QueryOnlyHumiditySetting,
+	}
+
+	var commands []string
+	for _, trait := range device.Traits {
+		name := strings.TrimPrefix(trait, traitPrefix)
+		if queryOnly[name] {
+			continue
+		}
+		for _, command := range traitCommands[name] {
+			commands = append(commands, commandPrefix+command)
+		}
+		if name == "TemperatureSetting" && len(attributes.AvailableThermostatModes) > 0 {
+			commands = append(commands, commandPrefix+"ThermostatSetMode")
+		}
+		if name == "Volume" && attributes.VolumeCanMuteAndUnmute {
+			commands = append(commands, commandPrefix+"mute")
+		}
+	}
+	return commands
+}
+
+// subscriptionTopics returns the topics the state of the device is read from
+func subscriptionTopics(device DeviceConfig) []string {
+	var topics []string
+	if device.Subscription != "" {
+		topics = append(topics, device.Subscription)
+	}
+	for _, mapping := range device.States {
+		if mapping.Topic != "" {
+			topics = append(topics, mapping.Topic)
+		}
+	}
+	return topics
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateBroker checks that the broker url has a scheme the mqtt client supports and an address
+func validateBroker(broker string) error {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(brokerSchemes, u.Scheme) {
+		return fmt.Errorf("unsupported scheme `%s`, use one of %s", u.Scheme, strings.Join(brokerSchemes, ", "))
+	}
+	if u.Scheme == "unix" {
+		if u.Path == "" {
+			return fmt.Errorf("missing socket path")
+		}
+	} else if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	plug := DeviceConfig{
+		Name:   "plug",
+		Topic:  "zigbee2mqtt/plug/set",
+		Type:   "action.devices.types.OUTLET",
+		Traits: []string{"action.devices.traits.OnOff"},
+	}
+	templates := map[string]string{"action.devices.commands.OnOff": `{"state":"%s"}`}
+
+	tests := []struct {
+		name           string
+		device         func(device DeviceConfig) DeviceConfig
+		expectedErrors []string
+	}{
+		{
+			name:   "Valid device",
+			device: func(device DeviceConfig) DeviceConfig { return device },
+		},
+		{
+			name: "Command instead of trait",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.Traits = []string{"action.devices.commands.OnOff"}
+				return device
+			},
+			expectedErrors: []string{
+				"device `plug`: `action.devices.commands.OnOff` is a command, not a trait, use `action.devices.traits.OnOff`",
+			},
+		},
+		{
+			name: "Unknown type and trait",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.Type = "action.devices.types.TOASTER"
+				device.Traits = []string{"action.devices.traits.Toast"}
+				return device
+			},
+			expectedErrors: []string{
+				"device `plug`: unknown type `action.devices.types.TOASTER`",
+				"device `plug`: unknown trait `action.devices.traits.Toast`",
+			},
+		},
+		{
+			name: "Missing template and topic for implied commands",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.Topic = ""
+				device.Traits = append(device.Traits, "action.devices.traits.Brightness")
+				device.Commands = map[string]CommandConfig{"action.devices.commands.OnOff": {Topic: "zigbee2mqtt/plug/power"}}
+				return device
+			},
+			expectedErrors: []string{
+				"device `plug`: no template for `action.devices.commands.BrightnessAbsolute`",
+				"device `plug`: no topic for `action.devices.commands.BrightnessAbsolute`",
+			},
+		},
+		{
+			name: "Query only trait needs no command",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.Topic = ""
+				device.Subscription = "zigbee2mqtt/plug"
+				device.WillReportState = true
+				device.Attributes.QueryOnlyOnOff = true
+				return device
+			},
+		},
+		{
+			name: "Report state without subscription",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.WillReportState = true
+				return device
+			},
+			expectedErrors: []string{"device `plug`: willReportState needs a subscription"},
+		},
+		{
+			name: "Get without subscription",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.Get = GetConfig{Topic: "zigbee2mqtt/plug/get"}
+				return device
+			},
+			expectedErrors: []string{"device `plug`: get needs a subscription"},
+		},
+		{
+			name: "Invalid attributes",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.Attributes = SyncAttributes{
+					ColorModel:               "cmyk",
+					ColorTemperatureRange:    SyncColorTemperatureRange{TemperatureMinK: 6500, TemperatureMaxK: 2200},
+					TemperatureRange:         &SyncTemperatureRange{MinThresholdCelsius: 30, MaxThresholdCelsius: 10},
+					AvailableThermostatModes: []string{"heat", "boost"},
+				}
+				return device
+			},
+			expectedErrors: []string{
+				"device `plug`: unknown colorModel `cmyk`, use one of rgb, hsv",
+				"device `plug`: colorTemperatureRange 6500K-2200K isn't a valid range",
+				"device `plug`: temperatureRange 30-10 isn't a valid range",
+				"device `plug`: unknown thermostat mode `boost`, use one of off, heat, cool, on, heatcool, auto, fan-only, purifier, eco, dry",
+			},
+		},
+		{
+			name: "Invalid states and notifications",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.States = map[string]StateMapping{
+					"on":         {},
+					"brightness": {Field: "brightness", Min: 254, Max: 1},
+				}
+				device.Notifications = []NotificationRule{{Field: "action", Value: "ring", Trait: "ObjectDetection"}, {Trait: "Doorbell"}}
+				return device
+			},
+			expectedErrors: []string{
+				"device `plug`: state `brightness` has min 254, which isn't below max 1",
+				"device `plug`: state `on` has no field or template",
+				"device `plug`: notification 1 needs the trait `action.devices.traits.ObjectDetection`",
+				"device `plug`: notification 2 has unknown trait `Doorbell`, use one of ObjectDetection, RunCycle, SensorState, LockUnlock",
+				"device `plug`: notification 2 has no field or template",
+			},
+		},
+		{
+			name: "Invalid qos",
+			device: func(device DeviceConfig) DeviceConfig {
+				device.Qos = 3
+				device.SubscriptionQos = 4
+				device.Commands = map[string]CommandConfig{"action.devices.commands.OnOff": {Qos: ptr(byte(5))}}
+				return device
+			},
+			expectedErrors: []string{
+				"device `plug`: qos 3 is invalid, use 0, 1 or 2",
+				"device `plug`: subscriptionQos 4 is invalid, use 0, 1 or 2",
+				"device `plug`: command `action.devices.commands.OnOff`: qos 5 is invalid, use 0, 1 or 2",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(&Config{
+				Devices:            map[string]DeviceConfig{"plug": test.device(plug)},
+				ExecutionTemplates: templates,
+			})
+
+			if len(test.expectedErrors) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, test.expectedErrors, splitErrors(err))
+		})
+	}
+}
+
+func TestValidateUniqueOtherDeviceIds(t *testing.T) {
+	device := func(name string) DeviceConfig {
+		return DeviceConfig{
+			Name:           name,
+			Type:           "action.devices.types.SENSOR",
+			Traits:         []string{"action.devices.traits.SensorState"},
+			OtherDeviceIds: []SyncOtherDeviceIds{{DeviceID: "local"}},
+		}
+	}
+
+	err := Validate(&Config{Devices: map[string]DeviceConfig{"a": device("a"), "b": device("b")}})
+
+	assert.EqualError(t, err, "device `b`: otherDeviceId `local` is already used by device `a`")
+}
+
+func TestValidateBrokers(t *testing.T) {
+	cfg := &Config{Mqtt: MqttConfig{Brokers: []string{
+		"tcp://localhost:1883", "wss://broker.example.com/mqtt", "unix:///run/mosquitto.sock",
+		"http://localhost:1883", "ws:///mqtt", "unix://",
+	}}}
+
+	assert.Equal(t, []string{
+		"mqtt: broker `http://localhost:1883`: unsupported scheme `http`, use one of tcp, mqtt, ssl, tls, mqtts, ws, wss, unix",
+		"mqtt: broker `ws:///mqtt`: missing host",
+		"mqtt: broker `unix://`: missing socket path",
+	}, splitErrors(Validate(cfg)))
+}
+
+func TestValidateBroker(t *testing.T) {
+	cfg := &Config{Broker: BrokerConfig{Port: 70000, Users: map[string]string{"bridge": "secret", "sensor": ""}}}
+
+	assert.Equal(t, []string{
+		"broker: port 70000 is out of range",
+		"broker: user `sensor` needs a username and password",
+	}, splitErrors(Validate(cfg)))
+}
+
+func TestValidateMqttVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		mqtt           MqttConfig
+		expectedErrors []string
+	}{
+		{
+			name: "MQTT 5 properties",
+			mqtt: MqttConfig{ProtocolVersion: 5, UserProperties: map[string]string{"source": "ghome"}, MessageExpiry: time.Minute},
+		},
+		{
+			name:           "Unsupported version",
+			mqtt:           MqttConfig{ProtocolVersion: 6},
+			expectedErrors: []string{"mqtt: protocolVersion 6 isn't supported, use 3, 4 or 5"},
+		},
+		{
+			name:           "MQTT 5 properties on MQTT 3.1.1",
+			mqtt:           MqttConfig{ProtocolVersion: 4, MessageExpiry: time.Minute},
+			expectedErrors: []string{"mqtt: userProperties and messageExpiry need protocolVersion 5"},
+		},
+		{
+			name:           "Invalid queue",
+			mqtt:           MqttConfig{QueueSize: -1, RetryInterval: time.Minute, MaxRetryInterval: time.Second},
+			expectedErrors: []string{"mqtt: queueSize -1 can't be negative", "mqtt: maxRetryInterval 1s is below retryInterval 1m0s"},
+		},
+		{
+			name:           "Unix socket on MQTT 5",
+			mqtt:           MqttConfig{ProtocolVersion: 5, Brokers: []string{"unix:///run/mosquitto.sock"}},
+			expectedErrors: []string{"mqtt: broker `unix:///run/mosquitto.sock`: unix sockets aren't supported with protocolVersion 5"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(&Config{Mqtt: test.mqtt})
+			if test.expectedErrors == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, test.expectedErrors, splitErrors(err))
+		})
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	for name := range Profiles {
+		t.Run(name, func(t *testing.T) {
+			device, err := ApplyProfile(DeviceConfig{Profile: name, FriendlyName: "device"}, nil)
+			require.NoError(t, err)
+
+			assert.NoError(t, Validate(&Config{Devices: map[string]DeviceConfig{"device": device}}))
+		})
+	}
+}
+
+func splitErrors(err error) []string {
+	var messages []string
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		messages = append(messages, err.Error())
+	}
+	return messages
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	log "log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// Watcher reloads the config when the file or the conf dir changes or on SIGHUP, invalid configs are rejected and the running config is kept
+type Watcher struct {
+	filename string
+	dir      string
+	interval time.Duration
+	onChange func(*Config)
+	hash     [sha256.Size]byte
+	signals  chan os.Signal
+	requests chan chan error
+	stop     chan struct{}
+}
+
+// Watch checks the files of the config for changes every interval and calls onChange with every valid new config
+func Watch(cfg *Config, interval time.Duration, onChange func(*Config)) *Watcher {
+	watcher := &Watcher{
+		filename: cfg.files[0],
+		dir:      cfg.dir,
+		interval: interval,
+		onChange: onChange,
+		signals:  make(chan os.Signal, 1),
+		requests: make(chan chan error),
+		stop:     make(chan struct{}),
+	}
+	watcher.hash, _ = configHash(watcher.filename, watcher.dir)
+	signal.Notify(watcher.signals, syscall.SIGHUP)
+
+	go watcher.run()
+	return watcher
+}
+
+// Reload reloads the config now and returns why it was rejected
+func (w *Watcher) Reload() error {
+	result := make(chan error, 1)
+	select {
+	case w.requests <- result:
+		return <-result
+	case <-w.stop:
+		return fmt.Errorf("config watcher is stopped")
+	}
+}
+
+func (w *Watcher) Stop() {
+	signal.Stop(w.signals)
+	close(w.stop)
+}
+
+func (w *Watcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.signals:
+			log.Info("reload config on signal", "file", w.filename)
+			_ = w.reload()
+		case result := <-w.requests:
+			log.Info("reload config on request", "file", w.filename)
+			result <- w.reload()
+		case <-ticker.C:
+			hash, err := configHash(w.filename, w.dir)
+			if err != nil || hash == w.hash {
+				continue
+			}
+			log.Info("reload changed config", "file", w.filename)
+			_ = w.reload()
+		}
+	}
+}
+
+func (w *Watcher) reload() error {
+	// remember the hash of invalid files too, so a broken file is only reported once
+	w.hash, _ = configHash(w.filename, w.dir)
+
+	cfg, err := ReadConfigFile(w.filename)
+	if err != nil {
+		log.Error("rejected config, keep running config", "error", err)
+		return err
+	}
+	if cfg.dir != w.dir {
+		w.dir = cfg.dir
+		w.hash, _ = configHash(w.filename, w.dir)
+	}
+	w.onChange(cfg)
+	return nil
+}
+
+// configHash is the hash of the config file and the names and content of the files in the conf dir
+func configHash(filename string, dir string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	files, err := confDirFiles(dir)
+	if err != nil {
+		return hash, err
+	}
+
+	sum := sha256.New()
+	for _, file := range append([]string{filename}, files...) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return hash, err
+		}
+		sum.Write([]byte(file))
+		sum.Write(data)
+	}
+	copy(hash[:], sum.Sum(nil))
+	return hash, nil
+}
+
+// RestartRequired returns the sections of the config that changed but are only applied on a restart
+func RestartRequired(old *Config, new *Config) []string {
+	sections := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"server", old.Server, new.Server},
+		{"auth", old.Auth, new.Auth},
+		{"mqtt", old.Mqtt, new.Mqtt},
+		{"broker", old.Broker, new.Broker},
+		{"homegraph", old.Homegraph, new.Homegraph},
+		{"profiles", old.Profiles, new.Profiles},
+		{"discovery", old.Discovery, new.Discovery},
+	}
+
+	var changed []string
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.old, section.new) {
+			changed = append(changed, section.name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(sensorConfig("temperature")), 0600))
+
+	cfg, err := ReadConfigFile(filename)
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var reloaded []*Config
+	watcher := Watch(cfg, 5*time.Millisecond, func(cfg *Config) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reloaded = append(reloaded, cfg)
+	})
+	defer watcher.Stop()
+	configs := func() []*Config {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return reloaded
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, configs(), "unchanged file isn't reloaded")
+
+	require.NoError(t, os.WriteFile(filename, []byte(sensorConfig("outside temperature")), 0600))
+	assert.Eventually(t, func() bool { return len(configs()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, "outside temperature", configs()[0].Devices["sensor"].Name)
+
+	require.NoError(t, os.WriteFile(filename, []byte("devices:\n  sensor:\n    profile: unknown\n"), 0600))
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(t, configs(), 1, "invalid config is rejected")
+
+	require.NoError(t, os.WriteFile(filename, []byte(sensorConfig("inside temperature")), 0600))
+	assert.Eventually(t, func() bool { return len(configs()) == 2 }, time.Second, time.Millisecond)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool { return len(configs()) == 3 }, time.Second, time.Millisecond, "SIGHUP reloads the config")
+	assert.Equal(t, "inside temperature", configs()[2].Devices["sensor"].Name)
+}
+
+func TestWatcherReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(sensorConfig("temperature")), 0600))
+
+	cfg, err := ReadConfigFile(filename)
+	require.NoError(t, err)
+
+	var reloaded []*Config
+	watcher := Watch(cfg, time.Hour, func(cfg *Config) {
+		reloaded = append(reloaded, cfg)
+	})
+
+	require.NoError(t, watcher.Reload())
+	assert.Len(t, reloaded, 1, "unchanged config is reloaded on request")
+
+	require.NoError(t, os.WriteFile(filename, []byte("devices:\n  sensor:\n    profile: unknown\n"), 0600))
+	assert.ErrorContains(t, watcher.Reload(), "unknown profile `unknown`")
+	assert.Len(t, reloaded, 1)
+
+	watcher.Stop()
+	assert.EqualError(t, watcher.Reload(), "config watcher is stopped")
+}
+
+func sensorConfig(name string) string {
+	return "devices:\n  sensor:\n    name: " + name + "\n    type: action.devices.types.SENSOR\n    traits: [action.devices.traits.SensorState]\n"
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := &Config{Mqtt: MqttConfig{Host: "localhost"}, Devices: map[string]DeviceConfig{"lamp": {Name: "lamp"}}}
+	new := &Config{Mqtt: MqttConfig{Host: "broker"}, Devices: map[string]DeviceConfig{"lamp": {Name: "reading lamp"}}}
+
+	assert.Equal(t, []string{"mqtt"}, RestartRequired(old, new))
+	assert.Empty(t, RestartRequired(old, old))
+}
@@ -0,0 +1,27 @@
+package fullfillment
+
+import (
+	log "log/slog"
+)
+
+// SetConnected marks all devices offline while the broker is gone, and reports them online again when it's back.
+// The broker resends the retained state of the devices when their topics are resubscribed,
+// devices with a get topic are asked for their state.
+func (f *Fullfillment) SetConnected(connected bool) {
+	f.mutex.Lock()
+	if f.offline == !connected {
+		f.mutex.Unlock()
+		return
+	}
+	f.offline = !connected
+	log.Info("devices are reachable", "online", connected)
+
+	for id, device := range f.devices {
+		f.reportState(id, device)
+	}
+	f.mutex.Unlock()
+
+	if connected {
+		go f.refresh()
+	}
+}
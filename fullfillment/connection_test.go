@@ -0,0 +1,67 @@
+package fullfillment
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetConnected(t *testing.T) {
+	reporter := &stateReporterMock{}
+	handler := &MessageHandlerMock{messages: map[string]string{}}
+	fullfillment := &Fullfillment{
+		handler: handler,
+		devices: map[string]Device{
+			"lamp": {Topic: "lamp/set", Config: config.DeviceConfig{WillReportState: true}},
+		},
+		executionTemplates: map[string]string{"action.devices.commands.OnOff": `{"state":"%s"}`},
+		linkedUsers:        &LinkedUsers{users: map[string]bool{"alice": true}},
+		reporter:           reporter,
+	}
+	fullfillment.setState("lamp", map[string]interface{}{"state": "ON"})
+	query := PayloadRequest{Devices: []DeviceRequest{{ID: "lamp"}}}
+	execute := PayloadRequest{Commands: []CommandRequest{{
+		Devices:   []DeviceRequest{{ID: "lamp"}},
+		Execution: []ExecutionRequest{{Command: "action.devices.commands.OnOff", Params: ParamsRequest{On: false}}},
+	}}}
+
+	fullfillment.SetConnected(false)
+	fullfillment.SetConnected(false)
+	handler.err = errors.New("not connected to the broker")
+
+	assert.False(t, fullfillment.query("alice", "1", query).Payload.Devices["lamp"].Online)
+	assert.Equal(t, []ExecuteCommands{offlineCommand("lamp")}, fullfillment.execute("alice", "2", execute).Payload.Commands)
+
+	fullfillment.SetConnected(true)
+	handler.err = nil
+
+	assert.True(t, fullfillment.query("alice", "3", query).Payload.Devices["lamp"].Online)
+	assert.Equal(t, Success, fullfillment.execute("alice", "4", execute).Payload.Commands[0].Status)
+	assert.Equal(t, []reportedState{
+		{user: "alice", device: "lamp", states: map[string]interface{}{"on": true, "online": true}},
+		{user: "alice", device: "lamp", states: map[string]interface{}{"on": true, "online": false}},
+		{user: "alice", device: "lamp", states: map[string]interface{}{"on": true, "online": true}},
+	}, reporter.reported)
+}
+
+func TestExecuteQueued(t *testing.T) {
+	fullfillment := &Fullfillment{
+		handler:            &MessageHandlerMock{messages: map[string]string{}, queued: true},
+		devices:            map[string]Device{"lamp": {Topic: "lamp/set"}},
+		executionTemplates: map[string]string{"action.devices.commands.OnOff": `{"state":"%s"}`},
+	}
+	execute := PayloadRequest{Commands: []CommandRequest{{
+		Devices:   []DeviceRequest{{ID: "lamp"}},
+		Execution: []ExecutionRequest{{Command: "action.devices.commands.OnOff", Params: ParamsRequest{On: true}}},
+	}}}
+
+	commands := fullfillment.execute("alice", "1", execute).Payload.Commands
+
+	assert.Equal(t, []ExecuteCommands{{
+		Ids:    []string{"lamp"},
+		Status: Pending,
+		States: ExecuteStates{On: true, Online: true},
+	}}, commands)
+}
@@ -0,0 +1,67 @@
+package fullfillment
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	"sort"
+	"time"
+)
+
+// DeviceStatus is a device with its state as listed by the MQTT control api
+type DeviceStatus struct {
+	Id     string                 `json:"id"`
+	Name   string                 `json:"name"`
+	Type   string                 `json:"type"`
+	Traits []string               `json:"traits"`
+	Online bool                   `json:"online"`
+	States map[string]interface{} `json:"states,omitempty"`
+}
+
+// Devices returns all devices with their state sorted by id
+func (f *Fullfillment) Devices() []DeviceStatus {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	devices := make([]DeviceStatus, 0, len(f.devices))
+	for id, device := range f.devices {
+		devices = append(devices, DeviceStatus{
+			Id:     id,
+			Name:   device.Config.Name,
+			Type:   device.Config.Type,
+			Traits: device.Config.Traits,
+			Online: !f.offline,
+			States: device.State.States,
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Id < devices[j].Id
+	})
+	return devices
+}
+
+// Execute executes a Google command with its params on the device, the same as an EXECUTE of the assistant
+func (f *Fullfillment) Execute(deviceId string, command string, params map[string]interface{}) ([]ExecuteCommands, error) {
+	f.mutex.RLock()
+	_, ok := f.devices[deviceId]
+	f.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown device `%s`", deviceId)
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+	var paramsRequest ParamsRequest
+	if err := json.Unmarshal(data, &paramsRequest); err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	requestId := fmt.Sprintf("mqtt-%d", time.Now().UnixNano())
+	response := f.execute(config.ControlUser, requestId, PayloadRequest{Commands: []CommandRequest{{
+		Devices:   []DeviceRequest{{ID: deviceId}},
+		Execution: []ExecutionRequest{{Command: command, Params: paramsRequest}},
+	}}})
+	return response.Payload.Commands, nil
+}
@@ -0,0 +1,34 @@
+package fullfillment
+
+import (
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControl(t *testing.T) {
+	deviceConfigs := map[string]config.DeviceConfig{
+		"lamp": {Name: "lamp", Topic: "lamp/set", Type: "action.devices.types.LIGHT", Traits: []string{"action.devices.traits.OnOff"}},
+		"plug": {Name: "plug", Topic: "plug/set", Type: "action.devices.types.OUTLET", Traits: []string{"action.devices.traits.OnOff"}},
+	}
+	templates := map[string]string{"action.devices.commands.OnOff": `{"state":"%s"}`}
+	handler := &MessageHandlerMock{messages: map[string]string{}}
+	fullfillment, err := NewFullfillment(handler, deviceConfigs, templates, nil)
+	require.NoError(t, err)
+	fullfillment.setState("plug", map[string]interface{}{"state": "ON"})
+
+	assert.Equal(t, []DeviceStatus{
+		{Id: "lamp", Name: "lamp", Type: "action.devices.types.LIGHT", Traits: []string{"action.devices.traits.OnOff"}, Online: true},
+		{Id: "plug", Name: "plug", Type: "action.devices.types.OUTLET", Traits: []string{"action.devices.traits.OnOff"}, Online: true, States: map[string]interface{}{"on": true}},
+	}, fullfillment.Devices())
+
+	commands, err := fullfillment.Execute("lamp", "action.devices.commands.OnOff", map[string]interface{}{"on": true})
+	require.NoError(t, err)
+	assert.Equal(t, []ExecuteCommands{{Ids: []string{"lamp"}, Status: Success, States: ExecuteStates{On: true, Online: true}}}, commands)
+	assert.Equal(t, `{"state":"on"}`, handler.messages["lamp/set"])
+
+	_, err = fullfillment.Execute("toaster", "action.devices.commands.OnOff", nil)
+	assert.EqualError(t, err, "unknown device `toaster`")
+}
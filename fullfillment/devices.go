@@ -0,0 +1,110 @@
+package fullfillment
+
+import (
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"reflect"
+	"slices"
+)
+
+// AddDevice adds or updates a discovered device, devices from the config take precedence over discovered devices
+func (f *Fullfillment) AddDevice(id string, deviceConfig config.DeviceConfig) {
+	f.mutex.Lock()
+	if f.configured[id] {
+		f.mutex.Unlock()
+		log.Debug("ignore discovered device, device is configured", "device", id)
+		return
+	}
+
+	device, exists := f.devices[id]
+	if exists && reflect.DeepEqual(device.Config, deviceConfig) {
+		f.mutex.Unlock()
+		return
+	}
+	oldSubscriptions := subscriptions(device.Config)
+
+	device.Topic = deviceConfig.Topic
+	device.Config = deviceConfig
+	f.devices[id] = device
+	f.syncPayload = syncPayload(f.deviceConfigs())
+	f.mutex.Unlock()
+
+	log.Info("add device", "device", id, "name", deviceConfig.Name, "update", exists)
+	f.scheduleSync()
+
+	// subscribe without holding the lock, retained state messages are delivered right away
+	f.resubscribe(id, oldSubscriptions, subscriptions(deviceConfig), deviceConfig.SubscriptionQos)
+}
+
+// RemoveDevice removes a discovered device, devices from the config are kept
+func (f *Fullfillment) RemoveDevice(id string) {
+	f.mutex.Lock()
+	device, exists := f.devices[id]
+	if !exists || f.configured[id] {
+		f.mutex.Unlock()
+		return
+	}
+
+	delete(f.devices, id)
+	f.syncPayload = syncPayload(f.deviceConfigs())
+	f.mutex.Unlock()
+
+	log.Info("remove device", "device", id, "name", device.Config.Name)
+	f.scheduleSync()
+	for _, topic := range subscriptions(device.Config) {
+		f.unsubscribe(id, topic)
+	}
+}
+
+// subscriptions returns the distinct topics with state of the device
+func subscriptions(deviceConfig config.DeviceConfig) []string {
+	var topics []string
+	if deviceConfig.Subscription != "" {
+		topics = append(topics, deviceConfig.Subscription)
+	}
+	for _, mapping := range deviceConfig.States {
+		if mapping.Topic != "" && !slices.Contains(topics, mapping.Topic) {
+			topics = append(topics, mapping.Topic)
+		}
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// resubscribe unsubscribes the topics the device no longer uses and subscribes the new topics
+func (f *Fullfillment) resubscribe(id string, oldSubscriptions []string, newSubscriptions []string, qos byte) {
+	for _, topic := range oldSubscriptions {
+		if !slices.Contains(newSubscriptions, topic) {
+			f.unsubscribe(id, topic)
+		}
+	}
+	for _, topic := range newSubscriptions {
+		if !slices.Contains(oldSubscriptions, topic) {
+			f.subscribe(id, topic, qos)
+		}
+	}
+}
+
+func (f *Fullfillment) subscribe(id string, topic string, qos byte) {
+	err := f.handler.RegisterStateChangeListener(id, topic, qos, func(deviceId string, payload map[string]interface{}) {
+		f.setTopicState(deviceId, topic, payload)
+	})
+	if err != nil {
+		log.Error("failed to subscribe", "device", id, "topic", topic, "error", err)
+	}
+}
+
+func (f *Fullfillment) unsubscribe(id string, topic string) {
+	err := f.handler.RemoveStateChangeListener(id, topic)
+	if err != nil {
+		log.Error("failed to unsubscribe", "device", id, "topic", topic, "error", err)
+	}
+}
+
+func (f *Fullfillment) deviceConfigs() map[string]config.DeviceConfig {
+	deviceConfigs := map[string]config.DeviceConfig{}
+	for id, device := range f.devices {
+		deviceConfigs[id] = device.Config
+	}
+	return deviceConfigs
+}
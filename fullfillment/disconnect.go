@@ -5,7 +5,15 @@ import log "log/slog"
 type DisconnectResponse struct {
 }
 
-func (f *Fullfillment) disconnect(requestId string, payload PayloadRequest) DisconnectResponse {
-	log.Info("handle disconnect request", "request", requestId, "payload", payload)
+func (f *Fullfillment) disconnect(userId string, requestId string, payload PayloadRequest) DisconnectResponse {
+	log.Info("handle disconnect request", "request", requestId, "user", userId, "payload", payload)
+	f.mutex.RLock()
+	linkedUsers, publisher := f.linkedUsers, f.events
+	f.mutex.RUnlock()
+
+	if linkedUsers != nil {
+		linkedUsers.Unlink(userId)
+	}
+	emitEvent(publisher, Event{Intent: disconnectEvent, RequestId: requestId, User: userId})
 	return DisconnectResponse{}
 }
@@ -0,0 +1,72 @@
+package fullfillment
+
+import (
+	"time"
+)
+
+const (
+	syncEvent       = "sync"
+	queryEvent      = "query"
+	executeEvent    = "execute"
+	disconnectEvent = "disconnect"
+)
+
+// EventPublisher publishes the requests of the assistant, e.g. for automations that react on voice control
+type EventPublisher interface {
+	PublishEvent(intent string, device string, event interface{})
+}
+
+// Event is a request of the assistant for a device, or for all devices of the user without a device
+type Event struct {
+	Intent    string                 `json:"intent"`
+	RequestId string                 `json:"requestId"`
+	User      string                 `json:"user"`
+	Device    string                 `json:"device,omitempty"`
+	Devices   []string               `json:"devices,omitempty"` // devices returned by a SYNC
+	Command   string                 `json:"command,omitempty"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+	Status    string                 `json:"status"`
+	ErrorCode string                 `json:"errorCode,omitempty"`
+	States    interface{}            `json:"states,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// SetEventPublisher publishes an event for every SYNC, QUERY, EXECUTE and DISCONNECT
+func (f *Fullfillment) SetEventPublisher(publisher EventPublisher) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.events = publisher
+}
+
+// emitEvent publishes the event with the publisher, nothing is published without one
+func emitEvent(publisher EventPublisher, event Event) {
+	if publisher == nil {
+		return
+	}
+	if event.Status == "" {
+		event.Status = string(Success)
+	}
+	event.Timestamp = time.Now().UTC()
+	publisher.PublishEvent(event.Intent, event.Device, event)
+}
+
+// publishExecuteEvents publishes an event for every execution of the command on the device,
+// only successful executions have states
+func publishExecuteEvents(publisher EventPublisher, userId string, requestId string, deviceId string, executions []ExecutionRequest, result ExecuteCommands) {
+	for _, execution := range executions {
+		event := Event{
+			Intent:    executeEvent,
+			RequestId: requestId,
+			User:      userId,
+			Device:    deviceId,
+			Command:   execution.Command,
+			Params:    execution.Params.values(),
+			Status:    string(result.Status),
+			ErrorCode: result.ErrorCode,
+		}
+		if result.Status == Success {
+			event.States = result.States
+		}
+		emitEvent(publisher, event)
+	}
+}
@@ -0,0 +1,114 @@
+package fullfillment
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishEvents(t *testing.T) {
+	deviceConfigs := map[string]config.DeviceConfig{
+		"lamp": {Name: "lamp", Topic: "lamp/set", Type: "action.devices.types.LIGHT", Traits: []string{"action.devices.traits.OnOff"}},
+		"safe": {Name: "safe", Topic: "safe/set", Type: "action.devices.types.OUTLET", Traits: []string{"action.devices.traits.OnOff"}},
+	}
+	templates := map[string]string{"action.devices.commands.OnOff": `{"state":"%s"}`}
+	users := map[string]config.UserConfig{"alice": {Devices: []string{"lamp"}}}
+	fullfillment, err := NewFullfillment(&MessageHandlerMock{messages: map[string]string{}}, deviceConfigs, templates, users)
+	require.NoError(t, err)
+	publisher := &eventPublisherMock{}
+	fullfillment.SetEventPublisher(publisher)
+
+	fullfillment.handle("alice", FullfillementRequest{RequestID: "1", Inputs: []InputRequest{{Intent: "action.devices.SYNC"}}})
+	fullfillment.handle("alice", FullfillementRequest{RequestID: "2", Inputs: []InputRequest{{
+		Intent:  "action.devices.QUERY",
+		Payload: PayloadRequest{Devices: []DeviceRequest{{ID: "safe"}}},
+	}}})
+	fullfillment.handle("alice", FullfillementRequest{RequestID: "3", Inputs: []InputRequest{{
+		Intent: "action.devices.EXECUTE",
+		Payload: PayloadRequest{Commands: []CommandRequest{{
+			Devices:   []DeviceRequest{{ID: "lamp"}, {ID: "safe"}},
+			Execution: []ExecutionRequest{{Command: "action.devices.commands.OnOff", Params: ParamsRequest{Raw: map[string]interface{}{"on": true}}}},
+		}}},
+	}}})
+	fullfillment.handle("alice", FullfillementRequest{RequestID: "4", Inputs: []InputRequest{{Intent: "action.devices.DISCONNECT"}}})
+
+	params := map[string]interface{}{"on": true}
+	assert.Equal(t, []publishedEvent{
+		{intent: "sync", event: Event{Intent: "sync", RequestId: "1", User: "alice", Devices: []string{"lamp"}, Status: "SUCCESS"}},
+		{intent: "query", device: "safe", event: Event{Intent: "query", RequestId: "2", User: "alice", Device: "safe", Status: "ERROR", ErrorCode: "deviceNotFound"}},
+		{intent: "execute", device: "lamp", event: Event{Intent: "execute", RequestId: "3", User: "alice", Device: "lamp", Command: "action.devices.commands.OnOff", Params: params, Status: "SUCCESS", States: ExecuteStates{Online: true}}},
+		{intent: "execute", device: "safe", event: Event{Intent: "execute", RequestId: "3", User: "alice", Device: "safe", Command: "action.devices.commands.OnOff", Params: params, Status: "ERROR", ErrorCode: "deviceNotFound"}},
+		{intent: "disconnect", event: Event{Intent: "disconnect", RequestId: "4", User: "alice", Status: "SUCCESS"}},
+	}, publisher.events)
+}
+
+func TestEventsDontBlockState(t *testing.T) {
+	tests := []struct {
+		name    string
+		request FullfillementRequest
+	}{
+		{"Sync", FullfillementRequest{Inputs: []InputRequest{{Intent: "action.devices.SYNC"}}}},
+		{"Query", FullfillementRequest{Inputs: []InputRequest{{Intent: "action.devices.QUERY", Payload: PayloadRequest{Devices: []DeviceRequest{{ID: "lamp"}}}}}}},
+		{"Disconnect", FullfillementRequest{Inputs: []InputRequest{{Intent: "action.devices.DISCONNECT"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deviceConfigs := map[string]config.DeviceConfig{"lamp": {Name: "lamp", Topic: "lamp/set", Type: "action.devices.types.LIGHT", Traits: []string{"action.devices.traits.OnOff"}}}
+			fullfillment, err := NewFullfillment(&MessageHandlerMock{messages: map[string]string{}}, deviceConfigs, nil, nil)
+			require.NoError(t, err)
+			publisher := &blockingPublisherMock{published: make(chan struct{}), release: make(chan struct{})}
+			fullfillment.SetEventPublisher(publisher)
+
+			done := make(chan struct{})
+			go func() {
+				fullfillment.handle("alice", test.request)
+				close(done)
+			}()
+			<-publisher.published
+
+			fullfillment.setState("lamp", map[string]interface{}{"state": "ON"})
+			close(publisher.release)
+			<-done
+
+			assert.True(t, fullfillment.devices["lamp"].State.On)
+		})
+	}
+}
+
+type publishedEvent struct {
+	intent string
+	device string
+	event  Event
+}
+
+type eventPublisherMock struct {
+	events []publishedEvent
+}
+
+func (p *eventPublisherMock) PublishEvent(intent string, device string, event interface{}) {
+	published := event.(Event)
+	if time.Since(published.Timestamp) > time.Minute {
+		published.Intent = "timestamp not set"
+	}
+	published.Timestamp = time.Time{}
+	p.events = append(p.events, publishedEvent{intent: intent, device: device, event: published})
+}
+
+// blockingPublisherMock blocks the first event until it's released, like a slow broker
+type blockingPublisherMock struct {
+	published chan struct{}
+	release   chan struct{}
+	once      sync.Once
+}
+
+func (p *blockingPublisherMock) PublishEvent(intent string, device string, event interface{}) {
+	p.once.Do(func() {
+		close(p.published)
+		<-p.release
+	})
+}
@@ -2,6 +2,7 @@ package fullfillment
 
 import (
 	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
 	log "log/slog"
 	"regexp"
 	"strconv"
@@ -86,58 +87,125 @@ type ExecuteStates struct {
 
 }
 
-func (f *Fullfillment) execute(requestId string, payload PayloadRequest) ExecuteResponse {
-	log.Info("handle execute request", "request", requestId, "payload", payload)
+// executeResult is an execution on a device, its message is published after the mutex is released
+type executeResult struct {
+	deviceId   string
+	executions []ExecutionRequest
+	command    ExecuteCommands
+	message    *commandMessage // nil when nothing is published
+}
+
+// commandMessage is a rendered command with the topic, qos and retain of the device
+type commandMessage struct {
+	deviceId string
+	command  string
+	config   config.CommandConfig
+	message  string
+	on       *bool // state of an OnOff command, applied when the command is sent
+}
+
+// execute renders the commands under the mutex and publishes them without it,
+// so a slow broker doesn't block the state updates of the devices
+func (f *Fullfillment) execute(userId string, requestId string, payload PayloadRequest) ExecuteResponse {
+	log.Info("handle execute request", "request", requestId, "user", userId, "payload", payload)
+
+	f.mutex.Lock()
+	results := f.prepareExecute(userId, payload)
+	events := f.events
+	f.mutex.Unlock()
+
+	for i, result := range results {
+		if result.message != nil {
+			results[i].command = f.sendCommand(result.command, result.message)
+		}
+	}
+
+	f.mutex.Lock()
+	for _, result := range results {
+		if result.message != nil && result.command.Status != Offline {
+			f.applyCommand(*result.message)
+		}
+	}
+	log.Info("state after executing command", "devices", f.devices)
+	f.mutex.Unlock()
 
 	executeCommands := []ExecuteCommands{}
+	for _, result := range results {
+		executeCommands = append(executeCommands, result.command)
+		publishExecuteEvents(events, userId, requestId, result.deviceId, result.executions, result.command)
+	}
+
+	return ExecuteResponse{
+		RequestID: requestId,
+		Payload: ExecutePayload{
+			Commands: executeCommands,
+		},
+	}
+}
+
+// prepareExecute renders the messages of the commands, the caller holds the mutex
+func (f *Fullfillment) prepareExecute(userId string, payload PayloadRequest) []executeResult {
+	var results []executeResult
 	for _, command := range payload.Commands {
 		for _, device := range command.Devices {
+			if !f.allowed(userId, device.ID) {
+				log.Warn("execute on device not allowed for user", "device", device.ID, "user", userId)
+				results = append(results, executeResult{
+					deviceId:   device.ID,
+					executions: command.Execution,
+					command: ExecuteCommands{
+						Ids:       []string{device.ID},
+						Status:    Error,
+						ErrorCode: "deviceNotFound",
+					},
+				})
+				continue
+			}
+
 			if deviceState, ok := f.devices[device.ID]; !ok {
 				log.Error("failed to find local state", "device", device.ID, "state", deviceState)
-				executeCommands = append(executeCommands, ExecuteCommands{
-					Ids:    []string{device.ID},
-					Status: Error,
-					States: ExecuteStates{
-						Online: false,
+				results = append(results, executeResult{
+					deviceId:   device.ID,
+					executions: command.Execution,
+					command: ExecuteCommands{
+						Ids:    []string{device.ID},
+						Status: Error,
+						States: ExecuteStates{
+							Online: false,
+						},
 					},
 				})
 				break
 			}
 
 			for _, execution := range command.Execution {
-				executeCommand := f.executeCommand(device.ID, execution)
-				executeCommands = append(executeCommands, executeCommand)
+				executeCommand, message := f.executeCommand(device, execution)
+				results = append(results, executeResult{
+					deviceId:   device.ID,
+					executions: []ExecutionRequest{execution},
+					command:    executeCommand,
+					message:    message,
+				})
 			}
 		}
 	}
-
-	log.Info("state after executing command", "devices", f.devices)
-
-	return ExecuteResponse{
-		RequestID: requestId,
-		Payload: ExecutePayload{
-			Commands: executeCommands,
-		},
-	}
+	return results
 }
 
-func (f *Fullfillment) executeCommand(deviceId string, execution ExecutionRequest) ExecuteCommands {
-	device := f.devices[deviceId]
-	defer func() {
-		f.devices[deviceId] = device
-	}()
+// executeCommand renders the message of the execution, the result is sent with sendCommand
+func (f *Fullfillment) executeCommand(deviceRequest DeviceRequest, execution ExecutionRequest) (ExecuteCommands, *commandMessage) {
+	deviceId := deviceRequest.ID
 
 	switch execution.Command {
 	case "action.devices.commands.OnOff":
 		action := onOffValue(execution.Params.On)
-		message, err := f.fillMessage(deviceId, execution.Command, action)
+		message, err := f.fillMessage(deviceRequest, execution, action)
 		if err != nil {
 			log.Error("failed to execute command '%s'", execution.Command, err)
-			return errorCommand(deviceId)
+			return errorCommand(deviceId), nil
 		}
 
-		f.sentCommand(deviceId, message)
-		device.State.On = execution.Params.On
+		on := execution.Params.On
 		return ExecuteCommands{
 			Ids:    []string{deviceId},
 			Status: Success,
@@ -145,15 +213,14 @@ func (f *Fullfillment) executeCommand(deviceId string, execution ExecutionReques
 				On:     execution.Params.On,
 				Online: true,
 			},
-		}
+		}, f.commandMessage(deviceId, execution.Command, message, &on)
 	case "action.devices.commands.mute":
-		message, err := f.fillMessage(deviceId, execution.Command, strconv.FormatBool(execution.Params.Mute))
+		message, err := f.fillMessage(deviceRequest, execution, strconv.FormatBool(execution.Params.Mute))
 		if err != nil {
 			log.Error("failed to execute command '%s'", execution.Command, err)
-			return errorCommand(deviceId)
+			return errorCommand(deviceId), nil
 		}
 
-		f.sentCommand(deviceId, message)
 		return ExecuteCommands{
 			Ids:    []string{deviceId},
 			Status: Success,
@@ -162,16 +229,15 @@ func (f *Fullfillment) executeCommand(deviceId string, execution ExecutionReques
 				CurrentVolume: 10,
 				IsMuted:       execution.Params.Mute,
 			},
-		}
+		}, f.commandMessage(deviceId, execution.Command, message, nil)
 	case "action.devices.commands.setVolume":
 		volume := execution.Params.VolumeLevel
-		message, err := f.fillMessage(deviceId, execution.Command, strconv.Itoa(volume))
+		message, err := f.fillMessage(deviceRequest, execution, strconv.Itoa(volume))
 		if err != nil {
 			log.Error("failed to execute command '%s'", execution.Command, err)
-			return errorCommand(deviceId)
+			return errorCommand(deviceId), nil
 		}
 
-		f.sentCommand(deviceId, message)
 		return ExecuteCommands{
 			Ids:    []string{deviceId},
 			Status: Success,
@@ -180,19 +246,18 @@ func (f *Fullfillment) executeCommand(deviceId string, execution ExecutionReques
 				CurrentVolume: 10,
 				IsMuted:       false,
 			},
-		}
+		}, f.commandMessage(deviceId, execution.Command, message, nil)
 	case "action.devices.commands.volumeRelative":
 		action := "decrease"
 		if execution.Params.RelativeSteps > 0 {
 			action = "increase"
 		}
-		message, err := f.fillMessage(deviceId, execution.Command, action)
+		message, err := f.fillMessage(deviceRequest, execution, action)
 		if err != nil {
 			log.Error("failed to execute command '%s'", execution.Command, err)
-			return errorCommand(deviceId)
+			return errorCommand(deviceId), nil
 		}
 
-		f.sentCommand(deviceId, message)
 		return ExecuteCommands{
 			Ids:    []string{deviceId},
 			Status: Success,
@@ -201,8 +266,25 @@ func (f *Fullfillment) executeCommand(deviceId string, execution ExecutionReques
 				CurrentVolume: 10 + execution.Params.RelativeSteps,
 				IsMuted:       false,
 			},
-		}
+		}, f.commandMessage(deviceId, execution.Command, message, nil)
 	default:
+		if _, ok := f.command(deviceId, execution.Command); ok {
+			// commands without specific handling can still be send with a template using the params
+			message, err := f.fillMessage(deviceRequest, execution)
+			if err != nil {
+				log.Error("failed to execute command", "command", execution.Command, "error", err)
+				return errorCommand(deviceId), nil
+			}
+
+			return ExecuteCommands{
+				Ids:    []string{deviceId},
+				Status: Success,
+				States: ExecuteStates{
+					Online: true,
+				},
+			}, f.commandMessage(deviceId, execution.Command, message, nil)
+		}
+
 		log.Info("execute command", "command", execution.Command, "device", deviceId)
 		return ExecuteCommands{
 			Ids:    []string{deviceId},
@@ -210,17 +292,39 @@ func (f *Fullfillment) executeCommand(deviceId string, execution ExecutionReques
 			States: ExecuteStates{
 				Online: false,
 			},
-		}
+		}, nil
 	}
 }
 
-func (f *Fullfillment) fillMessage(deviceId string, command string, args ...any) (msg string, err error) {
-	messageTemplate, commandFound := f.executionTemplates[command]
+// fillMessage renders the execution template of the command, templates with `{{` are rendered
+// with text/template and TemplateData, other templates are formatted with the positional args
+func (f *Fullfillment) fillMessage(deviceRequest DeviceRequest, execution ExecutionRequest, args ...any) (msg string, err error) {
+	deviceId := deviceRequest.ID
+	command := execution.Command
+	commandConfig, commandFound := f.command(deviceId, command)
+	messageTemplate := commandConfig.Template
 	if !commandFound {
 		return "", fmt.Errorf("failed to find command `%s` for device `%s` in execution template", command, deviceId)
 
 	}
 
+	if isTemplate(messageTemplate) {
+		device := f.devices[deviceId]
+		data := TemplateData{
+			Device:     deviceId,
+			Command:    command,
+			Params:     execution.Params.values(),
+			State:      device.State.Payload,
+			On:         device.State.On,
+			Config:     device.Config,
+			CustomData: deviceRequest.CustomData,
+		}
+		if len(args) > 0 {
+			data.Value = args[0]
+		}
+		return renderTemplate(command, messageTemplate, data)
+	}
+
 	regex := regexp.MustCompile("%[d|s|v]")
 	matches := regex.FindAllStringIndex(messageTemplate, -1)
 	if len(matches) != len(args) {
@@ -231,9 +335,56 @@ func (f *Fullfillment) fillMessage(deviceId string, command string, args ...any)
 	return message, nil
 }
 
-func (f *Fullfillment) sentCommand(deviceId string, message string) {
-	topic := f.devices[deviceId].Topic
-	f.handler.SendMessage(topic, message)
+// command resolves how the command is published for the device, the command block
+// of the device overrides the device topic and the global execution template
+func (f *Fullfillment) command(deviceId string, command string) (config.CommandConfig, bool) {
+	device := f.devices[deviceId]
+	commandConfig := device.Config.Commands[command]
+	if commandConfig.Topic == "" {
+		commandConfig.Topic = device.Topic
+	}
+	if commandConfig.Template == "" {
+		commandConfig.Template = f.executionTemplates[command]
+	}
+	if commandConfig.Qos == nil {
+		commandConfig.Qos = &device.Config.Qos
+	}
+	if commandConfig.Retain == nil {
+		commandConfig.Retain = &device.Config.Retain
+	}
+	return commandConfig, commandConfig.Template != ""
+}
+
+func (f *Fullfillment) commandMessage(deviceId string, command string, message string, on *bool) *commandMessage {
+	commandConfig, _ := f.command(deviceId, command)
+	return &commandMessage{deviceId: deviceId, command: command, config: commandConfig, message: message, on: on}
+}
+
+// sendCommand publishes the command, it's PENDING when the message is queued until the broker is back,
+// and OFFLINE when the message is lost
+func (f *Fullfillment) sendCommand(result ExecuteCommands, message *commandMessage) ExecuteCommands {
+	if message == nil {
+		return result
+	}
+	queued, err := f.handler.PublishCommand(message.config.Topic, message.message, *message.config.Qos, *message.config.Retain)
+	switch {
+	case err != nil:
+		log.Warn("failed to send command", "device", message.deviceId, "command", message.command, "error", err)
+		return offlineCommand(message.deviceId)
+	case queued:
+		result.Status = Pending
+	}
+	return result
+}
+
+// applyCommand updates the state of the device after its command is sent, the caller holds the mutex
+func (f *Fullfillment) applyCommand(message commandMessage) {
+	device, ok := f.devices[message.deviceId]
+	if !ok || message.on == nil {
+		return
+	}
+	device.State.On = *message.on
+	f.devices[message.deviceId] = device
 }
 
 func errorCommand(deviceId string) ExecuteCommands {
@@ -244,6 +395,14 @@ func errorCommand(deviceId string) ExecuteCommands {
 	}
 }
 
+func offlineCommand(deviceId string) ExecuteCommands {
+	return ExecuteCommands{
+		Ids:       []string{deviceId},
+		Status:    Offline,
+		ErrorCode: "deviceOffline",
+	}
+}
+
 func onOffValue(on bool) string {
 	if on {
 		return "on"
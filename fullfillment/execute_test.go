@@ -2,8 +2,10 @@ package fullfillment
 
 import (
 	"errors"
+	"slices"
 	"testing"
 
+	"github.com/mrlauy/ghome-mqtt/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -86,7 +88,7 @@ func TestFillMessage(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			result, err := fullfillment.fillMessage(test.device, test.command, test.args...)
+			result, err := fullfillment.fillMessage(DeviceRequest{ID: test.device}, ExecutionRequest{Command: test.command}, test.args...)
 
 			assert.Equal(t, test.expectedResult, result)
 			if test.expectedError == nil {
@@ -99,7 +101,7 @@ func TestFillMessage(t *testing.T) {
 }
 
 func TestExecute(t *testing.T) {
-	messageHandlerMock := &MessageHandlerMock{map[string]string{}}
+	messageHandlerMock := &MessageHandlerMock{messages: map[string]string{}}
 	fullfillment := &Fullfillment{
 		devices: map[string]Device{
 			"test-device": {
@@ -224,7 +226,7 @@ func TestExecute(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			messageHandlerMock.Reset()
 
-			result := fullfillment.execute(test.requestId, test.payload)
+			result := fullfillment.execute("", test.requestId, test.payload)
 
 			assert.Equal(t, test.expectedResult, result)
 			if test.expectedPublication {
@@ -238,7 +240,7 @@ func TestExecute(t *testing.T) {
 }
 
 func TestStateChange(t *testing.T) {
-	messageHandlerMock := &MessageHandlerMock{map[string]string{}}
+	messageHandlerMock := &MessageHandlerMock{messages: map[string]string{}}
 	fullfillment := &Fullfillment{
 		devices: map[string]Device{
 			"test-device": {
@@ -275,14 +277,153 @@ func TestStateChange(t *testing.T) {
 		},
 	}
 
-	_ = fullfillment.execute("test-request", payload)
+	_ = fullfillment.execute("", "test-request", payload)
 
 	assert.Equal(t, true, fullfillment.devices["test-device"].State.On)
 	assert.Equal(t, "this", fullfillment.devices["test-device"].State.State)
 }
 
+func TestExecuteDeviceCommands(t *testing.T) {
+	messageHandlerMock := &MessageHandlerMock{messages: map[string]string{}}
+	fullfillment := &Fullfillment{
+		devices: map[string]Device{
+			"tasmota": {
+				Topic: "cmnd/tasmota/Backlog",
+				Config: config.DeviceConfig{
+					Qos:    2,
+					Retain: true,
+					Commands: map[string]config.CommandConfig{
+						"action.devices.commands.OnOff":              {Topic: "cmnd/tasmota/POWER", Template: "%s"},
+						"action.devices.commands.BrightnessAbsolute": {Topic: "cmnd/tasmota/Dimmer", Template: "{{ .Params.brightness }}", Qos: ptr(byte(1))},
+						"action.devices.commands.ColorAbsolute":      {Topic: "cmnd/tasmota/Color", Template: "{{ .Params.color.spectrumRGB }}", Qos: ptr(byte(0)), Retain: ptr(false)},
+					},
+				},
+			},
+			"zigbee": {
+				Topic: "zigbee2mqtt/zigbee/set",
+			},
+		},
+		handler: messageHandlerMock,
+		executionTemplates: map[string]string{
+			"action.devices.commands.OnOff":            `{"state":"%s"}`,
+			"action.devices.commands.ColorTemperature": `{"color_temp":{{ kelvinToMired .Params.color.temperature }}}`,
+		},
+	}
+
+	tests := []struct {
+		name            string
+		device          string
+		execution       ExecutionRequest
+		expectedTopic   string
+		expectedMessage string
+		expectedQos     byte
+		expectedRetain  bool
+	}{
+		{
+			name:            "Device command overrides topic and template",
+			device:          "tasmota",
+			execution:       ExecutionRequest{Command: "action.devices.commands.OnOff", Params: ParamsRequest{On: true}},
+			expectedTopic:   "cmnd/tasmota/POWER",
+			expectedMessage: "on",
+			expectedQos:     2,
+			expectedRetain:  true,
+		},
+		{
+			name:            "Device command without global template",
+			device:          "tasmota",
+			execution:       ExecutionRequest{Command: "action.devices.commands.BrightnessAbsolute", Params: ParamsRequest{Raw: map[string]interface{}{"brightness": 40}}},
+			expectedTopic:   "cmnd/tasmota/Dimmer",
+			expectedMessage: "40",
+			expectedQos:     1,
+			expectedRetain:  true,
+		},
+		{
+			name:            "Device command overrides qos and retain of the device with zero values",
+			device:          "tasmota",
+			execution:       ExecutionRequest{Command: "action.devices.commands.ColorAbsolute", Params: ParamsRequest{Raw: map[string]interface{}{"color": map[string]interface{}{"spectrumRGB": 16711680}}}},
+			expectedTopic:   "cmnd/tasmota/Color",
+			expectedMessage: "16711680",
+		},
+		{
+			name:            "Device without command falls back on the global template and device topic",
+			device:          "tasmota",
+			execution:       ExecutionRequest{Command: "action.devices.commands.ColorTemperature", Params: ParamsRequest{Raw: map[string]interface{}{"color": map[string]interface{}{"temperature": 4000}}}},
+			expectedTopic:   "cmnd/tasmota/Backlog",
+			expectedMessage: `{"color_temp":250}`,
+			expectedQos:     2,
+			expectedRetain:  true,
+		},
+		{
+			name:            "Device without commands uses the global template",
+			device:          "zigbee",
+			execution:       ExecutionRequest{Command: "action.devices.commands.OnOff", Params: ParamsRequest{On: false}},
+			expectedTopic:   "zigbee2mqtt/zigbee/set",
+			expectedMessage: `{"state":"off"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messageHandlerMock.Reset()
+
+			result := fullfillment.sendCommand(fullfillment.executeCommand(DeviceRequest{ID: test.device}, test.execution))
+
+			assert.Equal(t, Success, result.Status)
+			assert.Equal(t, map[string]string{test.expectedTopic: test.expectedMessage}, messageHandlerMock.messages)
+			assert.Equal(t, test.expectedQos, messageHandlerMock.qos)
+			assert.Equal(t, test.expectedRetain, messageHandlerMock.retain)
+		})
+	}
+}
+
+func TestExecuteDoesntBlockState(t *testing.T) {
+	handler := &blockingHandlerMock{published: make(chan struct{}), release: make(chan struct{})}
+	fullfillment := &Fullfillment{
+		devices: map[string]Device{
+			"lamp": {Topic: "zigbee2mqtt/lamp/set"},
+			"plug": {Topic: "zigbee2mqtt/plug/set"},
+		},
+		handler:            handler,
+		executionTemplates: map[string]string{"action.devices.commands.OnOff": `{"state":"%s"}`},
+	}
+
+	done := make(chan ExecuteResponse)
+	go func() {
+		done <- fullfillment.execute("", "1", PayloadRequest{Commands: []CommandRequest{{
+			Devices:   []DeviceRequest{{ID: "lamp"}},
+			Execution: []ExecutionRequest{{Command: "action.devices.commands.OnOff", Params: ParamsRequest{On: true}}},
+		}}})
+	}()
+	<-handler.published
+
+	fullfillment.setState("plug", map[string]interface{}{"state": "ON"})
+	close(handler.release)
+
+	assert.Equal(t, Success, (<-done).Payload.Commands[0].Status)
+	assert.True(t, fullfillment.devices["lamp"].State.On)
+	assert.True(t, fullfillment.devices["plug"].State.On)
+}
+
+// blockingHandlerMock blocks the publish until it's released, like a slow broker
+type blockingHandlerMock struct {
+	MessageHandlerMock
+	published chan struct{}
+	release   chan struct{}
+}
+
+func (m *blockingHandlerMock) PublishCommand(topic string, message string, qos byte, retain bool) (bool, error) {
+	close(m.published)
+	<-m.release
+	return false, nil
+}
+
 type MessageHandlerMock struct {
-	messages map[string]string
+	messages  map[string]string
+	listeners map[string][]string // topic to the devices listening
+	qos       byte                // qos and retain of the last published message
+	retain    bool
+	queued    bool  // publish queues the commands
+	err       error // publish fails
 }
 
 func (m *MessageHandlerMock) Reset() {
@@ -292,6 +433,36 @@ func (m *MessageHandlerMock) Reset() {
 func (m *MessageHandlerMock) SendMessage(topic string, message string) {
 	m.messages[topic] = message
 }
-func (m *MessageHandlerMock) RegisterStateChangeListener(device string, topic string, callback func(string, map[string]interface{})) error {
+func (m *MessageHandlerMock) Publish(topic string, message string, qos byte, retain bool) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.messages[topic] = message
+	m.qos = qos
+	m.retain = retain
 	return nil
 }
+func (m *MessageHandlerMock) PublishCommand(topic string, message string, qos byte, retain bool) (bool, error) {
+	if err := m.Publish(topic, message, qos, retain); err != nil {
+		return false, err
+	}
+	return m.queued, nil
+}
+func (m *MessageHandlerMock) RemoveStateChangeListener(device string, topic string) error {
+	m.listeners[topic] = slices.DeleteFunc(m.listeners[topic], func(listener string) bool { return listener == device })
+	if len(m.listeners[topic]) == 0 {
+		delete(m.listeners, topic)
+	}
+	return nil
+}
+func (m *MessageHandlerMock) RegisterStateChangeListener(device string, topic string, qos byte, callback func(string, map[string]interface{})) error {
+	if m.listeners == nil {
+		m.listeners = map[string][]string{}
+	}
+	m.listeners[topic] = append(m.listeners[topic], device)
+	return nil
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
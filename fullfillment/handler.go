@@ -2,9 +2,14 @@ package fullfillment
 
 import (
 	"encoding/json"
+	"github.com/mrlauy/ghome-mqtt/auth"
 	"github.com/mrlauy/ghome-mqtt/config"
 	log "log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 type FullfillementRequest struct {
@@ -24,14 +29,8 @@ type PayloadRequest struct {
 }
 
 type DeviceRequest struct {
-	ID         string             `json:"id,omitempty"`
-	CustomData *CustomDataRequest `json:"customData,omitempty"`
-}
-
-type CustomDataRequest struct {
-	FooValue int    `json:"fooValue,omitempty"`
-	BarValue bool   `json:"barValue,omitempty"`
-	BazValue string `json:"bazValue,omitempty"`
+	ID         string                 `json:"id,omitempty"`
+	CustomData map[string]interface{} `json:"customData,omitempty"` // customData of the device as returned in the SYNC response
 }
 
 type CommandRequest struct {
@@ -50,71 +49,193 @@ type ParamsRequest struct {
 	Mute          bool `json:"mute,omitempty"`
 	VolumeLevel   int  `json:"volumeLevel,omitempty"`
 	RelativeSteps int  `json:"relativeSteps,omitempty"`
+
+	Raw map[string]interface{} `json:"-"` // All params as sent by Google, available in execution templates
+}
+
+func (p *ParamsRequest) UnmarshalJSON(data []byte) error {
+	type params ParamsRequest
+	var typed params
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &typed.Raw); err != nil {
+		return err
+	}
+	*p = ParamsRequest(typed)
+	return nil
+}
+
+// values returns all params, falls back on the typed params when the request wasn't decoded from json
+func (p ParamsRequest) values() map[string]interface{} {
+	if p.Raw != nil {
+		return p.Raw
+	}
+
+	values := map[string]interface{}{}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return values
+	}
+	_ = json.Unmarshal(data, &values)
+	return values
 }
 
 type EmptyResponse struct {
 }
 
 type Device struct {
-	Topic string
-	State LocalState
+	Topic  string
+	Config config.DeviceConfig
+	State  LocalState
 }
 type LocalState struct {
 	State        string
 	On           bool
+	Payload      map[string]interface{} // last state payload received from the device
+	States       map[string]interface{} // Google states mapped from the payloads of the device
+	Matching     map[int]bool           // notification rules that matched the last payload of their topic
 	DebugCommand []string
 }
 
 type Fullfillment struct {
+	mutex              sync.RWMutex
 	handler            MessageHandler
 	devices            map[string]Device
+	configured         map[string]bool // devices from the config, discovered devices don't replace these
 	syncPayload        []SyncDevices
 	executionTemplates map[string]string
+	users              map[string]config.UserConfig
+	linkedUsers        *LinkedUsers
+	reporter           StateReporter
+	offline            bool // the broker is gone, devices can't be reached
+	events             EventPublisher
+
+	syncMutex     sync.Mutex // guards the fields to request a SYNC
+	syncRequester SyncRequester
+	syncHashFile  string
+	syncDelay     time.Duration
+	syncedHash    string
+	syncTimer     *time.Timer
+
+	pollMutex sync.Mutex               // guards the running polls
+	polls     map[string]chan struct{} // closed when the polled device answers
 }
 
 type MessageHandler interface {
 	SendMessage(topic string, message string)
-	RegisterStateChangeListener(device string, topic string, callback func(string, map[string]interface{})) error
+	Publish(topic string, message string, qos byte, retain bool) error
+	PublishCommand(topic string, message string, qos byte, retain bool) (queued bool, err error)
+	RegisterStateChangeListener(device string, topic string, qos byte, callback func(string, map[string]interface{})) error
+	RemoveStateChangeListener(device string, topic string) error
 }
 
-func NewFullfillment(handler MessageHandler, deviceConfigs map[string]config.DeviceConfig, executionTemplates map[string]string) (*Fullfillment, error) {
+// StateRequester sends a get request with a response topic and waits for the state in the response,
+// the message handler implements it when its client supports request/response
+type StateRequester interface {
+	CanRequest() bool
+	Request(topic string, message string, timeout time.Duration) (map[string]interface{}, error)
+}
+
+// StateReporter reports state changes and notifications of devices to Google
+type StateReporter interface {
+	ReportState(agentUserId string, deviceId string, states map[string]interface{})
+	ReportNotification(agentUserId string, deviceId string, eventId string, notification map[string]interface{})
+}
+
+func NewFullfillment(handler MessageHandler, deviceConfigs map[string]config.DeviceConfig, executionTemplates map[string]string, users map[string]config.UserConfig) (*Fullfillment, error) {
 	devices, err := initDevices(deviceConfigs)
 	if err != nil {
 		return nil, err
 	}
 
+	configured := map[string]bool{}
+	for id := range deviceConfigs {
+		configured[id] = true
+	}
+
 	fullfillment := &Fullfillment{
 		handler:            handler,
 		devices:            devices,
+		configured:         configured,
 		syncPayload:        syncPayload(deviceConfigs),
 		executionTemplates: executionTemplates,
+		users:              initUsers(users),
+		linkedUsers:        &LinkedUsers{users: map[string]bool{}},
 	}
 	fullfillment.startListening(deviceConfigs)
 
 	return fullfillment, nil
 }
 
+// SetLinkedUsers replaces the in-memory linked users, e.g. with users stored in a file
+func (f *Fullfillment) SetLinkedUsers(linkedUsers *LinkedUsers) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.linkedUsers = linkedUsers
+}
+
+// SetStateReporter reports the state changes of devices with willReportState to the linked users
+func (f *Fullfillment) SetStateReporter(reporter StateReporter) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.reporter = reporter
+}
+
 func initDevices(deviceConfigs map[string]config.DeviceConfig) (map[string]Device, error) {
 	devices := map[string]Device{}
 	for id, config := range deviceConfigs {
-		devices[id] = Device{
-			Topic: config.Topic,
-			State: LocalState{
-				State: "off",
-				On:    true,
-			},
-		}
+		devices[id] = initDevice(config)
 	}
 	return devices, nil
 }
 
+func initDevice(config config.DeviceConfig) Device {
+	return Device{
+		Topic:  config.Topic,
+		Config: config,
+		State: LocalState{
+			State: "off",
+			On:    true,
+		},
+	}
+}
+
+func initUsers(userConfigs map[string]config.UserConfig) map[string]config.UserConfig {
+	// usernames are stored lowercase by the login, match the config keys the same way
+	users := map[string]config.UserConfig{}
+	for user, userConfig := range userConfigs {
+		users[strings.ToLower(user)] = userConfig
+	}
+	return users
+}
+
+// allowed reports whether the user can see and control the device,
+// users without a config entry have access to all devices
+func (f *Fullfillment) allowed(userId string, deviceId string) bool {
+	user, ok := f.users[strings.ToLower(userId)]
+	if !ok {
+		return true
+	}
+	return slices.Contains(user.Devices, deviceId)
+}
+
 func (f *Fullfillment) startListening(deviceConfigs map[string]config.DeviceConfig) {
 	for device, config := range deviceConfigs {
-		f.handler.RegisterStateChangeListener(device, config.Subscription, f.setState)
+		for _, topic := range subscriptions(config) {
+			f.subscribe(device, topic, config.SubscriptionQos)
+		}
 	}
 }
 
 func (f *Fullfillment) Handler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := auth.UserId(r.Context())
+	if !ok {
+		log.Error("fullfillment request without authenticated user")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	var request FullfillementRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
@@ -123,8 +244,8 @@ func (f *Fullfillment) Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := f.handle(request)
-	log.Info("fullfillment response", "inputs", request.Inputs, "response", toJson(response))
+	response := f.handle(userId, request)
+	log.Info("fullfillment response", "user", userId, "inputs", request.Inputs, "response", toJson(response))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -135,17 +256,17 @@ func (f *Fullfillment) Handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (f *Fullfillment) handle(request FullfillementRequest) interface{} {
+func (f *Fullfillment) handle(userId string, request FullfillementRequest) interface{} {
 	for _, input := range request.Inputs {
 		switch input.Intent {
 		case "action.devices.SYNC":
-			return f.sync(request, "1234")
+			return f.sync(request, userId)
 		case "action.devices.QUERY":
-			return f.query(request.RequestID, input.Payload)
+			return f.query(userId, request.RequestID, input.Payload)
 		case "action.devices.EXECUTE":
-			return f.execute(request.RequestID, input.Payload)
+			return f.execute(userId, request.RequestID, input.Payload)
 		case "action.devices.DISCONNECT":
-			return f.disconnect(request.RequestID, input.Payload)
+			return f.disconnect(userId, request.RequestID, input.Payload)
 		default:
 			log.Error("handle intent failed", "input", input)
 		}
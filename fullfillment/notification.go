@@ -0,0 +1,72 @@
+package fullfillment
+
+import (
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"strings"
+	"time"
+)
+
+// notify sends the notifications of the rules that match the payload of the topic,
+// the matching rules are kept on the device so a repeated state only notifies once
+func (f *Fullfillment) notify(deviceId string, device *Device, subscription bool, topic string, payload map[string]interface{}) {
+	for i, rule := range device.Config.Notifications {
+		if rule.Topic != topic && !(subscription && (rule.Topic == "" || rule.Topic == device.Config.Subscription)) {
+			continue
+		}
+
+		matches, err := matchNotification(rule, payload)
+		if err != nil {
+			log.Debug("failed to match notification", "device", deviceId, "trait", rule.Trait, "error", err)
+		}
+		matched := device.State.Matching[i]
+		if device.State.Matching == nil {
+			device.State.Matching = map[int]bool{}
+		}
+		device.State.Matching[i] = matches
+
+		if matches && (rule.Repeat || !matched) {
+			f.sendNotification(deviceId, rule)
+		}
+	}
+}
+
+// sendNotification sends the notification of the rule to every linked user that can see the device
+func (f *Fullfillment) sendNotification(deviceId string, rule config.NotificationRule) {
+	if f.reporter == nil || f.linkedUsers == nil {
+		log.Debug("no notification sent, homegraph isn't configured", "device", deviceId, "trait", rule.Trait)
+		return
+	}
+
+	eventId := fmt.Sprintf("%s-%d", deviceId, time.Now().UnixNano())
+	notification := notificationPayload(rule)
+	log.Info("send notification", "device", deviceId, "trait", rule.Trait, "event", eventId)
+	for _, user := range f.linkedUsers.Users() {
+		if f.allowed(user, deviceId) {
+			f.reporter.ReportNotification(user, deviceId, eventId, notification)
+		}
+	}
+}
+
+// notificationPayload returns the notification of the trait with the priority, object detections get the detection time
+func notificationPayload(rule config.NotificationRule) map[string]interface{} {
+	content := mergeStates(rule.Payload, map[string]interface{}{"priority": rule.Priority})
+	if _, ok := content["detectionTimestamp"]; !ok && rule.Trait == "ObjectDetection" {
+		content["detectionTimestamp"] = time.Now().UnixMilli()
+	}
+	return map[string]interface{}{rule.Trait: content}
+}
+
+func matchNotification(rule config.NotificationRule, payload map[string]interface{}) (bool, error) {
+	if rule.Template != "" {
+		result, err := renderTemplate(rule.Trait, rule.Template, payload)
+		if err != nil {
+			return false, err
+		}
+		return strings.TrimSpace(result) == "true", nil
+	}
+
+	value, ok := lookupPath(payload, rule.Field)
+	return ok && fmt.Sprintf("%v", value) == rule.Value, nil
+}
@@ -0,0 +1,109 @@
+package fullfillment
+
+import (
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	doorbell := config.NotificationRule{
+		Field:   "action",
+		Value:   "ring",
+		Trait:   "ObjectDetection",
+		Payload: map[string]interface{}{"objects": map[string]interface{}{"unclassified": 1}},
+		Repeat:  true,
+	}
+	washer := config.NotificationRule{
+		Template: `{{ if eq .cycle "done" }}true{{ end }}`,
+		Trait:    "RunCycle",
+		Priority: 1,
+		Payload:  map[string]interface{}{"status": "done"},
+	}
+	sensor := config.NotificationRule{
+		Topic: "sensor/smoke",
+		Field: "value",
+		Value: "1",
+		Trait: "SensorState",
+	}
+
+	tests := []struct {
+		name                  string
+		rule                  config.NotificationRule
+		topic                 string
+		payloads              []map[string]interface{}
+		expectedNotifications int
+	}{
+		{
+			name:                  "Repeated rule notifies every match",
+			rule:                  doorbell,
+			payloads:              []map[string]interface{}{{"action": "ring"}, {"action": "ring"}, {"battery": 90.0}},
+			expectedNotifications: 2,
+		},
+		{
+			name:                  "Rule notifies when the payload starts matching",
+			rule:                  washer,
+			payloads:              []map[string]interface{}{{"cycle": "done"}, {"cycle": "done"}, {"cycle": "wash"}, {"cycle": "done"}},
+			expectedNotifications: 2,
+		},
+		{
+			name:                  "Rule with topic ignores the subscription",
+			rule:                  sensor,
+			payloads:              []map[string]interface{}{{"value": 1.0}},
+			expectedNotifications: 0,
+		},
+		{
+			name:                  "Rule with topic matches payloads of the topic",
+			rule:                  sensor,
+			topic:                 "sensor/smoke",
+			payloads:              []map[string]interface{}{{"value": 1.0}},
+			expectedNotifications: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reporter := &stateReporterMock{}
+			fullfillment := &Fullfillment{
+				devices: map[string]Device{
+					"device": {Config: config.DeviceConfig{Subscription: "device/state", Notifications: []config.NotificationRule{test.rule}}},
+				},
+				users:       initUsers(nil),
+				linkedUsers: &LinkedUsers{users: map[string]bool{"alice": true}},
+				reporter:    reporter,
+			}
+
+			for _, payload := range test.payloads {
+				fullfillment.setTopicState("device", test.topic, payload)
+			}
+
+			require.Len(t, reporter.notifications, test.expectedNotifications)
+			for _, notification := range reporter.notifications {
+				assert.Equal(t, "alice", notification.user)
+				assert.Equal(t, "device", notification.device)
+				assert.Contains(t, notification.eventId, "device-")
+				assert.Contains(t, notification.notification, test.rule.Trait)
+			}
+		})
+	}
+}
+
+func TestNotificationPayload(t *testing.T) {
+	runCycle := notificationPayload(config.NotificationRule{Trait: "RunCycle", Priority: 1, Payload: map[string]interface{}{"status": "done"}})
+	assert.Equal(t, map[string]interface{}{"RunCycle": map[string]interface{}{"priority": 1, "status": "done"}}, runCycle)
+
+	objectDetection := notificationPayload(config.NotificationRule{Trait: "ObjectDetection", Payload: map[string]interface{}{"objects": map[string]interface{}{"unclassified": 1}}})
+	assert.Contains(t, objectDetection["ObjectDetection"], "detectionTimestamp")
+}
+
+func TestSyncNotificationSupported(t *testing.T) {
+	devices := syncPayload(map[string]config.DeviceConfig{
+		"doorbell": {Notifications: []config.NotificationRule{{Field: "action", Value: "ring", Trait: "ObjectDetection"}}},
+		"lamp":     {},
+	})
+
+	assert.True(t, devices[0].NotificationSupportedByAgent)
+	assert.False(t, devices[1].NotificationSupportedByAgent)
+}
@@ -0,0 +1,125 @@
+package fullfillment
+
+import (
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultGetTemplate requests the state of a zigbee2mqtt device
+const defaultGetTemplate = `{"state":""}`
+
+// defaultGetTimeout is how long a QUERY waits for the state of a device by default
+const defaultGetTimeout = time.Second
+
+// poll requests the state of the devices with a get topic and waits until they answer or time out,
+// devices that don't answer in time keep their cached state
+func (f *Fullfillment) poll(deviceIds []string) {
+	var wg sync.WaitGroup
+	for _, id := range deviceIds {
+		f.mutex.RLock()
+		device, ok := f.devices[id]
+		offline := f.offline
+		f.mutex.RUnlock()
+		if !ok || offline || device.Config.Get.Topic == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(id string, deviceConfig config.DeviceConfig) {
+			defer wg.Done()
+			f.pollDevice(id, deviceConfig)
+		}(id, device.Config)
+	}
+	wg.Wait()
+}
+
+// pollDevice publishes the get request of the device, concurrent polls of a device share the request
+func (f *Fullfillment) pollDevice(id string, deviceConfig config.DeviceConfig) {
+	f.pollMutex.Lock()
+	answered, running := f.polls[id]
+	if !running {
+		if f.polls == nil {
+			f.polls = map[string]chan struct{}{}
+		}
+		answered = make(chan struct{})
+		f.polls[id] = answered
+	}
+	f.pollMutex.Unlock()
+
+	get := deviceConfig.Get
+	timeout := get.Timeout
+	if timeout == 0 {
+		timeout = defaultGetTimeout
+	}
+	if !running {
+		if requester, ok := f.handler.(StateRequester); ok && requester.CanRequest() {
+			go f.request(requester, id, get, timeout)
+		} else {
+			f.handler.Publish(get.Topic, getTemplate(get), deviceConfig.Qos, false)
+		}
+	}
+
+	select {
+	case <-answered:
+	case <-time.After(timeout):
+		log.Warn("device didn't answer the get request in time, use the cached state", "device", id, "topic", get.Topic)
+		f.pollMutex.Lock()
+		if f.polls[id] == answered {
+			delete(f.polls, id)
+		}
+		f.pollMutex.Unlock()
+	}
+}
+
+// request publishes the get request with a response topic, the response updates the state like a message of the subscription.
+// Devices that don't use the response topic answer on their subscription.
+func (f *Fullfillment) request(requester StateRequester, id string, get config.GetConfig, timeout time.Duration) {
+	state, err := requester.Request(get.Topic, getTemplate(get), timeout)
+	if err != nil {
+		log.Debug("no response to the get request", "device", id, "topic", get.Topic, "error", err)
+		return
+	}
+	f.setState(id, state)
+}
+
+// answered ends the poll of the device, its state is received on the subscription topic
+func (f *Fullfillment) answered(id string) {
+	f.pollMutex.Lock()
+	defer f.pollMutex.Unlock()
+	if answered, ok := f.polls[id]; ok {
+		close(answered)
+		delete(f.polls, id)
+	}
+}
+
+// refresh requests the state of all devices with a get topic without waiting for the answers,
+// devices that don't retain their state are up-to-date again after a reconnect
+func (f *Fullfillment) refresh() {
+	f.mutex.RLock()
+	var ids []string
+	for id, device := range f.devices {
+		if device.Config.Get.Topic != "" {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	devices := make([]config.DeviceConfig, 0, len(ids))
+	for _, id := range ids {
+		devices = append(devices, f.devices[id].Config)
+	}
+	f.mutex.RUnlock()
+
+	for _, device := range devices {
+		_ = f.handler.Publish(device.Get.Topic, getTemplate(device.Get), device.Qos, false)
+	}
+}
+
+func getTemplate(get config.GetConfig) string {
+	if get.Template == "" {
+		return defaultGetTemplate
+	}
+	return get.Template
+}
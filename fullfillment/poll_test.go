@@ -0,0 +1,135 @@
+package fullfillment
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryPoll(t *testing.T) {
+	tests := []struct {
+		name       string
+		answer     bool
+		expectedOn bool
+	}{
+		{name: "Device answers the get request", answer: true, expectedOn: true},
+		{name: "Device doesn't answer in time", answer: false, expectedOn: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &pollHandlerMock{answer: test.answer}
+			fullfillment := newPollFullfillment(handler)
+			handler.fullfillment = fullfillment
+
+			response := fullfillment.query("alice", "1", PayloadRequest{Devices: []DeviceRequest{{ID: "lamp"}}})
+
+			assert.Equal(t, test.expectedOn, response.Payload.Devices["lamp"].On)
+			assert.Equal(t, int32(1), handler.requests.Load())
+			assert.Equal(t, "zigbee2mqtt/lamp/get", handler.topic)
+			assert.Equal(t, `{"state":""}`, handler.message)
+		})
+	}
+}
+
+func TestQueryPollCoalesced(t *testing.T) {
+	handler := &pollHandlerMock{answer: true, delay: 50 * time.Millisecond}
+	fullfillment := newPollFullfillment(handler)
+	handler.fullfillment = fullfillment
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response := fullfillment.query("alice", "1", PayloadRequest{Devices: []DeviceRequest{{ID: "lamp"}}})
+			assert.True(t, response.Payload.Devices["lamp"].On)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), handler.requests.Load())
+}
+
+func TestRefreshAfterReconnect(t *testing.T) {
+	handler := &pollHandlerMock{}
+	fullfillment := newPollFullfillment(handler)
+	fullfillment.devices["plug"] = Device{Config: config.DeviceConfig{Subscription: "zigbee2mqtt/plug"}}
+
+	fullfillment.SetConnected(false)
+	fullfillment.SetConnected(true)
+
+	assert.Eventually(t, func() bool { return handler.requests.Load() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, "zigbee2mqtt/lamp/get", handler.topic)
+	assert.Equal(t, `{"state":""}`, handler.message)
+}
+
+func TestQueryPollRequest(t *testing.T) {
+	handler := &requestHandlerMock{}
+	fullfillment := newPollFullfillment(handler)
+
+	response := fullfillment.query("alice", "1", PayloadRequest{Devices: []DeviceRequest{{ID: "lamp"}}})
+
+	assert.True(t, response.Payload.Devices["lamp"].On)
+	assert.Equal(t, "zigbee2mqtt/lamp/get", handler.topic)
+	assert.Equal(t, `{"state":""}`, handler.message)
+	assert.Empty(t, handler.messages)
+}
+
+func newPollFullfillment(handler MessageHandler) *Fullfillment {
+	fullfillment := &Fullfillment{
+		handler: handler,
+		devices: map[string]Device{
+			"lamp": {Config: config.DeviceConfig{
+				Subscription: "zigbee2mqtt/lamp",
+				Get:          config.GetConfig{Topic: "zigbee2mqtt/lamp/get", Timeout: 200 * time.Millisecond},
+			}},
+		},
+	}
+	fullfillment.setState("lamp", map[string]interface{}{"state": "OFF"})
+	return fullfillment
+}
+
+// pollHandlerMock answers get requests with the state of the device on its subscription
+type pollHandlerMock struct {
+	MessageHandlerMock
+	fullfillment *Fullfillment
+	answer       bool
+	delay        time.Duration
+	requests     atomic.Int32
+	topic        string
+	message      string
+}
+
+func (m *pollHandlerMock) Publish(topic string, message string, qos byte, retain bool) error {
+	m.topic = topic
+	m.message = message
+	m.requests.Add(1)
+	if !m.answer {
+		return nil
+	}
+	go func() {
+		time.Sleep(m.delay)
+		m.fullfillment.setTopicState("lamp", "zigbee2mqtt/lamp", map[string]interface{}{"state": "ON"})
+	}()
+	return nil
+}
+
+// requestHandlerMock answers get requests with the state of the device in the response
+type requestHandlerMock struct {
+	MessageHandlerMock
+	topic   string
+	message string
+}
+
+func (m *requestHandlerMock) CanRequest() bool { return true }
+
+func (m *requestHandlerMock) Request(topic string, message string, timeout time.Duration) (map[string]interface{}, error) {
+	m.topic = topic
+	m.message = message
+	return map[string]interface{}{"state": "ON"}, nil
+}
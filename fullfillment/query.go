@@ -1,6 +1,9 @@
 package fullfillment
 
-import log "log/slog"
+import (
+	"encoding/json"
+	log "log/slog"
+)
 
 type QueryResponse struct {
 	RequestID string       `json:"requestId,omitempty"` // Required. ID of the corresponding request.
@@ -21,20 +24,64 @@ type QueryDevice struct {
 	On         bool   `json:"on,omitempty"`
 	Brightness int    `json:"brightness,omitempty"`
 	Color      *Color `json:"color,omitempty"`
+
+	States map[string]interface{} `json:"-"` // Google states mapped from the device payload, added to the json of the device
+}
+
+func (d QueryDevice) MarshalJSON() ([]byte, error) {
+	type queryDevice QueryDevice
+	data, err := json.Marshal(queryDevice(d))
+	if err != nil || len(d.States) == 0 {
+		return data, err
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range d.States {
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
 }
 
 type Color struct {
 	SpectrumRgb int `json:"spectrumRgb,omitempty"`
 }
 
-func (f *Fullfillment) query(requestId string, payload PayloadRequest) QueryResponse {
-	log.Info("handle sync request", "request", requestId, "payload", payload)
+func (f *Fullfillment) query(userId string, requestId string, payload PayloadRequest) QueryResponse {
+	log.Info("handle query request", "request", requestId, "user", userId, "payload", payload)
+	f.poll(f.allowedDevices(userId, payload.Devices))
+
+	// the events are published without holding the mutex, so a slow broker doesn't block the state updates
+	f.mutex.RLock()
 	devices := map[string]QueryDevice{}
+	var events []Event
 	for _, device := range payload.Devices {
+		if !f.allowed(userId, device.ID) {
+			log.Warn("query device not allowed for user", "device", device.ID, "user", userId)
+			devices[device.ID] = QueryDevice{
+				Status:    "ERROR",
+				ErrorCode: "deviceNotFound",
+			}
+			events = append(events, Event{Intent: queryEvent, RequestId: requestId, User: userId, Device: device.ID, Status: "ERROR", ErrorCode: "deviceNotFound"})
+			continue
+		}
+
 		devices[device.ID] = QueryDevice{
-			Online: true,
+			Online: !f.offline,
 			On:     f.devices[device.ID].State.On,
+			States: f.devices[device.ID].State.States,
 		}
+		events = append(events, Event{Intent: queryEvent, RequestId: requestId, User: userId, Device: device.ID, States: devices[device.ID]})
+	}
+	publisher := f.events
+	f.mutex.RUnlock()
+
+	for _, event := range events {
+		emitEvent(publisher, event)
 	}
 
 	return QueryResponse{
@@ -44,3 +91,17 @@ func (f *Fullfillment) query(requestId string, payload PayloadRequest) QueryResp
 		},
 	}
 }
+
+// allowedDevices returns the ids of the requested devices the user has access to
+func (f *Fullfillment) allowedDevices(userId string, devices []DeviceRequest) []string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	var ids []string
+	for _, device := range devices {
+		if f.allowed(userId, device.ID) {
+			ids = append(ids, device.ID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,69 @@
+package fullfillment
+
+import (
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"reflect"
+)
+
+// Reload applies the devices, templates and users of a new config, the state of unchanged devices is kept.
+// Topics of changed devices are subscribed and unsubscribed, and a SYNC is requested when the devices changed.
+func (f *Fullfillment) Reload(deviceConfigs map[string]config.DeviceConfig, executionTemplates map[string]string, users map[string]config.UserConfig) {
+	f.mutex.Lock()
+	oldSubscriptions := map[string][]string{}
+	newSubscriptions := map[string][]string{}
+	qosChanged := map[string]bool{}
+	removed := 0
+
+	for id := range f.configured {
+		if _, ok := deviceConfigs[id]; ok {
+			continue
+		}
+		oldSubscriptions[id] = subscriptions(f.devices[id].Config)
+		delete(f.devices, id)
+		removed++
+		log.Info("remove device on reload", "device", id)
+	}
+
+	configured := map[string]bool{}
+	for id, deviceConfig := range deviceConfigs {
+		configured[id] = true
+		device, exists := f.devices[id]
+		if exists && reflect.DeepEqual(device.Config, deviceConfig) {
+			continue
+		}
+
+		if exists {
+			oldSubscriptions[id] = subscriptions(device.Config)
+			qosChanged[id] = device.Config.SubscriptionQos != deviceConfig.SubscriptionQos
+			device.Topic = deviceConfig.Topic
+			device.Config = deviceConfig
+			device.State.Matching = nil
+		} else {
+			device = initDevice(deviceConfig)
+		}
+		f.devices[id] = device
+		newSubscriptions[id] = subscriptions(deviceConfig)
+		log.Info("update device on reload", "device", id, "name", deviceConfig.Name, "update", exists)
+	}
+
+	f.configured = configured
+	f.syncPayload = syncPayload(f.deviceConfigs())
+	f.executionTemplates = executionTemplates
+	f.users = initUsers(users)
+	f.mutex.Unlock()
+
+	// subscribe without holding the lock, retained state messages are delivered right away
+	for id, topics := range oldSubscriptions {
+		if _, ok := newSubscriptions[id]; !ok || qosChanged[id] {
+			f.resubscribe(id, topics, nil, 0)
+			oldSubscriptions[id] = nil
+		}
+	}
+	for id, topics := range newSubscriptions {
+		f.resubscribe(id, oldSubscriptions[id], topics, deviceConfigs[id].SubscriptionQos)
+	}
+
+	log.Info("reloaded config", "devices", len(deviceConfigs), "changed", len(newSubscriptions), "removed", removed)
+	f.scheduleSync()
+}
@@ -0,0 +1,49 @@
+package fullfillment
+
+import (
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	handler := &MessageHandlerMock{}
+	fullfillment, err := NewFullfillment(handler, map[string]config.DeviceConfig{
+		"lamp":   {Name: "lamp", Subscription: "zigbee2mqtt/lamp"},
+		"plug":   {Name: "plug", Subscription: "zigbee2mqtt/plug"},
+		"heater": {Name: "heater", Subscription: "tasmota/heater"},
+	}, map[string]string{"action.devices.commands.OnOff": `{"state":"%s"}`}, nil)
+	require.NoError(t, err)
+	fullfillment.AddDevice("sensor", config.DeviceConfig{Name: "sensor", Subscription: "zigbee2mqtt/sensor"})
+	fullfillment.setState("lamp", map[string]interface{}{"state": "ON"})
+	fullfillment.setState("plug", map[string]interface{}{"state": "ON"})
+
+	fullfillment.Reload(map[string]config.DeviceConfig{
+		"lamp":  {Name: "lamp", Subscription: "zigbee2mqtt/lamp"},
+		"plug":  {Name: "plug", Subscription: "zigbee2mqtt/socket"},
+		"fan":   {Name: "fan", Subscription: "zigbee2mqtt/fan"},
+		"light": {Name: "light", Subscription: "zigbee2mqtt/lamp"},
+	}, map[string]string{"action.devices.commands.OnOff": `{"power":"%s"}`}, map[string]config.UserConfig{
+		"Alice": {Devices: []string{"lamp"}},
+	})
+
+	assert.Equal(t, map[string][]string{
+		"zigbee2mqtt/lamp":   {"lamp", "light"},
+		"zigbee2mqtt/socket": {"plug"},
+		"zigbee2mqtt/fan":    {"fan"},
+		"zigbee2mqtt/sensor": {"sensor"},
+	}, handler.listeners)
+	assert.Len(t, fullfillment.devices, 5)
+	assert.NotContains(t, fullfillment.devices, "heater")
+	assert.Contains(t, fullfillment.devices, "sensor", "discovered devices are kept")
+	assert.Equal(t, map[string]bool{"lamp": true, "plug": true, "fan": true, "light": true}, fullfillment.configured)
+
+	assert.True(t, fullfillment.devices["lamp"].State.States["on"].(bool), "state of unchanged devices is kept")
+	assert.True(t, fullfillment.devices["plug"].State.States["on"].(bool), "state of changed devices is kept")
+	assert.Len(t, fullfillment.syncPayload, 5)
+	assert.Equal(t, `{"power":"%s"}`, fullfillment.executionTemplates["action.devices.commands.OnOff"])
+	assert.True(t, fullfillment.allowed("alice", "lamp"))
+	assert.False(t, fullfillment.allowed("alice", "plug"))
+}
@@ -0,0 +1,127 @@
+package fullfillment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// SyncRequester asks Google to SYNC the devices of a user
+type SyncRequester interface {
+	RequestSync(agentUserId string) error
+}
+
+// SetSyncRequester requests a SYNC for the linked users when the devices change, changes are collected for the delay.
+// The hash of the last synced devices is stored in the file, so a restart only requests a SYNC when the devices changed.
+func (f *Fullfillment) SetSyncRequester(requester SyncRequester, hashFile string, delay time.Duration) {
+	f.syncMutex.Lock()
+	f.syncRequester = requester
+	f.syncHashFile = hashFile
+	f.syncDelay = delay
+	f.syncedHash = readSyncHash(hashFile)
+	f.syncMutex.Unlock()
+
+	f.scheduleSync()
+}
+
+// RequestSync requests a SYNC for all linked users, even if the devices didn't change
+func (f *Fullfillment) RequestSync() {
+	f.requestSync(true)
+}
+
+// scheduleSync checks for changed devices after the delay, so a burst of discovered devices results in one SYNC
+func (f *Fullfillment) scheduleSync() {
+	f.syncMutex.Lock()
+	defer f.syncMutex.Unlock()
+
+	if f.syncRequester == nil || f.syncTimer != nil {
+		return
+	}
+	f.syncTimer = time.AfterFunc(f.syncDelay, func() {
+		f.syncMutex.Lock()
+		f.syncTimer = nil
+		f.syncMutex.Unlock()
+
+		f.requestSync(false)
+	})
+}
+
+// requestSync requests a SYNC when the devices differ from the last synced devices or when forced
+func (f *Fullfillment) requestSync(force bool) {
+	f.mutex.RLock()
+	users := f.linkedUserIds()
+	hash := syncHash(f.syncPayload)
+	f.mutex.RUnlock()
+
+	f.syncMutex.Lock()
+	requester, syncedHash := f.syncRequester, f.syncedHash
+	f.syncMutex.Unlock()
+
+	if requester == nil {
+		log.Info("no sync requested, homegraph isn't configured")
+		return
+	}
+	if !force && hash == syncedHash {
+		return
+	}
+
+	log.Info("request sync", "users", len(users), "forced", force)
+	failed := false
+	for _, user := range users {
+		if err := requester.RequestSync(user); err != nil {
+			log.Error("failed to request sync", "user", user, "error", err)
+			failed = true
+		}
+	}
+	if failed {
+		// keep the old hash, the next change or restart tries again
+		return
+	}
+
+	f.syncMutex.Lock()
+	f.syncedHash = hash
+	writeSyncHash(f.syncHashFile, hash)
+	f.syncMutex.Unlock()
+}
+
+func (f *Fullfillment) linkedUserIds() []string {
+	if f.linkedUsers == nil {
+		return nil
+	}
+	return f.linkedUsers.Users()
+}
+
+// syncHash is the hash of the SYNC payload of all devices
+func syncHash(devices []SyncDevices) string {
+	data, err := json.Marshal(devices)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func readSyncHash(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error("failed to read sync hash", "file", filename, "error", err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func writeSyncHash(filename string, hash string) {
+	if filename == "" {
+		return
+	}
+	if err := os.WriteFile(filename, []byte(hash), 0600); err != nil {
+		log.Error("failed to store sync hash", "file", filename, "error", err)
+	}
+}
@@ -0,0 +1,102 @@
+package fullfillment
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSyncOnStartup(t *testing.T) {
+	hashFile := filepath.Join(t.TempDir(), ".synchash")
+	deviceConfigs := map[string]config.DeviceConfig{
+		"plug": {Name: "plug", Type: "action.devices.types.OUTLET"},
+	}
+
+	tests := []struct {
+		name             string
+		storedHash       string
+		expectedRequests []string
+	}{
+		{
+			name:             "Devices changed since the last run",
+			storedHash:       "outdated",
+			expectedRequests: []string{"alice", "bob"},
+		},
+		{
+			name:             "Devices didn't change",
+			storedHash:       syncHash(syncPayload(deviceConfigs)),
+			expectedRequests: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(hashFile, []byte(test.storedHash), 0600))
+			requester := &syncRequesterMock{}
+			fullfillment, err := NewFullfillment(&MessageHandlerMock{}, deviceConfigs, nil, nil)
+			require.NoError(t, err)
+			fullfillment.SetLinkedUsers(&LinkedUsers{users: map[string]bool{"alice": true, "bob": true}})
+
+			fullfillment.SetSyncRequester(requester, hashFile, 0)
+
+			if test.expectedRequests == nil {
+				time.Sleep(20 * time.Millisecond)
+				assert.Empty(t, requester.users())
+			} else {
+				assert.Eventually(t, func() bool { return len(requester.users()) == len(test.expectedRequests) }, time.Second, time.Millisecond)
+				assert.Equal(t, test.expectedRequests, requester.users())
+			}
+
+			data, err := os.ReadFile(hashFile)
+			require.NoError(t, err)
+			assert.Equal(t, syncHash(syncPayload(deviceConfigs)), string(data))
+		})
+	}
+}
+
+func TestRequestSyncOnDiscovery(t *testing.T) {
+	requester := &syncRequesterMock{}
+	fullfillment, err := NewFullfillment(&MessageHandlerMock{}, map[string]config.DeviceConfig{}, nil, nil)
+	require.NoError(t, err)
+	fullfillment.SetLinkedUsers(&LinkedUsers{users: map[string]bool{"alice": true}})
+	fullfillment.SetSyncRequester(requester, "", 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(requester.users()) == 1 }, time.Second, time.Millisecond)
+
+	fullfillment.AddDevice("lamp", config.DeviceConfig{Name: "lamp"})
+	fullfillment.AddDevice("plug", config.DeviceConfig{Name: "plug"})
+
+	assert.Eventually(t, func() bool { return len(requester.users()) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []string{"alice", "alice"}, requester.users(), "discovered devices are synced at once")
+
+	fullfillment.AddDevice("plug", config.DeviceConfig{Name: "plug"})
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(t, requester.users(), 2, "unchanged devices aren't synced")
+
+	fullfillment.RequestSync()
+	assert.Len(t, requester.users(), 3, "a forced sync is always requested")
+}
+
+type syncRequesterMock struct {
+	mutex     sync.Mutex
+	requested []string
+}
+
+func (r *syncRequesterMock) RequestSync(agentUserId string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requested = append(r.requested, agentUserId)
+	return nil
+}
+
+func (r *syncRequesterMock) users() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.requested
+}
@@ -1,8 +1,13 @@
 package fullfillment
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
 	log "log/slog"
+	"math"
+	"reflect"
+	"strings"
 )
 
 // type DeviceConfig struct {
@@ -31,22 +36,190 @@ import (
 // 	SwVersion    string `json:"swVersion,omitempty"`
 // }
 
+// defaultStates maps the zigbee2mqtt `state` field for devices without state mappings
+var defaultStates = map[string]config.StateMapping{
+	"on": {Field: "state", Values: map[string]interface{}{"ON": true, "OFF": false}},
+}
+
+// setState updates the device with a payload of its subscription
 func (f *Fullfillment) setState(deviceId string, payload map[string]interface{}) {
-	if _, ok := payload["state"]; !ok {
-		log.Info("failed to get state for device", "device", deviceId, "payload", payload)
+	f.setTopicState(deviceId, "", payload)
+}
+
+// setTopicState updates the device with a payload of the topic, only the mappings of the topic are applied
+func (f *Fullfillment) setTopicState(deviceId string, topic string, payload map[string]interface{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	device, ok := f.devices[deviceId]
+	if !ok {
+		log.Info("failed to find device for state", "device", deviceId, "payload", payload)
 		return
 	}
-	state := fmt.Sprintf("%v", payload["state"])
-	if state != "OFF" && state != "ON" {
+
+	subscription := topic == "" || topic == device.Config.Subscription
+	if subscription {
+		// the state is stored when a polling QUERY continues
+		defer f.answered(deviceId)
+	}
+	f.notify(deviceId, &device, subscription, topic, payload)
+	f.devices[deviceId] = device
+
+	mappings := topicMappings(device.Config, subscription, topic)
+
+	states := mapStates(deviceId, mappings, payload)
+	if len(states) == 0 {
 		log.Info("failed to get state for device", "device", deviceId, "payload", payload)
 		return
 	}
 
-	device := f.devices[deviceId]
+	oldState := device.State
 	device.State = LocalState{
-		State: state,
-		On:    state == "ON",
+		State:    oldState.State,
+		On:       oldState.On,
+		Payload:  oldState.Payload,
+		States:   mergeStates(oldState.States, states),
+		Matching: oldState.Matching,
+	}
+	if subscription {
+		device.State.Payload = mergeStates(oldState.Payload, payload)
 	}
-	log.Info("change state", "device", device, "old", f.devices[deviceId].State, "new", device.State)
+	if on, ok := states["on"].(bool); ok {
+		device.State.On = on
+		device.State.State = strings.ToUpper(onOffValue(on))
+	}
+	log.Info("change state", "device", deviceId, "old", oldState.States, "new", device.State.States)
 	f.devices[deviceId] = device
+
+	if !reflect.DeepEqual(oldState.States, device.State.States) {
+		f.reportState(deviceId, device)
+	}
+}
+
+// reportState reports the states of the device to every linked user that can see it
+func (f *Fullfillment) reportState(deviceId string, device Device) {
+	if f.reporter == nil || f.linkedUsers == nil || !device.Config.WillReportState {
+		return
+	}
+
+	states := mergeStates(device.State.States, map[string]interface{}{"online": !f.offline})
+	for _, user := range f.linkedUsers.Users() {
+		if f.allowed(user, deviceId) {
+			f.reporter.ReportState(user, deviceId, states)
+		}
+	}
+}
+
+// topicMappings returns the state mappings of the topic, mappings without a topic belong to the subscription
+func topicMappings(deviceConfig config.DeviceConfig, subscription bool, topic string) map[string]config.StateMapping {
+	if len(deviceConfig.States) == 0 {
+		if subscription {
+			return defaultStates
+		}
+		return nil
+	}
+
+	mappings := map[string]config.StateMapping{}
+	for name, mapping := range deviceConfig.States {
+		if mapping.Topic == topic || (subscription && (mapping.Topic == "" || mapping.Topic == deviceConfig.Subscription)) {
+			mappings[name] = mapping
+		}
+	}
+	return mappings
+}
+
+// mapStates converts the payload of a device into Google states, nested states like `color.spectrumRgb` are expanded
+func mapStates(deviceId string, mappings map[string]config.StateMapping, payload map[string]interface{}) map[string]interface{} {
+	states := map[string]interface{}{}
+	for name, mapping := range mappings {
+		value, ok, err := mapState(name, mapping, payload)
+		if err != nil {
+			log.Debug("failed to map state", "device", deviceId, "state", name, "error", err)
+			continue
+		}
+		if ok {
+			setPath(states, name, value)
+		}
+	}
+	return states
+}
+
+func mapState(name string, mapping config.StateMapping, payload map[string]interface{}) (interface{}, bool, error) {
+	var value interface{}
+	if mapping.Template != "" {
+		result, err := renderTemplate(name, mapping.Template, payload)
+		if err != nil {
+			return nil, false, err
+		}
+		result = strings.TrimSpace(result)
+		if result == "" {
+			return nil, false, nil
+		}
+		if err := json.Unmarshal([]byte(result), &value); err != nil {
+			value = result
+		}
+	} else {
+		var ok bool
+		value, ok = lookupPath(payload, mapping.Field)
+		if !ok {
+			return nil, false, nil
+		}
+	}
+
+	if mapping.Values != nil {
+		mapped, ok := mapping.Values[fmt.Sprintf("%v", value)]
+		if !ok {
+			return nil, false, fmt.Errorf("no mapping for value `%v`", value)
+		}
+		value = mapped
+	}
+
+	if mapping.Max != 0 {
+		scaled, err := scale(value, mapping.Min, mapping.Max, 0, 100)
+		if err != nil {
+			return nil, false, err
+		}
+		value = int64(math.Round(scaled))
+	}
+	return value, true, nil
+}
+
+func lookupPath(payload map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = fields[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func setPath(states map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		nested, ok := states[key].(map[string]interface{})
+		if !ok {
+			nested = map[string]interface{}{}
+			states[key] = nested
+		}
+		states = nested
+	}
+	states[keys[len(keys)-1]] = value
+}
+
+// mergeStates returns a copy of the old states updated with the new states, top-level keys are replaced
+func mergeStates(old map[string]interface{}, new map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(old)+len(new))
+	for key, value := range old {
+		merged[key] = value
+	}
+	for key, value := range new {
+		merged[key] = value
+	}
+	return merged
 }
@@ -0,0 +1,145 @@
+package fullfillment
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetStateMapping(t *testing.T) {
+	tests := []struct {
+		name           string
+		profile        string
+		payloads       []map[string]interface{}
+		expectedStates map[string]interface{}
+		expectedOn     bool
+	}{
+		{
+			name: "Default mapping",
+			payloads: []map[string]interface{}{
+				{"state": "ON", "linkquality": 120.0},
+			},
+			expectedStates: map[string]interface{}{"on": true},
+			expectedOn:     true,
+		},
+		{
+			name:    "Zigbee2mqtt light with color temperature",
+			profile: "zigbee2mqtt-light",
+			payloads: []map[string]interface{}{
+				{"state": "ON", "brightness": 127.0, "color_mode": "color_temp", "color_temp": 370.0},
+			},
+			expectedStates: map[string]interface{}{
+				"on":         true,
+				"brightness": int64(50),
+				"color":      map[string]interface{}{"temperatureK": 2703.0},
+			},
+			expectedOn: true,
+		},
+		{
+			name:    "Tasmota results are merged",
+			profile: "tasmota-dimmer",
+			payloads: []map[string]interface{}{
+				{"POWER": "ON"},
+				{"Dimmer": 40.0},
+				{"POWER": "OFF"},
+			},
+			expectedStates: map[string]interface{}{"on": false, "brightness": 40.0},
+			expectedOn:     false,
+		},
+		{
+			name:    "Shelly plain payload",
+			profile: "shelly-gen1-relay",
+			payloads: []map[string]interface{}{
+				{"value": "on"},
+			},
+			expectedStates: map[string]interface{}{"on": true},
+			expectedOn:     true,
+		},
+		{
+			name:    "Unmapped value is ignored",
+			profile: "zigbee2mqtt-plug",
+			payloads: []map[string]interface{}{
+				{"state": "ON"},
+				{"state": "TOGGLE"},
+			},
+			expectedStates: map[string]interface{}{"on": true},
+			expectedOn:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deviceConfig := config.DeviceConfig{Name: "device"}
+			if test.profile != "" {
+				var err error
+				deviceConfig, err = config.ApplyProfile(config.DeviceConfig{Profile: test.profile, FriendlyName: "device"}, nil)
+				require.NoError(t, err)
+			}
+			fullfillment := &Fullfillment{
+				devices: map[string]Device{
+					"device": {Config: deviceConfig},
+				},
+			}
+
+			for _, payload := range test.payloads {
+				fullfillment.setState("device", payload)
+			}
+
+			assert.Equal(t, test.expectedStates, fullfillment.devices["device"].State.States)
+			assert.Equal(t, test.expectedOn, fullfillment.devices["device"].State.On)
+		})
+	}
+}
+
+func TestSetTopicState(t *testing.T) {
+	fullfillment := &Fullfillment{
+		devices: map[string]Device{
+			"thermostat": {
+				Config: config.DeviceConfig{
+					Subscription: "thermostat/state",
+					States: map[string]config.StateMapping{
+						"thermostatMode":                {Field: "value"},
+						"thermostatTemperatureSetpoint": {Field: "value", Topic: "thermostat/target"},
+						"thermostatTemperatureAmbient":  {Field: "value", Topic: "thermostat/current"},
+					},
+				},
+			},
+		},
+	}
+
+	fullfillment.setTopicState("thermostat", "thermostat/state", map[string]interface{}{"value": "heat"})
+	fullfillment.setTopicState("thermostat", "thermostat/target", map[string]interface{}{"value": 21.5})
+	fullfillment.setTopicState("thermostat", "thermostat/current", map[string]interface{}{"value": 19.0})
+
+	assert.Equal(t, map[string]interface{}{
+		"thermostatMode":                "heat",
+		"thermostatTemperatureSetpoint": 21.5,
+		"thermostatTemperatureAmbient":  19.0,
+	}, fullfillment.devices["thermostat"].State.States)
+	assert.Equal(t, map[string]interface{}{"value": "heat"}, fullfillment.devices["thermostat"].State.Payload)
+}
+
+func TestQueryStates(t *testing.T) {
+	fullfillment := &Fullfillment{
+		devices: map[string]Device{
+			"lamp": {
+				State: LocalState{
+					States: map[string]interface{}{
+						"on":         false,
+						"brightness": int64(50),
+						"color":      map[string]interface{}{"spectrumRgb": 16711680},
+					},
+				},
+			},
+		},
+	}
+
+	result := fullfillment.query("", "test-request", PayloadRequest{Devices: []DeviceRequest{{ID: "lamp"}}})
+
+	data, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"requestId":"test-request","payload":{"devices":{"lamp":{"online":true,"on":false,"brightness":50,"color":{"spectrumRgb":16711680}}}}}`, string(data))
+}
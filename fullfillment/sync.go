@@ -3,6 +3,7 @@ package fullfillment
 import (
 	"github.com/mrlauy/ghome-mqtt/config"
 	log "log/slog"
+	"sort"
 )
 
 /*
@@ -102,17 +103,17 @@ type SyncPayload struct {
 }
 
 type SyncDevices struct {
-	ID                           string                 `json:"id"`                                     // Required. The ID of the device in the developer's cloud. This must be unique for the user and for the developer, as in cases of sharing we may use this to dedupe multiple views of the same device. It should be immutable for the device; if it changes, the Assistant will treat it as a new device.
-	Type                         string                 `json:"type"`                                   // Required. The hardware type of device.
-	Traits                       []string               `json:"traits"`                                 // Required. List of traits this device has. This defines the commands, attributes, and states that the device supports.
-	Name                         SyncName               `json:"name"`                                   // Required. Names of this device.
-	WillReportState              bool                   `json:"willReportState"`                        // Required.	Indicates whether this device will have its states updated by the Real Time Feed. (true to use the Real Time Feed for reporting state, and false to use the polling model.)
-	RoomHint                     string                 `json:"roomHint,omitempty"`                     // Provides the current room of the device in the user's home to simplify setup.
-	NotificationSupportedByAgent bool                   `json:"notificationSupportedByAgent,omitempty"` // (Default: false) Indicates whether notifications are enabled for the device.
-	DeviceInfo                   *SyncDeviceInfo        `json:"deviceInfo,omitempty"`                   // Contains fields describing the device for use in one-off logic if needed (e.g. 'broken firmware version X of light Y requires adjusting color', or 'security flaw requires notifying all users of firmware Z').
-	OtherDeviceIds               []*SyncOtherDeviceIds  `json:"otherDeviceIds,omitempty"`               // List of alternate IDs used to identify a cloud synced device for local execution.
-	CustomData                   *SyncCustomData        `json:"customData,omitempty"`                   // Object defined by the developer which will be attached to future QUERY and EXECUTE requests, maximum of 512 bytes per device. Use this object to store additional information about the device your cloud service may need, such as the global region of the device. Data in this object has a few constraints: No sensitive information, including but not limited to Personally Identifiable Information.
-	Attributes                   *config.SyncAttributes `json:"attributes,omitempty"`                   // Aligned with per-trait attributes described in each trait schema reference.
+	ID                           string                      `json:"id"`                                     // Required. The ID of the device in the developer's cloud. This must be unique for the user and for the developer, as in cases of sharing we may use this to dedupe multiple views of the same device. It should be immutable for the device; if it changes, the Assistant will treat it as a new device.
+	Type                         string                      `json:"type"`                                   // Required. The hardware type of device.
+	Traits                       []string                    `json:"traits"`                                 // Required. List of traits this device has. This defines the commands, attributes, and states that the device supports.
+	Name                         SyncName                    `json:"name"`                                   // Required. Names of this device.
+	WillReportState              bool                        `json:"willReportState"`                        // Required.	Indicates whether this device will have its states updated by the Real Time Feed. (true to use the Real Time Feed for reporting state, and false to use the polling model.)
+	RoomHint                     string                      `json:"roomHint,omitempty"`                     // Provides the current room of the device in the user's home to simplify setup.
+	NotificationSupportedByAgent bool                        `json:"notificationSupportedByAgent,omitempty"` // (Default: false) Indicates whether notifications are enabled for the device.
+	DeviceInfo                   *config.SyncDeviceInfo      `json:"deviceInfo,omitempty"`                   // Contains fields describing the device for use in one-off logic if needed (e.g. 'broken firmware version X of light Y requires adjusting color', or 'security flaw requires notifying all users of firmware Z').
+	OtherDeviceIds               []config.SyncOtherDeviceIds `json:"otherDeviceIds,omitempty"`               // List of alternate IDs used to identify a cloud synced device for local execution.
+	CustomData                   map[string]interface{}      `json:"customData,omitempty"`                   // Object defined by the developer which will be attached to future QUERY and EXECUTE requests, maximum of 512 bytes per device. Use this object to store additional information about the device your cloud service may need, such as the global region of the device. Data in this object has a few constraints: No sensitive information, including but not limited to Personally Identifiable Information.
+	Attributes                   *config.SyncAttributes      `json:"attributes,omitempty"`                   // Aligned with per-trait attributes described in each trait schema reference.
 }
 
 type SyncName struct {
@@ -121,49 +122,66 @@ type SyncName struct {
 	Nicknames    []string `json:"nicknames,omitempty"`    // Additional names provided by the user for the device.
 }
 
-type SyncDeviceInfo struct {
-	Manufacturer string `json:"manufacturer,omitempty"` // Especially useful when the developer is a hub for other devices. Google may provide a standard list of manufacturers here so that e.g. TP-Link and Smartthings both describe 'osram' the same way.
-	Model        string `json:"model,omitempty"`        // The model or SKU identifier of the particular device.
-	HwVersion    string `json:"hwVersion,omitempty"`    // Specific version number attached to the hardware if available.
-	SwVersion    string `json:"swVersion,omitempty"`    // Specific version number attached to the software/firmware, if available.
-}
-
-type SyncOtherDeviceIds struct {
-	AgentId  string `json:"agentId,omitempty"` // The agent's ID. Generally, this is the project ID in the Actions console.
-	DeviceID string `json:"deviceId"`          // Required. Device ID defined by the agent. The device ID must be unique.
-}
-
-type SyncCustomData struct {
-	FooValue int    `json:"fooValue,omitempty"`
-	BarValue bool   `json:"barValue,omitempty"`
-	BazValue string `json:"bazValue,omitempty"`
-}
-
 func syncPayload(devices map[string]config.DeviceConfig) []SyncDevices {
 	var syncDevices []SyncDevices
 	for id, device := range devices {
-		syncDevices = append(syncDevices, SyncDevices{
+		attributes := device.Attributes
+		syncDevice := SyncDevices{
 			ID:     id,
 			Type:   device.Type,
 			Traits: device.Traits,
 			Name: SyncName{
-				Name: device.Name,
+				DefaultNames: device.DefaultNames,
+				Name:         device.Name,
+				Nicknames:    device.Nicknames,
 			},
-			WillReportState: device.WillReportState,
-			Attributes:      &device.Attributes,
-		})
+			WillReportState:              device.WillReportState,
+			NotificationSupportedByAgent: len(device.Notifications) > 0,
+			RoomHint:                     device.RoomHint,
+			OtherDeviceIds:               device.OtherDeviceIds,
+			CustomData:                   device.CustomData,
+			Attributes:                   &attributes,
+		}
+		if device.DeviceInfo != (config.SyncDeviceInfo{}) {
+			deviceInfo := device.DeviceInfo
+			syncDevice.DeviceInfo = &deviceInfo
+		}
+		syncDevices = append(syncDevices, syncDevice)
 	}
+
+	sort.Slice(syncDevices, func(i, j int) bool {
+		return syncDevices[i].ID < syncDevices[j].ID
+	})
 	return syncDevices
 }
 
 func (f *Fullfillment) sync(request FullfillementRequest, userId string) SyncResponse {
 	requestId := request.RequestID
 	log.Info("handle sync", "request", requestId, "user", userId)
+
+	// the user is linked and the event is published without holding the mutex, both can be slow
+	f.mutex.RLock()
+	devices := []SyncDevices{}
+	ids := []string{}
+	for _, device := range f.syncPayload {
+		if f.allowed(userId, device.ID) {
+			devices = append(devices, device)
+			ids = append(ids, device.ID)
+		}
+	}
+	linkedUsers, publisher := f.linkedUsers, f.events
+	f.mutex.RUnlock()
+
+	if linkedUsers != nil {
+		linkedUsers.Link(userId)
+	}
+	emitEvent(publisher, Event{Intent: syncEvent, RequestId: requestId, User: userId, Devices: ids})
+
 	return SyncResponse{
 		RequestID: requestId,
 		Payload: SyncPayload{
 			AgentUserID: userId,
-			Devices:     f.syncPayload,
+			Devices:     devices,
 		},
 	}
 }
@@ -0,0 +1,134 @@
+package fullfillment
+
+import (
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncPerUser(t *testing.T) {
+	fullfillment := &Fullfillment{
+		syncPayload: []SyncDevices{
+			{ID: "plug"},
+			{ID: "lamp"},
+		},
+		users: initUsers(map[string]config.UserConfig{
+			"Alice": {Devices: []string{"lamp"}},
+		}),
+	}
+
+	tests := []struct {
+		name            string
+		user            string
+		expectedDevices []SyncDevices
+	}{
+		{
+			name:            "Restricted user only sees configured devices",
+			user:            "alice",
+			expectedDevices: []SyncDevices{{ID: "lamp"}},
+		},
+		{
+			name:            "Unconfigured user sees all devices",
+			user:            "bob",
+			expectedDevices: []SyncDevices{{ID: "plug"}, {ID: "lamp"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := fullfillment.sync(FullfillementRequest{RequestID: "test-request"}, test.user)
+
+			assert.Equal(t, test.user, result.Payload.AgentUserID)
+			assert.Equal(t, test.expectedDevices, result.Payload.Devices)
+		})
+	}
+}
+
+func TestExecuteNotAllowed(t *testing.T) {
+	messageHandlerMock := &MessageHandlerMock{messages: map[string]string{}}
+	fullfillment := &Fullfillment{
+		devices: map[string]Device{
+			"plug": {Topic: "topic/plug/set"},
+		},
+		handler: messageHandlerMock,
+		executionTemplates: map[string]string{
+			"action.devices.commands.OnOff": `{"state":"%s"}`,
+		},
+		users: initUsers(map[string]config.UserConfig{
+			"alice": {Devices: []string{"lamp"}},
+		}),
+	}
+
+	payload := PayloadRequest{
+		Commands: []CommandRequest{
+			{
+				Devices:   []DeviceRequest{{ID: "plug"}},
+				Execution: []ExecutionRequest{{Command: "action.devices.commands.OnOff", Params: ParamsRequest{On: true}}},
+			},
+		},
+	}
+
+	result := fullfillment.execute("alice", "test-request", payload)
+
+	assert.Equal(t, []ExecuteCommands{{Ids: []string{"plug"}, Status: Error, ErrorCode: "deviceNotFound"}}, result.Payload.Commands)
+	assert.Empty(t, messageHandlerMock.messages)
+}
+
+func TestSyncPayloadMetadata(t *testing.T) {
+	devices := map[string]config.DeviceConfig{
+		"lamp": {
+			Name:           "lamp",
+			Nicknames:      []string{"reading lamp"},
+			DefaultNames:   []string{"hue bulb"},
+			RoomHint:       "office",
+			Type:           "action.devices.types.LIGHT",
+			Traits:         []string{"action.devices.traits.OnOff"},
+			DeviceInfo:     config.SyncDeviceInfo{Manufacturer: "signify"},
+			OtherDeviceIds: []config.SyncOtherDeviceIds{{DeviceID: "local-lamp"}},
+			CustomData:     map[string]interface{}{"endpoint": 11},
+		},
+	}
+
+	result := syncPayload(devices)
+
+	assert.Equal(t, []SyncDevices{
+		{
+			ID:     "lamp",
+			Type:   "action.devices.types.LIGHT",
+			Traits: []string{"action.devices.traits.OnOff"},
+			Name: SyncName{
+				DefaultNames: []string{"hue bulb"},
+				Name:         "lamp",
+				Nicknames:    []string{"reading lamp"},
+			},
+			RoomHint:       "office",
+			DeviceInfo:     &config.SyncDeviceInfo{Manufacturer: "signify"},
+			OtherDeviceIds: []config.SyncOtherDeviceIds{{DeviceID: "local-lamp"}},
+			CustomData:     map[string]interface{}{"endpoint": 11},
+			Attributes:     &config.SyncAttributes{},
+		},
+	}, result)
+}
+
+func TestSyncDiscoveredDevices(t *testing.T) {
+	fullfillment, err := NewFullfillment(&MessageHandlerMock{messages: map[string]string{}}, map[string]config.DeviceConfig{
+		"plug": {Name: "plug"},
+	}, nil, nil)
+	assert.NoError(t, err)
+
+	fullfillment.AddDevice("plug", config.DeviceConfig{Name: "discovered plug"})
+	fullfillment.AddDevice("0x01", config.DeviceConfig{Name: "lamp", Topic: "zigbee2mqtt/lamp/set"})
+
+	result := fullfillment.sync(FullfillementRequest{RequestID: "test-request"}, "user")
+	assert.Equal(t, []string{"0x01", "plug"}, []string{result.Payload.Devices[0].ID, result.Payload.Devices[1].ID})
+	assert.Equal(t, "plug", result.Payload.Devices[1].Name.Name)
+	assert.Equal(t, "zigbee2mqtt/lamp/set", fullfillment.devices["0x01"].Topic)
+
+	fullfillment.RemoveDevice("0x01")
+	fullfillment.RemoveDevice("plug")
+
+	result = fullfillment.sync(FullfillementRequest{RequestID: "test-request"}, "user")
+	assert.Len(t, result.Payload.Devices, 1)
+	assert.Equal(t, "plug", result.Payload.Devices[0].ID)
+}
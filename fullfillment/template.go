@@ -0,0 +1,325 @@
+package fullfillment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+)
+
+// TemplateData is available in execution templates written with text/template, e.g.
+// `{"state":"{{ if .Params.on }}ON{{ else }}OFF{{ end }}","brightness":{{ scale .Params.brightness 0 100 0 254 | round }}}`
+type TemplateData struct {
+	Device     string                 // ID of the device
+	Command    string                 // Google command, e.g. action.devices.commands.OnOff
+	Value      interface{}            // Value of the command as used by positional templates, e.g. on or off
+	Params     map[string]interface{} // All params of the command as sent by Google
+	State      map[string]interface{} // Last state payload received from the device
+	On         bool                   // Current on state of the device
+	Config     config.DeviceConfig    // Configuration of the device
+	CustomData map[string]interface{} // customData of the device as sent back by Google
+}
+
+var templateFuncs = template.FuncMap{
+	"scale":         scale,
+	"round":         round,
+	"default":       defaultValue,
+	"json":          toJsonValue,
+	"jsonEscape":    jsonEscape,
+	"spectrumToRgb": spectrumToRgb,
+	"spectrumToHex": spectrumToHex,
+	"hexToSpectrum": hexToSpectrum,
+	"spectrumToHsv": spectrumToHsv,
+	"hsvToSpectrum": hsvToSpectrum,
+	"rgbToSpectrum": rgbToSpectrum,
+	"xyToSpectrum":  xyToSpectrum,
+	"kelvinToMired": kelvinToMired,
+	"miredToKelvin": miredToKelvin,
+}
+
+func isTemplate(messageTemplate string) bool {
+	return strings.Contains(messageTemplate, "{{")
+}
+
+func parseTemplate(name string, messageTemplate string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(messageTemplate)
+}
+
+func renderTemplate(name string, messageTemplate string, data interface{}) (string, error) {
+	tmpl, err := parseTemplate(name, messageTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template for `%s`: %v", name, err)
+	}
+
+	var message bytes.Buffer
+	err = tmpl.Execute(&message, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute template for `%s`: %v", name, err)
+	}
+	return message.String(), nil
+}
+
+// scale maps value linear from the range [inMin, inMax] to [outMin, outMax]
+func scale(value, inMin, inMax, outMin, outMax interface{}) (float64, error) {
+	numbers, err := toFloats(value, inMin, inMax, outMin, outMax)
+	if err != nil {
+		return 0, err
+	}
+	if numbers[2] == numbers[1] {
+		return 0, fmt.Errorf("scale input range is empty")
+	}
+	return numbers[3] + (numbers[0]-numbers[1])*(numbers[4]-numbers[3])/(numbers[2]-numbers[1]), nil
+}
+
+func round(value interface{}) (int64, error) {
+	number, err := toFloat(value)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(number)), nil
+}
+
+// defaultValue returns value, or fallback when value is empty, e.g. {{ .Params.brightness | default 100 }}
+func defaultValue(fallback interface{}, value interface{}) interface{} {
+	if value == nil {
+		return fallback
+	}
+	if str, ok := value.(string); ok && str == "" {
+		return fallback
+	}
+	return value
+}
+
+// toJsonValue encodes the value as json, strings are quoted and escaped
+func toJsonValue(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// jsonEscape escapes the string to be used within a quoted json string
+func jsonEscape(value interface{}) (string, error) {
+	data, err := json.Marshal(fmt.Sprintf("%v", value))
+	if err != nil {
+		return "", err
+	}
+	return string(data[1 : len(data)-1]), nil
+}
+
+// spectrumToRgb converts a Google spectrumRgb value into its red, green and blue components
+func spectrumToRgb(value interface{}) (map[string]int, error) {
+	spectrum, err := toFloat(value)
+	if err != nil {
+		return nil, err
+	}
+	rgb := int(spectrum)
+	return map[string]int{
+		"r": (rgb >> 16) & 0xff,
+		"g": (rgb >> 8) & 0xff,
+		"b": rgb & 0xff,
+	}, nil
+}
+
+// spectrumToHex converts a Google spectrumRgb value into a hex color, e.g. FF0000
+func spectrumToHex(value interface{}) (string, error) {
+	spectrum, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06X", int(spectrum)&0xffffff), nil
+}
+
+// hexToSpectrum converts a hex color, e.g. #FF0000 or FF0000, into a Google spectrumRgb value
+func hexToSpectrum(value interface{}) (int, error) {
+	hex := strings.TrimPrefix(fmt.Sprintf("%v", value), "#")
+	if len(hex) < 6 {
+		return 0, fmt.Errorf("invalid hex color `%s`", hex)
+	}
+	spectrum, err := strconv.ParseInt(hex[:6], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hex color `%s`: %v", hex, err)
+	}
+	return int(spectrum), nil
+}
+
+// spectrumToHsv converts a Google spectrumRgb value into hue (0-360), saturation (0-1) and value (0-1)
+func spectrumToHsv(value interface{}) (map[string]float64, error) {
+	rgb, err := spectrumToRgb(value)
+	if err != nil {
+		return nil, err
+	}
+	r, g, b := float64(rgb["r"])/255, float64(rgb["g"])/255, float64(rgb["b"])/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	hue := 0.0
+	switch {
+	case delta == 0:
+		hue = 0
+	case max == r:
+		hue = math.Mod((g-b)/delta, 6)
+	case max == g:
+		hue = (b-r)/delta + 2
+	default:
+		hue = (r-g)/delta + 4
+	}
+	hue *= 60
+	if hue < 0 {
+		hue += 360
+	}
+
+	saturation := 0.0
+	if max > 0 {
+		saturation = delta / max
+	}
+	return map[string]float64{"h": hue, "s": saturation, "v": max}, nil
+}
+
+// hsvToSpectrum converts hue (0-360), saturation (0-1) and value (0-1) into a Google spectrumRgb value
+func hsvToSpectrum(hue, saturation, value interface{}) (int, error) {
+	numbers, err := toFloats(hue, saturation, value)
+	if err != nil {
+		return 0, err
+	}
+	h, s, v := math.Mod(numbers[0], 360), numbers[1], numbers[2]
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	component := func(value float64) int {
+		return int(math.Round((value + m) * 255))
+	}
+	return component(r)<<16 | component(g)<<8 | component(b), nil
+}
+
+// rgbToSpectrum converts red, green and blue components (0-255) into a Google spectrumRgb value
+func rgbToSpectrum(red, green, blue interface{}) (int, error) {
+	numbers, err := toFloats(red, green, blue)
+	if err != nil {
+		return 0, err
+	}
+	component := func(value float64) int {
+		return int(math.Max(0, math.Min(255, math.Round(value))))
+	}
+	return component(numbers[0])<<16 | component(numbers[1])<<8 | component(numbers[2]), nil
+}
+
+// xyToSpectrum converts a CIE 1931 xy color, as used by zigbee, into a Google spectrumRgb value at full brightness
+func xyToSpectrum(x, y interface{}) (int, error) {
+	numbers, err := toFloats(x, y)
+	if err != nil {
+		return 0, err
+	}
+	if numbers[1] == 0 {
+		return 0, fmt.Errorf("invalid xy color, y is 0")
+	}
+
+	X := numbers[0] / numbers[1]
+	Z := (1 - numbers[0] - numbers[1]) / numbers[1]
+	rgb := []float64{
+		X*1.656492 - 0.354851 - Z*0.255038,
+		-X*0.707196 + 1.655397 + Z*0.036152,
+		X*0.051713 - 0.121364 + Z*1.011530,
+	}
+
+	max := math.Max(rgb[0], math.Max(rgb[1], rgb[2]))
+	for i, value := range rgb {
+		if max > 1 {
+			value /= max
+		}
+		if value <= 0.0031308 {
+			value = 12.92 * value
+		} else {
+			value = 1.055*math.Pow(value, 1/2.4) - 0.055
+		}
+		rgb[i] = math.Max(0, math.Min(1, value)) * 255
+	}
+	return rgbToSpectrum(rgb[0], rgb[1], rgb[2])
+}
+
+func kelvinToMired(value interface{}) (int64, error) {
+	kelvin, err := toFloat(value)
+	if err != nil {
+		return 0, err
+	}
+	if kelvin == 0 {
+		return 0, fmt.Errorf("can't convert 0 kelvin to mired")
+	}
+	return int64(math.Round(1000000 / kelvin)), nil
+}
+
+func miredToKelvin(value interface{}) (int64, error) {
+	mired, err := toFloat(value)
+	if err != nil {
+		return 0, err
+	}
+	if mired == 0 {
+		return 0, fmt.Errorf("can't convert 0 mired to kelvin")
+	}
+	return int64(math.Round(1000000 / mired)), nil
+}
+
+func toFloats(values ...interface{}) ([]float64, error) {
+	numbers := make([]float64, len(values))
+	for i, value := range values {
+		number, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		numbers[i] = number
+	}
+	return numbers, nil
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch number := value.(type) {
+	case float64:
+		return number, nil
+	case float32:
+		return float64(number), nil
+	case int:
+		return float64(number), nil
+	case int64:
+		return float64(number), nil
+	case int32:
+		return float64(number), nil
+	case uint8:
+		return float64(number), nil
+	case json.Number:
+		return number.Float64()
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(number), 64)
+	case bool:
+		if number {
+			return 1, nil
+		}
+		return 0, nil
+	case nil:
+		return 0, fmt.Errorf("expected a number, got no value")
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", value)
+	}
+}
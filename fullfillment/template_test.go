@@ -0,0 +1,121 @@
+package fullfillment
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFillMessageTemplate(t *testing.T) {
+	fullfillment := &Fullfillment{
+		devices: map[string]Device{
+			"lamp": {
+				Config: config.DeviceConfig{Name: "reading lamp"},
+				State: LocalState{
+					On:      true,
+					Payload: map[string]interface{}{"brightness": 254.0},
+				},
+			},
+		},
+		executionTemplates: map[string]string{
+			"action.devices.commands.OnOff":              `{"state":"{{ .Value | upper }}"}`,
+			"action.devices.commands.BrightnessAbsolute": `{"brightness":{{ scale .Params.brightness 0 100 0 254 | round }}}`,
+			"action.devices.commands.ColorAbsolute":      `{"color":{"hex":"#{{ spectrumToHex .Params.color.spectrumRGB }}"}{{ if .On }},"brightness":{{ .State.brightness }}{{ end }}}`,
+			"action.devices.commands.SetModes":           `{"name":{{ json .Config.Name }},"mode":"{{ jsonEscape .Params.updateModeSettings.mode }}"}`,
+			"action.devices.commands.ColorTemperature":   `{"color_temp":{{ kelvinToMired .Params.color.temperature }},"transition":{{ .CustomData.transition | default 1 }}}`,
+			"action.devices.commands.Broken":             `{"brightness":{{ scale .Params.missing 0 100 0 254 }}}`,
+		},
+	}
+
+	tests := []struct {
+		name           string
+		command        string
+		params         string
+		customData     map[string]interface{}
+		args           []interface{}
+		expectedResult string
+		expectedError  string
+	}{
+		{
+			name:          "Unknown function is a parse error",
+			command:       "action.devices.commands.OnOff",
+			params:        `{"on":true}`,
+			args:          []interface{}{"on"},
+			expectedError: "failed to parse template for `action.devices.commands.OnOff`: template: action.devices.commands.OnOff:1: function \"upper\" not defined",
+		},
+		{
+			name:           "Scale and round params",
+			command:        "action.devices.commands.BrightnessAbsolute",
+			params:         `{"brightness":50}`,
+			expectedResult: `{"brightness":127}`,
+		},
+		{
+			name:           "Color conversion with current state",
+			command:        "action.devices.commands.ColorAbsolute",
+			params:         `{"color":{"name":"red","spectrumRGB":16711680}}`,
+			expectedResult: `{"color":{"hex":"#FF0000"},"brightness":254}`,
+		},
+		{
+			name:           "Json escaping and device config",
+			command:        "action.devices.commands.SetModes",
+			params:         `{"updateModeSettings":{"mode":"say \"hi\""}}`,
+			expectedResult: `{"name":"reading lamp","mode":"say \"hi\""}`,
+		},
+		{
+			name:           "Custom data with default",
+			command:        "action.devices.commands.ColorTemperature",
+			params:         `{"color":{"temperature":4000}}`,
+			expectedResult: `{"color_temp":250,"transition":1}`,
+		},
+		{
+			name:           "Custom data from the request",
+			command:        "action.devices.commands.ColorTemperature",
+			params:         `{"color":{"temperature":2500}}`,
+			customData:     map[string]interface{}{"transition": 3},
+			expectedResult: `{"color_temp":400,"transition":3}`,
+		},
+		{
+			name:          "Missing param",
+			command:       "action.devices.commands.Broken",
+			params:        `{}`,
+			expectedError: "failed to execute template for `action.devices.commands.Broken`: template: action.devices.commands.Broken:1:17: executing \"action.devices.commands.Broken\" at <scale .Params.missing 0 100 0 254>: error calling scale: expected a number, got no value",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var params ParamsRequest
+			require.NoError(t, json.Unmarshal([]byte(test.params), &params))
+
+			result, err := fullfillment.fillMessage(DeviceRequest{ID: "lamp", CustomData: test.customData}, ExecutionRequest{Command: test.command, Params: params}, test.args...)
+
+			assert.Equal(t, test.expectedResult, result)
+			if test.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestTemplateColorConversion(t *testing.T) {
+	hsv, err := spectrumToHsv(0x00ff00)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"h": 120, "s": 1, "v": 1}, hsv)
+
+	spectrum, err := hsvToSpectrum(240, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 0x0000ff, spectrum)
+
+	spectrum, err = hexToSpectrum("#12AB34")
+	require.NoError(t, err)
+	assert.Equal(t, 0x12ab34, spectrum)
+
+	rgb, err := spectrumToRgb(0x12ab34)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"r": 0x12, "g": 0xab, "b": 0x34}, rgb)
+}
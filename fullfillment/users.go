@@ -0,0 +1,122 @@
+package fullfillment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"os"
+	"sort"
+	"sync"
+)
+
+// LinkedUsers keeps track of the users that linked their Google account, a SYNC links a user and a DISCONNECT unlinks it.
+// The users are stored in a json file so HomeGraph can be updated for them after a restart.
+type LinkedUsers struct {
+	mutex    sync.Mutex
+	filename string
+	users    map[string]bool
+	listener func(count int)
+}
+
+// NewLinkedUsers loads the linked users from the file, users are only kept in memory without a filename
+func NewLinkedUsers(filename string) (*LinkedUsers, error) {
+	linkedUsers := &LinkedUsers{
+		filename: filename,
+		users:    map[string]bool{},
+	}
+	if filename == "" {
+		return linkedUsers, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return linkedUsers, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read linked users %s: %v", filename, err)
+	}
+
+	var users []string
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse linked users %s: %v", filename, err)
+	}
+	for _, user := range users {
+		linkedUsers.users[user] = true
+	}
+	return linkedUsers, nil
+}
+
+func (l *LinkedUsers) Link(user string) {
+	l.update(func() bool {
+		if l.users[user] {
+			return false
+		}
+		l.users[user] = true
+		return true
+	})
+}
+
+func (l *LinkedUsers) Unlink(user string) {
+	l.update(func() bool {
+		if !l.users[user] {
+			return false
+		}
+		delete(l.users, user)
+		return true
+	})
+}
+
+// OnChange calls the listener with the number of linked users when a user is linked or unlinked
+func (l *LinkedUsers) OnChange(listener func(count int)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.listener = listener
+}
+
+// update stores the users when the change modified them and calls the listener without holding the lock
+func (l *LinkedUsers) update(change func() bool) {
+	l.mutex.Lock()
+	changed := change()
+	if changed {
+		l.save()
+	}
+	listener, count := l.listener, len(l.users)
+	l.mutex.Unlock()
+
+	if changed && listener != nil {
+		listener(count)
+	}
+}
+
+// Users returns the linked users sorted
+func (l *LinkedUsers) Users() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.sorted()
+}
+
+func (l *LinkedUsers) sorted() []string {
+	users := make([]string, 0, len(l.users))
+	for user := range l.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+func (l *LinkedUsers) save() {
+	if l.filename == "" {
+		return
+	}
+
+	data, err := json.Marshal(l.sorted())
+	if err != nil {
+		log.Error("failed to encode linked users", "error", err)
+		return
+	}
+	if err := os.WriteFile(l.filename, data, 0600); err != nil {
+		log.Error("failed to store linked users", "file", l.filename, "error", err)
+	}
+}
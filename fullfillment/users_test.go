@@ -0,0 +1,89 @@
+package fullfillment
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkedUsers(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".linkedusers")
+	linkedUsers, err := NewLinkedUsers(filename)
+	require.NoError(t, err)
+	var counts []int
+	linkedUsers.OnChange(func(count int) { counts = append(counts, count) })
+
+	fullfillment := &Fullfillment{linkedUsers: linkedUsers}
+	fullfillment.sync(FullfillementRequest{RequestID: "sync"}, "bob")
+	fullfillment.sync(FullfillementRequest{RequestID: "sync"}, "alice")
+	fullfillment.sync(FullfillementRequest{RequestID: "sync"}, "bob")
+	fullfillment.disconnect("bob", "disconnect", PayloadRequest{})
+
+	assert.Equal(t, []string{"alice"}, linkedUsers.Users())
+	assert.Equal(t, []int{1, 2, 1}, counts)
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.JSONEq(t, `["alice"]`, string(data))
+
+	reloaded, err := NewLinkedUsers(filename)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, reloaded.Users())
+}
+
+func TestReportState(t *testing.T) {
+	reporter := &stateReporterMock{}
+	linkedUsers := &LinkedUsers{users: map[string]bool{"alice": true, "bob": true}}
+	fullfillment := &Fullfillment{
+		devices: map[string]Device{
+			"lamp":  {Config: config.DeviceConfig{WillReportState: true}},
+			"plug":  {Config: config.DeviceConfig{WillReportState: true}},
+			"quiet": {Config: config.DeviceConfig{WillReportState: false}},
+		},
+		users: initUsers(map[string]config.UserConfig{
+			"alice": {Devices: []string{"lamp"}},
+		}),
+		linkedUsers: linkedUsers,
+		reporter:    reporter,
+	}
+
+	fullfillment.setState("lamp", map[string]interface{}{"state": "ON"})
+	fullfillment.setState("lamp", map[string]interface{}{"state": "ON", "linkquality": 100.0})
+	fullfillment.setState("plug", map[string]interface{}{"state": "OFF"})
+	fullfillment.setState("quiet", map[string]interface{}{"state": "ON"})
+
+	assert.Equal(t, []reportedState{
+		{user: "alice", device: "lamp", states: map[string]interface{}{"on": true, "online": true}},
+		{user: "bob", device: "lamp", states: map[string]interface{}{"on": true, "online": true}},
+		{user: "bob", device: "plug", states: map[string]interface{}{"on": false, "online": true}},
+	}, reporter.reported)
+}
+
+type reportedState struct {
+	user   string
+	device string
+	states map[string]interface{}
+}
+
+type reportedNotification struct {
+	user         string
+	device       string
+	eventId      string
+	notification map[string]interface{}
+}
+
+type stateReporterMock struct {
+	reported      []reportedState
+	notifications []reportedNotification
+}
+
+func (r *stateReporterMock) ReportState(agentUserId string, deviceId string, states map[string]interface{}) {
+	r.reported = append(r.reported, reportedState{user: agentUserId, device: deviceId, states: states})
+}
+
+func (r *stateReporterMock) ReportNotification(agentUserId string, deviceId string, eventId string, notification map[string]interface{}) {
+	r.notifications = append(r.notifications, reportedNotification{user: agentUserId, device: deviceId, eventId: eventId, notification: notification})
+}
@@ -0,0 +1,227 @@
+package homegraph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	"io"
+	log "log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// Homegraph reports state to the Google HomeGraph API, state changes are collected for the batch window and sent in one request per user
+type Homegraph struct {
+	client      *http.Client
+	url         string
+	tokens      *tokenSource
+	batchWindow time.Duration
+	retries     int
+	retryDelay  time.Duration
+
+	// flushMutex is held while the states are sent, so the states of a device can't overtake a flush that retries
+	flushMutex sync.Mutex
+	mutex      sync.Mutex
+	pending    map[string]map[string]map[string]interface{} // agentUserId to device to states
+	timer      *time.Timer
+}
+
+type reportStateRequest struct {
+	RequestId   string             `json:"requestId"`
+	EventId     string             `json:"eventId,omitempty"`
+	AgentUserId string             `json:"agentUserId"`
+	Payload     reportStatePayload `json:"payload"`
+}
+
+type reportStatePayload struct {
+	Devices reportStateDevices `json:"devices"`
+}
+
+type reportStateDevices struct {
+	States        map[string]map[string]interface{} `json:"states,omitempty"`
+	Notifications map[string]map[string]interface{} `json:"notifications,omitempty"`
+}
+
+type requestSyncRequest struct {
+	AgentUserId string `json:"agentUserId"`
+	Async       bool   `json:"async"`
+}
+
+// errorResponse is the error body of Google APIs
+type errorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+func NewHomegraph(cfg config.HomegraphConfig) (*Homegraph, error) {
+	client := &http.Client{Timeout: requestTimeout}
+	tokens, err := newTokenSource(client, cfg.KeyFile, cfg.TokenUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Homegraph{
+		client:      client,
+		url:         strings.TrimSuffix(cfg.Url, "/"),
+		tokens:      tokens,
+		batchWindow: cfg.BatchWindow,
+		retries:     cfg.Retries,
+		retryDelay:  cfg.RetryDelay,
+		pending:     map[string]map[string]map[string]interface{}{},
+	}, nil
+}
+
+// ReportState queues the states of the device for the user, states of the same device are merged until they are sent
+func (h *Homegraph) ReportState(agentUserId string, deviceId string, states map[string]interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	devices, ok := h.pending[agentUserId]
+	if !ok {
+		devices = map[string]map[string]interface{}{}
+		h.pending[agentUserId] = devices
+	}
+	merged, ok := devices[deviceId]
+	if !ok {
+		merged = map[string]interface{}{}
+		devices[deviceId] = merged
+	}
+	for key, value := range states {
+		merged[key] = value
+	}
+
+	if h.timer == nil {
+		h.timer = time.AfterFunc(h.batchWindow, h.Flush)
+	}
+}
+
+// Flush sends the queued states right away, after a flush that is still running
+func (h *Homegraph) Flush() {
+	h.flushMutex.Lock()
+	defer h.flushMutex.Unlock()
+
+	h.mutex.Lock()
+	pending := h.pending
+	h.pending = map[string]map[string]map[string]interface{}{}
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	h.mutex.Unlock()
+
+	for agentUserId, devices := range pending {
+		err := h.post("/v1/devices:reportStateAndNotification", reportStateRequest{
+			RequestId:   requestId(),
+			AgentUserId: agentUserId,
+			Payload: reportStatePayload{
+				Devices: reportStateDevices{States: devices},
+			},
+		})
+		if err != nil {
+			log.Error("failed to report state", "user", agentUserId, "devices", len(devices), "error", err)
+			continue
+		}
+		log.Debug("reported state", "user", agentUserId, "devices", len(devices))
+	}
+}
+
+// ReportNotification sends the notification of the device to the user right away, notifications aren't batched since each has its own event
+func (h *Homegraph) ReportNotification(agentUserId string, deviceId string, eventId string, notification map[string]interface{}) {
+	go func() {
+		err := h.post("/v1/devices:reportStateAndNotification", reportStateRequest{
+			RequestId:   requestId(),
+			EventId:     eventId,
+			AgentUserId: agentUserId,
+			Payload: reportStatePayload{
+				Devices: reportStateDevices{Notifications: map[string]map[string]interface{}{deviceId: notification}},
+			},
+		})
+		if err != nil {
+			log.Error("failed to report notification", "user", agentUserId, "device", deviceId, "event", eventId, "error", err)
+			return
+		}
+		log.Debug("reported notification", "user", agentUserId, "device", deviceId, "event", eventId)
+	}()
+}
+
+// RequestSync asks Google to send a SYNC intent for the user, e.g. after devices were added
+func (h *Homegraph) RequestSync(agentUserId string) error {
+	err := h.post("/v1/devices:requestSync", requestSyncRequest{
+		AgentUserId: agentUserId,
+		Async:       true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to request sync for %s: %v", agentUserId, err)
+	}
+	log.Info("requested sync", "user", agentUserId)
+	return nil
+}
+
+// post sends the request to HomeGraph, network errors, rate limits and server errors are retried
+func (h *Homegraph) post(path string, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %v", err)
+	}
+
+	delay := h.retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := h.send(path, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= h.retries {
+			return err
+		}
+
+		log.Debug("retry homegraph request", "path", path, "attempt", attempt+1, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// send reports whether a failed request can be retried
+func (h *Homegraph) send(path string, body []byte) (bool, error) {
+	token, err := h.tokens.accessToken()
+	if err != nil {
+		return true, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, h.url+path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	data, _ := io.ReadAll(response.Body)
+	var errorBody errorResponse
+	message := string(data)
+	if json.Unmarshal(data, &errorBody) == nil && errorBody.Error.Message != "" {
+		message = errorBody.Error.Message
+	}
+	retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError
+	return retry, fmt.Errorf("%s: %s", response.Status, message)
+}
+
+func requestId() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
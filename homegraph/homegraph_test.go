@@ -0,0 +1,261 @@
+package homegraph
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportStateBatches(t *testing.T) {
+	server := newFakeHomegraph(t)
+	homegraph := newTestHomegraph(t, server)
+
+	homegraph.ReportState("user", "lamp", map[string]interface{}{"on": true, "online": true})
+	homegraph.ReportState("user", "lamp", map[string]interface{}{"brightness": 40})
+	homegraph.ReportState("user", "plug", map[string]interface{}{"on": false})
+	homegraph.ReportState("other", "plug", map[string]interface{}{"on": false})
+	homegraph.Flush()
+
+	requests := server.requests("/v1/devices:reportStateAndNotification")
+	require.Len(t, requests, 2)
+	byUser := map[string]reportStateRequest{}
+	for _, request := range requests {
+		var report reportStateRequest
+		require.NoError(t, json.Unmarshal(request, &report))
+		assert.NotEmpty(t, report.RequestId)
+		byUser[report.AgentUserId] = report
+	}
+	assert.Equal(t, map[string]map[string]interface{}{
+		"lamp": {"on": true, "online": true, "brightness": 40.0},
+		"plug": {"on": false},
+	}, byUser["user"].Payload.Devices.States)
+	assert.Equal(t, map[string]map[string]interface{}{
+		"plug": {"on": false},
+	}, byUser["other"].Payload.Devices.States)
+
+	assert.Equal(t, 1, server.tokenRequests, "access token is reused")
+}
+
+func TestReportStateBatchWindow(t *testing.T) {
+	server := newFakeHomegraph(t)
+	homegraph := newTestHomegraph(t, server)
+	homegraph.batchWindow = 20 * time.Millisecond
+
+	homegraph.ReportState("user", "lamp", map[string]interface{}{"on": true})
+	homegraph.ReportState("user", "lamp", map[string]interface{}{"on": false})
+	assert.Empty(t, server.requests("/v1/devices:reportStateAndNotification"))
+
+	assert.Eventually(t, func() bool {
+		return len(server.requests("/v1/devices:reportStateAndNotification")) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestReportStateFlushInOrder(t *testing.T) {
+	server := newFakeHomegraph(t)
+	server.failures = []int{http.StatusServiceUnavailable}
+	homegraph := newTestHomegraph(t, server)
+	homegraph.retryDelay = 50 * time.Millisecond
+
+	homegraph.ReportState("user", "lamp", map[string]interface{}{"on": true})
+	go homegraph.Flush()
+	assert.Eventually(t, func() bool {
+		return len(server.requests("/v1/devices:reportStateAndNotification")) == 1
+	}, time.Second, time.Millisecond)
+	homegraph.ReportState("user", "lamp", map[string]interface{}{"on": false})
+	homegraph.Flush()
+
+	var states []interface{}
+	for _, body := range server.requests("/v1/devices:reportStateAndNotification") {
+		var report reportStateRequest
+		require.NoError(t, json.Unmarshal(body, &report))
+		states = append(states, report.Payload.Devices.States["lamp"]["on"])
+	}
+	assert.Equal(t, []interface{}{true, true, false}, states, "the second flush waits for the retry of the first")
+}
+
+func TestReportStateRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         []int
+		expectedRequests int
+	}{
+		{name: "Retry server errors", failures: []int{http.StatusInternalServerError, http.StatusTooManyRequests}, expectedRequests: 3},
+		{name: "Give up after retries", failures: []int{503, 503, 503, 503, 503}, expectedRequests: 4},
+		{name: "Don't retry client errors", failures: []int{http.StatusNotFound}, expectedRequests: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeHomegraph(t)
+			server.failures = test.failures
+			homegraph := newTestHomegraph(t, server)
+
+			homegraph.ReportState("user", "lamp", map[string]interface{}{"on": true})
+			homegraph.Flush()
+
+			assert.Len(t, server.requests("/v1/devices:reportStateAndNotification"), test.expectedRequests)
+		})
+	}
+}
+
+func TestReportNotification(t *testing.T) {
+	server := newFakeHomegraph(t)
+	homegraph := newTestHomegraph(t, server)
+
+	homegraph.ReportNotification("user", "doorbell", "doorbell-1", map[string]interface{}{
+		"ObjectDetection": map[string]interface{}{"priority": 0, "objects": map[string]interface{}{"unclassified": 1}},
+	})
+
+	assert.Eventually(t, func() bool {
+		return len(server.requests("/v1/devices:reportStateAndNotification")) == 1
+	}, time.Second, 5*time.Millisecond)
+	var report map[string]interface{}
+	require.NoError(t, json.Unmarshal(server.requests("/v1/devices:reportStateAndNotification")[0], &report))
+	assert.Equal(t, "doorbell-1", report["eventId"])
+	assert.Equal(t, "user", report["agentUserId"])
+	assert.Equal(t, map[string]interface{}{"devices": map[string]interface{}{"notifications": map[string]interface{}{
+		"doorbell": map[string]interface{}{"ObjectDetection": map[string]interface{}{"priority": 0.0, "objects": map[string]interface{}{"unclassified": 1.0}}},
+	}}}, report["payload"])
+}
+
+func TestRequestSync(t *testing.T) {
+	server := newFakeHomegraph(t)
+	homegraph := newTestHomegraph(t, server)
+
+	require.NoError(t, homegraph.RequestSync("alice"))
+
+	requests := server.requests("/v1/devices:requestSync")
+	require.Len(t, requests, 1)
+	assert.JSONEq(t, `{"agentUserId":"alice","async":true}`, string(requests[0]))
+
+	server.failures = []int{http.StatusNotFound}
+	assert.EqualError(t, homegraph.RequestSync("unknown"), "failed to request sync for unknown: 404 Not Found: failure")
+}
+
+func TestServiceAccountAssertion(t *testing.T) {
+	server := newFakeHomegraph(t)
+	homegraph := newTestHomegraph(t, server)
+
+	_, err := homegraph.tokens.accessToken()
+	require.NoError(t, err)
+
+	token, err := jwt.Parse(server.assertion, func(token *jwt.Token) (interface{}, error) {
+		return &server.key.PublicKey, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "RS256", token.Header["alg"])
+	assert.Equal(t, "key-id", token.Header["kid"])
+	claims := token.Claims.(jwt.MapClaims)
+	assert.Equal(t, "bridge@project.iam.gserviceaccount.com", claims["iss"])
+	assert.Equal(t, "https://www.googleapis.com/auth/homegraph", claims["scope"])
+	assert.Equal(t, server.URL+"/token", claims["aud"])
+}
+
+func TestInvalidKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	require.NoError(t, os.WriteFile(keyFile, []byte(`{"client_email":"bridge@project.iam.gserviceaccount.com"}`), 0600))
+
+	_, err := NewHomegraph(config.HomegraphConfig{KeyFile: keyFile})
+
+	assert.EqualError(t, err, "service account key "+keyFile+" has no client_email or private_key")
+}
+
+// fakeHomegraph is a local HomeGraph API and token endpoint that records the requests
+type fakeHomegraph struct {
+	*httptest.Server
+	key           *rsa.PrivateKey
+	mutex         sync.Mutex
+	bodies        map[string][][]byte
+	failures      []int
+	tokenRequests int
+	assertion     string
+}
+
+func newFakeHomegraph(t *testing.T) *fakeHomegraph {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	fake := &fakeHomegraph{key: key, bodies: map[string][][]byte{}}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeHomegraph) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.URL.Path == "/token" {
+		f.tokenRequests++
+		f.assertion = r.FormValue("assertion")
+		if r.FormValue("grant_type") != jwtBearerGrant {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(tokenResponse{AccessToken: "access-token", ExpiresIn: 3600, TokenType: "Bearer"})
+		return
+	}
+
+	var body json.RawMessage
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	f.bodies[r.URL.Path] = append(f.bodies[r.URL.Path], body)
+
+	if r.Header.Get("Authorization") != "Bearer access-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if len(f.failures) > 0 {
+		status := f.failures[0]
+		f.failures = f.failures[1:]
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"error":{"code":500,"message":"failure","status":"INTERNAL"}}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{}`))
+}
+
+func (f *fakeHomegraph) requests(path string) [][]byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.bodies[path]
+}
+
+func newTestHomegraph(t *testing.T, server *fakeHomegraph) *Homegraph {
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(server.key)})
+	key, err := json.Marshal(serviceAccountKey{
+		Type:         "service_account",
+		ProjectId:    "project",
+		PrivateKeyId: "key-id",
+		PrivateKey:   string(privateKey),
+		ClientEmail:  "bridge@project.iam.gserviceaccount.com",
+		TokenUri:     server.URL + "/token",
+	})
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	require.NoError(t, os.WriteFile(keyFile, key, 0600))
+
+	homegraph, err := NewHomegraph(config.HomegraphConfig{
+		KeyFile:     keyFile,
+		Url:         server.URL,
+		BatchWindow: time.Hour,
+		Retries:     3,
+		RetryDelay:  time.Millisecond,
+	})
+	require.NoError(t, err)
+	return homegraph
+}
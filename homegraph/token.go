@@ -0,0 +1,145 @@
+package homegraph
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	homegraphScope  = "https://www.googleapis.com/auth/homegraph"
+	defaultTokenUrl = "https://oauth2.googleapis.com/token"
+	jwtBearerGrant  = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	tokenLifetime   = time.Hour
+	// tokenMargin renews the access token before it expires
+	tokenMargin = time.Minute
+)
+
+// serviceAccountKey is the json key file of a Google service account
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ProjectId    string `json:"project_id"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenUri     string `json:"token_uri"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// tokenSource exchanges a signed service account JWT for an access token and caches it until it expires
+type tokenSource struct {
+	client     *http.Client
+	tokenUrl   string
+	email      string
+	keyId      string
+	privateKey *rsa.PrivateKey
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newTokenSource(client *http.Client, keyFile string, tokenUrl string) (*tokenSource, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account key %s: %v", keyFile, err)
+	}
+
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("failed to parse service account key %s: %v", keyFile, err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("service account key %s has no client_email or private_key", keyFile)
+	}
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(key.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key of %s: %v", keyFile, err)
+	}
+
+	if tokenUrl == "" {
+		tokenUrl = key.TokenUri
+	}
+	if tokenUrl == "" {
+		tokenUrl = defaultTokenUrl
+	}
+
+	return &tokenSource{
+		client:     client,
+		tokenUrl:   tokenUrl,
+		email:      key.ClientEmail,
+		keyId:      key.PrivateKeyId,
+		privateKey: privateKey,
+	}, nil
+}
+
+// accessToken returns the cached access token or requests a new one
+func (s *tokenSource) accessToken() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if s.token != "" && now.Before(s.expires.Add(-tokenMargin)) {
+		return s.token, nil
+	}
+
+	assertion, err := s.assertion(now)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := s.client.PostForm(s.tokenUrl, url.Values{
+		"grant_type": {jwtBearerGrant},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to request access token: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request access token: %s", response.Status)
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to parse access token: %v", err)
+	}
+
+	s.token = token.AccessToken
+	s.expires = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// assertion signs the JWT that is exchanged for an access token
+func (s *tokenSource) assertion(now time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   s.email,
+		"scope": homegraphScope,
+		"aud":   s.tokenUrl,
+		"iat":   now.Unix(),
+		"exp":   now.Add(tokenLifetime).Unix(),
+	})
+	if s.keyId != "" {
+		token.Header["kid"] = s.keyId
+	}
+
+	signed, err := token.SignedString(s.privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign service account token: %v", err)
+	}
+	return signed, nil
+}
@@ -1,22 +1,46 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	auth2 "github.com/mrlauy/ghome-mqtt/auth"
+	"github.com/mrlauy/ghome-mqtt/broker"
 	"github.com/mrlauy/ghome-mqtt/config"
 	"github.com/mrlauy/ghome-mqtt/fullfillment"
+	"github.com/mrlauy/ghome-mqtt/homegraph"
 	"github.com/mrlauy/ghome-mqtt/mqtt"
 	"html/template"
 	log "log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const requestFullDump = false
 
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// shutdownTimeout is how long running requests get to finish on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// version of the bridge, set with `-ldflags "-X main.version=1.2.3"`
+var version = ""
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate())
+	}
+
 	cfg, err := config.ReadConfig()
 	if err != nil {
 		log.Error("failed to read config: ", err)
@@ -26,17 +50,94 @@ func main() {
 	config.InitLogging(cfg.Log.Level)
 
 	auth := auth2.NewAuth(cfg.Auth)
-	messageHandler, err := mqtt.NewMqtt(cfg.Mqtt)
+	mqttConfig := cfg.Mqtt
+	if cfg.Broker.Enabled {
+		embeddedBroker, err := broker.NewBroker(cfg.Broker)
+		if err != nil {
+			log.Error("failed to start the embedded mqtt broker", "error", err)
+			return
+		}
+		defer embeddedBroker.Close()
+		mqttConfig = embeddedBroker.Connect(cfg.Mqtt)
+	}
+	messageHandler, err := mqtt.NewMqtt(mqttConfig)
 	if err != nil {
 		log.Error("failed to start mqtt: ", err)
 		return
 	}
 
-	fullfillmentManager, err := fullfillment.NewFullfillment(messageHandler, cfg.Devices, cfg.ExecutionTemplates)
+	fullfillmentManager, err := fullfillment.NewFullfillment(messageHandler, cfg.Devices, cfg.ExecutionTemplates, cfg.Users)
 	if err != nil {
 		log.Error("failed to start fullfillment handler: ", err)
 		return
 	}
+	messageHandler.OnConnectionChange(fullfillmentManager.SetConnected)
+	if cfg.Mqtt.Events {
+		fullfillmentManager.SetEventPublisher(messageHandler)
+	}
+
+	linkedUsers, err := fullfillment.NewLinkedUsers(cfg.Auth.LinkedUsers)
+	if err != nil {
+		log.Error("failed to load linked users", "error", err)
+		return
+	}
+	fullfillmentManager.SetLinkedUsers(linkedUsers)
+	publishBridgeInfo := func(count int) {
+		messageHandler.PublishBridgeInfo(mqtt.BridgeInfo{Version: bridgeVersion(), LinkedUsers: count})
+	}
+	linkedUsers.OnChange(publishBridgeInfo)
+	publishBridgeInfo(len(linkedUsers.Users()))
+
+	if cfg.Homegraph.KeyFile != "" {
+		homegraphClient, err := homegraph.NewHomegraph(cfg.Homegraph)
+		if err != nil {
+			log.Error("failed to start homegraph client", "error", err)
+			return
+		}
+		fullfillmentManager.SetStateReporter(homegraphClient)
+		fullfillmentManager.SetSyncRequester(homegraphClient, cfg.Homegraph.SyncHash, cfg.Homegraph.BatchWindow)
+	}
+
+	if cfg.Discovery.Zigbee2mqtt.Enabled {
+		err = messageHandler.DiscoverZigbee2mqtt(cfg.Discovery.Zigbee2mqtt, cfg.Profiles, fullfillmentManager)
+		if err != nil {
+			log.Error("failed to start zigbee2mqtt discovery", "error", err)
+			return
+		}
+	}
+	if cfg.Discovery.Homeassistant.Enabled {
+		err = messageHandler.DiscoverHomeassistant(cfg.Discovery.Homeassistant, fullfillmentManager)
+		if err != nil {
+			log.Error("failed to start home assistant discovery", "error", err)
+			return
+		}
+	}
+	if cfg.Discovery.Tasmota.Enabled {
+		err = messageHandler.DiscoverTasmota(cfg.Discovery.Tasmota, cfg.Profiles, fullfillmentManager)
+		if err != nil {
+			log.Error("failed to start tasmota discovery", "error", err)
+			return
+		}
+	}
+
+	// applied is the last applied config, a section that changed is only reported once
+	applied := cfg
+	watcher := config.Watch(cfg, configPollInterval, func(newCfg *config.Config) {
+		for _, section := range config.RestartRequired(applied, newCfg) {
+			log.Warn("config change requires a restart", "section", section)
+		}
+		config.InitLogging(newCfg.Log.Level)
+		fullfillmentManager.Reload(newCfg.Devices, newCfg.ExecutionTemplates, newCfg.Users)
+		applied = newCfg
+	})
+
+	if cfg.Mqtt.Control {
+		err = messageHandler.HandleRequests(controlHandlers(fullfillmentManager, messageHandler, watcher, cfg.Homegraph.KeyFile != ""))
+		if err != nil {
+			log.Error("failed to start the control api", "error", err)
+			return
+		}
+	}
 
 	loginPage := template.Must(template.ParseFiles("templates/login.html"))
 	authPage := template.Must(template.ParseFiles("templates/auth.html"))
@@ -56,9 +157,86 @@ func main() {
 	http.Handle("/", router)
 
 	port := cfg.Server.Port
-	log.Info("started server", "port", port)
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-	log.Error("failure during execution", err)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+	go shutdownOnSignal(server)
+
+	log.Info("started server", "port", port, "version", bridgeVersion())
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Error("failure during execution", err)
+	}
+	messageHandler.Close()
+}
+
+// controlHandlers are the requests of the MQTT control api
+func controlHandlers(fullfillmentManager *fullfillment.Fullfillment, messageHandler *mqtt.Mqtt, watcher *config.Watcher, homegraph bool) map[string]mqtt.RequestHandler {
+	return map[string]mqtt.RequestHandler{
+		"request_sync": func(payload json.RawMessage) (interface{}, error) {
+			if !homegraph {
+				return nil, fmt.Errorf("homegraph isn't configured")
+			}
+			fullfillmentManager.RequestSync()
+			return nil, nil
+		},
+		"config/reload": func(payload json.RawMessage) (interface{}, error) {
+			return nil, watcher.Reload()
+		},
+		"devices": func(payload json.RawMessage) (interface{}, error) {
+			return fullfillmentManager.Devices(), nil
+		},
+		"queue": func(payload json.RawMessage) (interface{}, error) {
+			return map[string]int{"depth": messageHandler.QueueDepth()}, nil
+		},
+		"execute": func(payload json.RawMessage) (interface{}, error) {
+			var request struct {
+				Device  string                 `json:"device"`
+				Command string                 `json:"command"`
+				Params  map[string]interface{} `json:"params"`
+			}
+			if err := json.Unmarshal(payload, &request); err != nil {
+				return nil, fmt.Errorf("invalid execute request: %v", err)
+			}
+			return fullfillmentManager.Execute(request.Device, request.Command, request.Params)
+		},
+	}
+}
+
+// shutdownOnSignal stops the server on SIGINT or SIGTERM and lets running requests finish
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	log.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("failed to shut down server", "error", err)
+	}
+}
+
+// bridgeVersion returns the version set at build time, or the version of the module
+func bridgeVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// validate checks the config file and prints the problems, it returns the exit code
+func validate() int {
+	config.InitLogging("error")
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("%s is valid, %d devices\n", config.Filename(), len(cfg.Devices))
+	return 0
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -66,13 +244,15 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		if requestFullDump {
 			headers := r.Header
 
-			// only print the following headers
+			// only print the following headers, without the secrets
 			r.Header = map[string][]string{}
-			r.Header.Add("Cookie", headers.Get("Cookie"))
+			r.Header.Add("Cookie", config.Redact(headers.Get("Cookie")))
 			r.Header.Add("Referer", headers.Get("Referer"))
-			r.Header.Add("Authorization", headers.Get("Authorization"))
+			r.Header.Add("Authorization", config.Redact(headers.Get("Authorization")))
 
-			data, err := httputil.DumpRequest(r, true)
+			// oauth requests and responses contain codes and tokens
+			dumpBody := !strings.HasPrefix(r.URL.Path, "/oauth/")
+			data, err := httputil.DumpRequest(r, dumpBody)
 			if err != nil {
 				log.Error("error dumping request", err)
 				return
@@ -84,7 +264,7 @@ func loggingMiddleware(next http.Handler) http.Handler {
 			recorder := httptest.NewRecorder()
 			next.ServeHTTP(recorder, r)
 
-			dump, err := httputil.DumpResponse(recorder.Result(), true)
+			dump, err := httputil.DumpResponse(recorder.Result(), dumpBody)
 			if err != nil {
 				log.Error("error dumping response", err)
 				return
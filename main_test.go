@@ -4,19 +4,38 @@
 package main
 
 import (
+	"github.com/mrlauy/ghome-mqtt/broker"
 	"github.com/mrlauy/ghome-mqtt/config"
 	mqtt2 "github.com/mrlauy/ghome-mqtt/mqtt"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestSendMessageLive(t *testing.T) {
-	mqtt, err := mqtt2.NewMqtt(config.MqttConfig{
-		Host: "10.0.0.21",
-		Port: 1883,
-	})
+	embeddedBroker, err := broker.NewBroker(config.BrokerConfig{Host: "127.0.0.1"})
+	require.NoError(t, err)
+	defer embeddedBroker.Close()
+
+	device, err := mqtt2.NewMqtt(embeddedBroker.Connect(config.MqttConfig{ClientId: "speaker"}))
+	require.NoError(t, err)
+	defer device.Close()
+	commands := make(chan map[string]interface{}, 1)
+	require.NoError(t, device.RegisterStateChangeListener("speaker", "device/speaker/set", 0, func(device string, payload map[string]interface{}) {
+		commands <- payload
+	}))
 
+	mqtt, err := mqtt2.NewMqtt(embeddedBroker.Connect(config.MqttConfig{ClientId: "bridge"}))
 	require.NoError(t, err)
+	defer mqtt.Close()
 	mqtt.SendMessage("device/speaker/set", `{"state":"on"}`)
+
+	select {
+	case command := <-commands:
+		assert.Equal(t, map[string]interface{}{"state": "on"}, command)
+	case <-time.After(time.Second):
+		t.Fatal("message isn't received")
+	}
 }
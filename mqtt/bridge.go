@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"encoding/json"
+	log "log/slog"
+)
+
+const (
+	online  = "online"
+	offline = "offline"
+
+	defaultBaseTopic = "ghome-mqtt"
+)
+
+// BridgeInfo is published retained on `<baseTopic>/bridge/info`
+type BridgeInfo struct {
+	Version     string `json:"version"`
+	LinkedUsers int    `json:"linkedUsers"`
+}
+
+func baseTopic(topic string) string {
+	if topic != "" {
+		return topic
+	}
+	return defaultBaseTopic
+}
+
+// statusTopic returns the configured status topic, or `<baseTopic>/status`
+func statusTopic(baseTopic string, topic string) string {
+	if topic != "" {
+		return topic
+	}
+	return baseTopic + "/status"
+}
+
+// eventTopic returns the configured event topic, or `<baseTopic>/events`
+func eventTopic(baseTopic string, topic string) string {
+	if topic != "" {
+		return topic
+	}
+	return baseTopic + "/events"
+}
+
+// responseTopic is where the responses to the MQTT 5 requests of the client arrive, `<baseTopic>/response/<clientId>`
+func responseTopic(baseTopic string, clientId string) string {
+	return baseTopic + "/response/" + clientId
+}
+
+// PublishEvent publishes the event as json on `<eventTopic>/<intent>/<device>`, or `<eventTopic>/<intent>` without device
+func (m *Mqtt) PublishEvent(intent string, device string, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error("failed to encode event", "intent", intent, "device", device, "error", err)
+		return
+	}
+	topic := m.eventTopic + "/" + intent
+	if device != "" {
+		topic += "/" + device
+	}
+	m.Publish(topic, string(data), 0, false)
+}
+
+// PublishBridgeInfo publishes the info of the bridge, it's published again after a reconnect
+func (m *Mqtt) PublishBridgeInfo(info BridgeInfo) {
+	m.mutex.Lock()
+	m.info = &info
+	m.mutex.Unlock()
+
+	m.publishBridgeInfo(info)
+}
+
+func (m *Mqtt) publishBridgeInfo(info BridgeInfo) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		log.Error("failed to encode bridge info", "error", err)
+		return
+	}
+	m.Publish(m.baseTopic+"/bridge/info", string(data), 1, true)
+}
+
+// Close publishes the bridge is offline and disconnects from the broker, queued messages are dropped
+func (m *Mqtt) Close() {
+	if m.queue != nil {
+		m.queue.close()
+	}
+	if m.client.IsConnected() {
+		if err := m.send(m.statusTopic, offline, 1, true); err != nil {
+			log.Warn("failed to publish the bridge is offline", "error", err)
+		}
+	}
+	m.client.Disconnect(250)
+	log.Info("mqtt client disconnected", "dropped", m.QueueDepth())
+}
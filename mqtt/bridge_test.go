@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridgeStatus(t *testing.T) {
+	client := &mqttClientMock{}
+	m := Mqtt{client: client, baseTopic: "ghome-mqtt", statusTopic: "ghome-mqtt/status"}
+
+	m.onConnect(client)
+	m.PublishBridgeInfo(BridgeInfo{Version: "1.2.3", LinkedUsers: 2})
+	m.onConnect(client)
+	m.Close()
+
+	info := publishedMessage{topic: "ghome-mqtt/bridge/info", payload: `{"version":"1.2.3","linkedUsers":2}`, qos: 1, retain: true}
+	assert.Equal(t, []publishedMessage{
+		{topic: "ghome-mqtt/status", payload: "online", qos: 1, retain: true},
+		info,
+		{topic: "ghome-mqtt/status", payload: "online", qos: 1, retain: true},
+		info,
+		{topic: "ghome-mqtt/status", payload: "offline", qos: 1, retain: true},
+	}, client.published)
+}
+
+func TestPublishEvent(t *testing.T) {
+	client := &mqttClientMock{}
+	m := Mqtt{client: client, eventTopic: "ghome-mqtt/events"}
+
+	m.PublishEvent("execute", "kitchen", map[string]interface{}{"command": "action.devices.commands.OnOff"})
+	m.PublishEvent("sync", "", map[string]interface{}{"user": "alice"})
+
+	assert.Equal(t, []publishedMessage{
+		{topic: "ghome-mqtt/events/execute/kitchen", payload: `{"command":"action.devices.commands.OnOff"}`},
+		{topic: "ghome-mqtt/events/sync", payload: `{"user":"alice"}`},
+	}, client.published)
+}
+
+func TestStatusTopic(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.MqttConfig
+		expected string
+	}{
+		{"default", config.MqttConfig{}, "ghome-mqtt/status"},
+		{"base topic", config.MqttConfig{BaseTopic: "bridges/living"}, "bridges/living/status"},
+		{"status topic", config.MqttConfig{BaseTopic: "bridges/living", StatusTopic: "status/ghome"}, "status/ghome"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, statusTopic(baseTopic(test.cfg.BaseTopic), test.cfg.StatusTopic))
+		})
+	}
+}
+
+func TestLastWill(t *testing.T) {
+	socket := listenUnix(t)
+
+	m, err := NewMqtt(config.MqttConfig{Brokers: []string{"unix://" + socket}, BaseTopic: "bridge"})
+	require.NoError(t, err)
+	defer m.client.Disconnect(0)
+
+	options := m.client.OptionsReader()
+	assert.True(t, options.WillEnabled())
+	assert.Equal(t, "bridge/status", options.WillTopic())
+	assert.Equal(t, []byte("offline"), options.WillPayload())
+	assert.True(t, options.WillRetained())
+}
@@ -0,0 +1,27 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	"net/url"
+	"slices"
+)
+
+// secureSchemes are the broker url schemes that connect over TLS
+var secureSchemes = []string{"ssl", "tls", "mqtts", "wss"}
+
+// brokerUrls returns the configured broker urls, or the url of the host and port without them
+func brokerUrls(cfg config.MqttConfig) []string {
+	if len(cfg.Brokers) > 0 {
+		return cfg.Brokers
+	}
+	if cfg.Tls {
+		return []string{fmt.Sprintf("ssl://%s:%d", cfg.Host, cfg.Port)}
+	}
+	return []string{fmt.Sprintf("tcp://%s:%d", cfg.Host, cfg.Port)}
+}
+
+func isSecure(broker string) bool {
+	u, err := url.Parse(broker)
+	return err == nil && slices.Contains(secureSchemes, u.Scheme)
+}
@@ -0,0 +1,119 @@
+package mqtt
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerUrls(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.MqttConfig
+		expected []string
+	}{
+		{"host and port", config.MqttConfig{Host: "localhost", Port: 1883}, []string{"tcp://localhost:1883"}},
+		{"tls", config.MqttConfig{Host: "localhost", Port: 8883, Tls: true}, []string{"ssl://localhost:8883"}},
+		{"brokers", config.MqttConfig{Host: "localhost", Port: 1883, Brokers: []string{"wss://one/mqtt", "ws://two/mqtt"}}, []string{"wss://one/mqtt", "ws://two/mqtt"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, brokerUrls(test.cfg))
+		})
+	}
+}
+
+func TestNewMqttUnixFailover(t *testing.T) {
+	socket := listenUnix(t)
+
+	m, err := NewMqtt(config.MqttConfig{Brokers: []string{"unix://" + filepath.Join(t.TempDir(), "down.sock"), "unix://" + socket}})
+
+	require.NoError(t, err)
+	assert.True(t, m.client.IsConnected())
+	m.client.Disconnect(0)
+}
+
+func TestNewMqttWebsocket(t *testing.T) {
+	tests := []struct {
+		name string
+		tls  bool
+	}{
+		{"ws", false},
+		{"wss", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := make(chan http.Header, 1)
+			handler := websocketBroker(headers)
+			server := httptest.NewUnstartedServer(handler)
+			cfg := config.MqttConfig{Headers: map[string]string{"Authorization": "Bearer token"}}
+			if test.tls {
+				server.StartTLS()
+				cfg.CaFile = writePem(t, t.TempDir(), "ca.pem", server.Certificate())
+			} else {
+				server.Start()
+			}
+			t.Cleanup(server.Close)
+			cfg.Brokers = []string{strings.Replace(server.URL, "http", "ws", 1) + "/mqtt"}
+
+			m, err := NewMqtt(cfg)
+
+			require.NoError(t, err)
+			assert.True(t, m.client.IsConnected())
+			assert.Equal(t, "Bearer token", (<-headers).Get("Authorization"))
+			m.client.Disconnect(0)
+		})
+	}
+}
+
+// listenUnix starts a unix socket listener that accepts the MQTT connect of the client
+func listenUnix(t *testing.T) string {
+	socket := filepath.Join(t.TempDir(), "mqtt.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go acceptConnect(conn)
+		}
+	}()
+	return socket
+}
+
+// websocketBroker accepts the MQTT connect of the client over a WebSocket and sends the headers of the upgrade
+func websocketBroker(headers chan http.Header) http.Handler {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0x20, 0x02, 0x00, 0x00}); err != nil {
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "log/slog"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// RequestHandler handles a request of the control api, the result is the data of the response
+type RequestHandler func(payload json.RawMessage) (interface{}, error)
+
+// controlResponse is published on the response topic, the transaction of the request correlates the response
+type controlResponse struct {
+	Status      string      `json:"status"`
+	Data        interface{} `json:"data,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Transaction interface{} `json:"transaction,omitempty"`
+}
+
+// HandleRequests handles the requests on `<baseTopic>/bridge/request/<name>` with the handler of the name,
+// the response is published on `<baseTopic>/bridge/response/<name>`.
+// Requests run on their own goroutine, a request that publishes doesn't block the messages of the client.
+func (m *Mqtt) HandleRequests(handlers map[string]RequestHandler) error {
+	prefix := m.baseTopic + "/bridge/request/"
+	topic := prefix + "#"
+	log.Info("handle control requests", "topic", topic)
+
+	return m.subscribe(topic, func(client mqtt.Client, msg mqtt.Message) {
+		name := strings.TrimPrefix(msg.Topic(), prefix)
+		go m.respond(handlers, name, msg.Payload())
+	})
+}
+
+// respond handles the request and publishes its response
+func (m *Mqtt) respond(handlers map[string]RequestHandler, name string, payload []byte) {
+	response := handleRequest(handlers, name, payload)
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Error("failed to encode response", "request", name, "error", err)
+		response = controlResponse{Status: "error", Error: err.Error(), Transaction: response.Transaction}
+		data, _ = json.Marshal(response)
+	}
+	m.Publish(m.baseTopic+"/bridge/response/"+name, string(data), 0, false)
+}
+
+func handleRequest(handlers map[string]RequestHandler, name string, payload []byte) controlResponse {
+	if len(bytes.TrimSpace(payload)) == 0 {
+		payload = []byte("{}")
+	}
+	var request struct {
+		Transaction interface{} `json:"transaction"`
+	}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return controlResponse{Status: "error", Error: fmt.Sprintf("invalid request: %v", err)}
+	}
+
+	handler, ok := handlers[name]
+	if !ok {
+		return controlResponse{Status: "error", Error: fmt.Sprintf("unknown request `%s`", name), Transaction: request.Transaction}
+	}
+
+	log.Info("handle control request", "request", name, "transaction", request.Transaction)
+	data, err := handler(payload)
+	if err != nil {
+		return controlResponse{Status: "error", Error: err.Error(), Transaction: request.Transaction}
+	}
+	return controlResponse{Status: "ok", Data: data, Transaction: request.Transaction}
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRequests(t *testing.T) {
+	client := &mqttClientMock{subscriptions: map[string]mqtt.MessageHandler{}}
+	m := Mqtt{client: client, baseTopic: "ghome-mqtt"}
+
+	require.NoError(t, m.HandleRequests(map[string]RequestHandler{
+		"devices": func(payload json.RawMessage) (interface{}, error) {
+			return []string{"lamp"}, nil
+		},
+		"config/reload": func(payload json.RawMessage) (interface{}, error) {
+			return nil, errors.New("invalid config")
+		},
+	}))
+	handler := client.subscriptions["ghome-mqtt/bridge/request/#"]
+	require.NotNil(t, handler)
+
+	tests := []struct {
+		name     string
+		topic    string
+		payload  string
+		expected publishedMessage
+	}{
+		{
+			name:     "Data with transaction",
+			topic:    "ghome-mqtt/bridge/request/devices",
+			payload:  `{"transaction":"abc"}`,
+			expected: publishedMessage{topic: "ghome-mqtt/bridge/response/devices", payload: `{"status":"ok","data":["lamp"],"transaction":"abc"}`},
+		},
+		{
+			name:     "Empty request",
+			topic:    "ghome-mqtt/bridge/request/devices",
+			expected: publishedMessage{topic: "ghome-mqtt/bridge/response/devices", payload: `{"status":"ok","data":["lamp"]}`},
+		},
+		{
+			name:     "Handler error",
+			topic:    "ghome-mqtt/bridge/request/config/reload",
+			payload:  `{"transaction":7}`,
+			expected: publishedMessage{topic: "ghome-mqtt/bridge/response/config/reload", payload: `{"status":"error","error":"invalid config","transaction":7}`},
+		},
+		{
+			name:     "Unknown request",
+			topic:    "ghome-mqtt/bridge/request/restart",
+			payload:  `{"transaction":"def"}`,
+			expected: publishedMessage{topic: "ghome-mqtt/bridge/response/restart", payload: `{"status":"error","error":"unknown request ` + "`restart`" + `","transaction":"def"}`},
+		},
+		{
+			name:     "Invalid request",
+			topic:    "ghome-mqtt/bridge/request/devices",
+			payload:  `devices`,
+			expected: publishedMessage{topic: "ghome-mqtt/bridge/response/devices", payload: `{"status":"error","error":"invalid request: invalid character 'd' looking for beginning of value"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client.published = nil
+			handler(client, &messageMock{topic: test.topic, payload: []byte(test.payload)})
+			require.Eventually(t, func() bool { return len(client.publishedMessages()) > 0 }, time.Second, time.Millisecond)
+			assert.Equal(t, []publishedMessage{test.expected}, client.publishedMessages())
+		})
+	}
+}
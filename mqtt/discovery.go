@@ -0,0 +1,155 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"path"
+	"sync"
+)
+
+// DiscoveryListener receives the devices found by a discovery source
+type DiscoveryListener interface {
+	AddDevice(id string, device config.DeviceConfig)
+	RemoveDevice(id string)
+}
+
+type discoveredDevice struct {
+	id     string
+	name   string
+	device config.DeviceConfig
+}
+
+// discovery applies the filters and overrides of a source and keeps track of the devices it found
+type discovery struct {
+	name     string
+	source   config.DiscoverySource
+	listener DiscoveryListener
+	mutex    sync.Mutex
+	devices  map[string]bool
+
+	// pending are the messages waiting for the worker, the listener subscribes to the state of the devices
+	// and can't wait for the broker inside the message handler of the client
+	workMutex sync.Mutex
+	pending   []func()
+	working   bool
+}
+
+func newDiscovery(name string, source config.DiscoverySource, listener DiscoveryListener) *discovery {
+	return &discovery{
+		name:     name,
+		source:   source,
+		listener: listener,
+		devices:  map[string]bool{},
+	}
+}
+
+// dispatch handles the message on the worker of the discovery, the messages are handled in order
+func (d *discovery) dispatch(handle func()) {
+	d.workMutex.Lock()
+	defer d.workMutex.Unlock()
+	d.pending = append(d.pending, handle)
+	if !d.working {
+		d.working = true
+		go d.work()
+	}
+}
+
+// work handles the pending messages until there are none left
+func (d *discovery) work() {
+	for {
+		d.workMutex.Lock()
+		if len(d.pending) == 0 {
+			d.working = false
+			d.workMutex.Unlock()
+			return
+		}
+		handle := d.pending[0]
+		d.pending = d.pending[1:]
+		d.workMutex.Unlock()
+
+		handle()
+	}
+}
+
+// update adds all discovered devices and removes the devices that are no longer discovered
+func (d *discovery) update(discovered []discoveredDevice) {
+	found := map[string]bool{}
+	for _, device := range discovered {
+		if d.add(device) {
+			found[device.id] = true
+		}
+	}
+
+	d.mutex.Lock()
+	var removed []string
+	for id := range d.devices {
+		if !found[id] {
+			removed = append(removed, id)
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, id := range removed {
+		d.remove(id)
+	}
+}
+
+// add passes the device to the listener when it matches the filters, reports whether it was added
+func (d *discovery) add(discovered discoveredDevice) bool {
+	if !d.included(discovered.id, discovered.name) {
+		log.Debug("discovered device excluded", "source", d.name, "device", discovered.id, "name", discovered.name)
+		d.remove(discovered.id)
+		return false
+	}
+
+	device := discovered.device
+	if override, ok := d.source.Overrides[discovered.name]; ok {
+		device = config.MergeDevice(device, override)
+	}
+	if override, ok := d.source.Overrides[discovered.id]; ok {
+		device = config.MergeDevice(device, override)
+	}
+
+	d.mutex.Lock()
+	d.devices[discovered.id] = true
+	d.mutex.Unlock()
+
+	log.Debug("discovered device", "source", d.name, "device", discovered.id, "name", discovered.name)
+	d.listener.AddDevice(discovered.id, device)
+	return true
+}
+
+func (d *discovery) remove(id string) {
+	d.mutex.Lock()
+	known := d.devices[id]
+	delete(d.devices, id)
+	d.mutex.Unlock()
+
+	if known {
+		d.listener.RemoveDevice(id)
+	}
+}
+
+func (d *discovery) included(id string, name string) bool {
+	if len(d.source.Include) > 0 && !matchAny(d.source.Include, id, name) {
+		return false
+	}
+	return !matchAny(d.source.Exclude, id, name)
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, _ := path.Match(pattern, value); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fahrenheitTemplate converts a temperature field in fahrenheit to celsius, the state Google expects for sensors
+func fahrenheitTemplate(field string) string {
+	return fmt.Sprintf("{{ with .%s }}{{ scale . 32 212 0 100 }}{{ end }}", field)
+}
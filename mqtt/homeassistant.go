@@ -0,0 +1,647 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	openCloseTrait          = "action.devices.traits.OpenClose"
+	fanSpeedTrait           = "action.devices.traits.FanSpeed"
+	temperatureSettingTrait = "action.devices.traits.TemperatureSetting"
+	temperatureControlTrait = "action.devices.traits.TemperatureControl"
+	humiditySettingTrait    = "action.devices.traits.HumiditySetting"
+	lockUnlockTrait         = "action.devices.traits.LockUnlock"
+
+	openCloseCommand   = "action.devices.commands.OpenClose"
+	fanSpeedCommand    = "action.devices.commands.SetFanSpeed"
+	setModeCommand     = "action.devices.commands.ThermostatSetMode"
+	homeassistantTopic = "homeassistant"
+)
+
+// homeassistantAbbreviations expands the abbreviated keys of discovery messages that are supported
+var homeassistantAbbreviations = map[string]string{
+	"bri_cmd_t":        "brightness_command_topic",
+	"bri_scl":          "brightness_scale",
+	"bri_stat_t":       "brightness_state_topic",
+	"bri_val_tpl":      "brightness_value_template",
+	"clr_temp_cmd_t":   "color_temp_command_topic",
+	"clr_temp_stat_t":  "color_temp_state_topic",
+	"clr_temp_val_tpl": "color_temp_value_template",
+	"cmd_t":            "command_topic",
+	"curr_temp_t":      "current_temperature_topic",
+	"curr_temp_tpl":    "current_temperature_template",
+	"dev":              "device",
+	"dev_cla":          "device_class",
+	"max_mirs":         "max_mireds",
+	"min_mirs":         "min_mireds",
+	"mode_cmd_t":       "mode_command_topic",
+	"mode_stat_t":      "mode_state_topic",
+	"mode_stat_tpl":    "mode_state_template",
+	"pct_cmd_t":        "percentage_command_topic",
+	"pct_stat_t":       "percentage_state_topic",
+	"pct_val_tpl":      "percentage_value_template",
+	"pl_cls":           "payload_close",
+	"pl_lock":          "payload_lock",
+	"pl_off":           "payload_off",
+	"pl_on":            "payload_on",
+	"pl_open":          "payload_open",
+	"pl_unlk":          "payload_unlock",
+	"pos_clsd":         "position_closed",
+	"pos_open":         "position_open",
+	"pos_t":            "position_topic",
+	"pos_tpl":          "position_template",
+	"rgb_cmd_t":        "rgb_command_topic",
+	"set_pos_t":        "set_position_topic",
+	"spd_rng_max":      "speed_range_max",
+	"spd_rng_min":      "speed_range_min",
+	"stat_clsd":        "state_closed",
+	"stat_locked":      "state_locked",
+	"stat_off":         "state_off",
+	"stat_on":          "state_on",
+	"stat_open":        "state_open",
+	"stat_t":           "state_topic",
+	"stat_unlocked":    "state_unlocked",
+	"stat_val_tpl":     "state_value_template",
+	"sup_clrm":         "supported_color_modes",
+	"temp_cmd_t":       "temperature_command_topic",
+	"temp_stat_t":      "temperature_state_topic",
+	"temp_stat_tpl":    "temperature_state_template",
+	"temp_unit":        "temperature_unit",
+	"uniq_id":          "unique_id",
+	"unit_of_meas":     "unit_of_measurement",
+	"val_tpl":          "value_template",
+	// device
+	"ids": "identifiers",
+	"mf":  "manufacturer",
+	"mdl": "model",
+	"sw":  "sw_version",
+	"hw":  "hw_version",
+	"sa":  "suggested_area",
+	"cns": "connections",
+}
+
+// homeassistantCoverTypes maps the device class of a cover to a Google device type
+var homeassistantCoverTypes = map[string]string{
+	"awning":  "action.devices.types.AWNING",
+	"curtain": "action.devices.types.CURTAIN",
+	"door":    "action.devices.types.DOOR",
+	"garage":  "action.devices.types.GARAGE",
+	"gate":    "action.devices.types.GATE",
+	"shutter": "action.devices.types.SHUTTER",
+	"window":  "action.devices.types.WINDOW",
+}
+
+// homeassistantModes maps the hvac modes of Home Assistant to Google thermostat modes
+var homeassistantModes = map[string]string{
+	"off":       "off",
+	"heat":      "heat",
+	"cool":      "cool",
+	"auto":      "auto",
+	"heat_cool": "heatcool",
+	"dry":       "dry",
+	"fan_only":  "fan-only",
+}
+
+// homeassistantConfig is an expanded discovery message
+type homeassistantConfig map[string]interface{}
+
+// DiscoverHomeassistant subscribes to the Home Assistant discovery prefix and passes every supported component to the listener,
+// an empty discovery message removes the component
+func (m *Mqtt) DiscoverHomeassistant(source config.DiscoverySource, listener DiscoveryListener) error {
+	prefix := source.Topic
+	if prefix == "" {
+		prefix = homeassistantTopic
+	}
+	discovery := newHomeassistantDiscovery(prefix, source, listener)
+	callbackHandler := func(client mqtt.Client, msg mqtt.Message) {
+		topic, payload := msg.Topic(), msg.Payload()
+		discovery.dispatch(func() {
+			discovery.handle(topic, payload)
+		})
+	}
+
+	for _, topic := range []string{prefix + "/+/+/config", prefix + "/+/+/+/config"} {
+		log.Info("discover home assistant devices", "topic", topic)
+		if err := m.subscribe(topic, callbackHandler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// homeassistantDiscovery keeps track of the device of every discovery topic, so an empty message can remove it
+type homeassistantDiscovery struct {
+	*discovery
+	prefix  string
+	mutex   sync.Mutex
+	devices map[string]string // discovery topic to device id
+}
+
+func newHomeassistantDiscovery(prefix string, source config.DiscoverySource, listener DiscoveryListener) *homeassistantDiscovery {
+	return &homeassistantDiscovery{
+		discovery: newDiscovery("homeassistant", source, listener),
+		prefix:    prefix,
+		devices:   map[string]string{},
+	}
+}
+
+// handle adds the device of the discovery message, the listener is called without holding the mutex
+func (h *homeassistantDiscovery) handle(topic string, payload []byte) {
+	if len(payload) == 0 {
+		h.mutex.Lock()
+		id, ok := h.devices[topic]
+		delete(h.devices, topic)
+		h.mutex.Unlock()
+		if ok {
+			h.remove(id)
+		}
+		return
+	}
+
+	device, ok, err := parseHomeassistantConfig(h.prefix, topic, payload)
+	if err != nil {
+		log.Error("failed to parse home assistant discovery message", "topic", topic, "error", err)
+		return
+	}
+	if !ok {
+		log.Debug("unsupported home assistant component", "topic", topic)
+		return
+	}
+
+	h.mutex.Lock()
+	previous, ok := h.devices[topic]
+	h.devices[topic] = device.id
+	h.mutex.Unlock()
+
+	if ok && previous != device.id {
+		h.remove(previous)
+	}
+	h.add(device)
+}
+
+// parseHomeassistantConfig converts the discovery message of a component to a device, reports whether the component is supported
+func parseHomeassistantConfig(prefix string, topic string, payload []byte) (discoveredDevice, bool, error) {
+	// <prefix>/<component>/[<node_id>/]<object_id>/config
+	parts := strings.Split(strings.TrimPrefix(topic, prefix+"/"), "/")
+	if len(parts) < 3 {
+		return discoveredDevice{}, false, fmt.Errorf("invalid discovery topic %s", topic)
+	}
+	component := parts[0]
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return discoveredDevice{}, false, err
+	}
+	cfg := expandHomeassistantConfig(message)
+
+	var device config.DeviceConfig
+	var ok bool
+	switch component {
+	case "switch":
+		device, ok = homeassistantSwitch(cfg), true
+	case "light":
+		device, ok = homeassistantLight(cfg), true
+	case "cover":
+		device, ok = homeassistantCover(cfg), true
+	case "fan":
+		device, ok = homeassistantFan(cfg), true
+	case "climate":
+		device, ok = homeassistantClimate(cfg), true
+	case "lock":
+		device, ok = homeassistantLock(cfg), true
+	case "sensor":
+		device, ok = homeassistantSensor(cfg)
+	}
+	if !ok {
+		return discoveredDevice{}, false, nil
+	}
+
+	id := cfg.string("unique_id", strings.Join(parts[:len(parts)-1], "_"))
+	deviceInfo := cfg.device()
+	device.Name = cfg.string("name", deviceInfo.string("name", id))
+	if name := deviceInfo.string("name", ""); name != "" && name != device.Name {
+		device.DefaultNames = []string{name}
+	}
+	device.RoomHint = deviceInfo.string("suggested_area", "")
+	device.DeviceInfo = config.SyncDeviceInfo{
+		Manufacturer: deviceInfo.string("manufacturer", ""),
+		Model:        deviceInfo.string("model", ""),
+		HwVersion:    deviceInfo.string("hw_version", ""),
+		SwVersion:    deviceInfo.string("sw_version", ""),
+	}
+	return discoveredDevice{id: id, name: device.Name, device: device}, true, nil
+}
+
+func homeassistantSwitch(cfg homeassistantConfig) config.DeviceConfig {
+	deviceType := "action.devices.types.SWITCH"
+	if cfg.string("device_class", "") == "outlet" {
+		deviceType = "action.devices.types.OUTLET"
+	}
+	device := newHomeassistantDevice(cfg, deviceType, onOffTrait)
+	addHomeassistantOnOff(&device, cfg)
+	return device
+}
+
+func homeassistantLight(cfg homeassistantConfig) config.DeviceConfig {
+	if cfg.string("schema", "default") == "json" {
+		return homeassistantJsonLight(cfg)
+	}
+
+	device := newHomeassistantDevice(cfg, "action.devices.types.LIGHT", onOffTrait)
+	addHomeassistantOnOff(&device, cfg)
+
+	if topic := cfg.string("brightness_command_topic", ""); topic != "" {
+		brightnessScale := cfg.float("brightness_scale", 255)
+		device.Traits = append(device.Traits, brightnessTrait)
+		device.Commands[brightnessCommand] = config.CommandConfig{
+			Topic:    topic,
+			Template: fmt.Sprintf("{{ scale .Params.brightness 0 100 0 %v | round }}", brightnessScale),
+		}
+		addHomeassistantState(&device, cfg, "brightness", "brightness_state_topic", "brightness_value_template", config.StateMapping{Max: brightnessScale})
+	}
+
+	if topic := cfg.string("rgb_command_topic", ""); topic != "" {
+		device.Traits = append(device.Traits, colorSettingTrait)
+		device.Attributes.ColorModel = "rgb"
+		device.Commands[colorCommand] = config.CommandConfig{
+			Topic:    topic,
+			Template: "{{ with spectrumToRgb .Params.color.spectrumRGB }}{{ .r }},{{ .g }},{{ .b }}{{ end }}",
+		}
+	} else if topic := cfg.string("color_temp_command_topic", ""); topic != "" {
+		device.Traits = append(device.Traits, colorSettingTrait)
+		device.Attributes.ColorTemperatureRange = homeassistantColorTemperatureRange(cfg)
+		device.Commands[colorCommand] = config.CommandConfig{
+			Topic:    topic,
+			Template: "{{ kelvinToMired .Params.color.temperature }}",
+		}
+		addHomeassistantState(&device, cfg, "color.temperatureK", "color_temp_state_topic", "", config.StateMapping{})
+		if mapping, ok := device.States["color.temperatureK"]; ok {
+			mapping.Template = fmt.Sprintf("{{ with index . %s }}{{ miredToKelvin . }}{{ end }}", templateKeys(mapping.Field))
+			mapping.Field = ""
+			device.States["color.temperatureK"] = mapping
+		}
+	}
+	return device
+}
+
+// homeassistantJsonLight handles lights with the json schema, commands and states are json objects on a single topic
+func homeassistantJsonLight(cfg homeassistantConfig) config.DeviceConfig {
+	device := newHomeassistantDevice(cfg, "action.devices.types.LIGHT", onOffTrait)
+	device.Commands[onOffCommand] = config.CommandConfig{Template: `{"state":"{{ if .Params.on }}ON{{ else }}OFF{{ end }}"}`}
+	device.States["on"] = config.StateMapping{Field: "state", Values: map[string]interface{}{"ON": true, "OFF": false}}
+
+	colorModes := cfg.strings("supported_color_modes")
+	brightness := cfg.bool("brightness") || len(colorModes) > 0 && !(len(colorModes) == 1 && colorModes[0] == "onoff")
+	if brightness {
+		brightnessScale := cfg.float("brightness_scale", 255)
+		device.Traits = append(device.Traits, brightnessTrait)
+		device.Commands[brightnessCommand] = config.CommandConfig{Template: fmt.Sprintf(`{"state":"ON","brightness":{{ scale .Params.brightness 0 100 0 %v | round }}}`, brightnessScale)}
+		device.States["brightness"] = config.StateMapping{Field: "brightness", Max: brightnessScale}
+	}
+
+	rgb := cfg.bool("rgb") || containsAny(colorModes, "rgb", "rgbw", "rgbww", "hs", "xy")
+	colorTemp := cfg.bool("color_temp") || containsAny(colorModes, "color_temp")
+	if rgb || colorTemp {
+		device.Traits = append(device.Traits, colorSettingTrait)
+	}
+	if rgb {
+		device.Attributes.ColorModel = "rgb"
+		device.States["color.spectrumRgb"] = config.StateMapping{Template: `{{ with .color }}{{ if ne (printf "%v" .r) "<nil>" }}{{ rgbToSpectrum .r .g .b }}{{ end }}{{ end }}`}
+	}
+	if colorTemp {
+		device.Attributes.ColorTemperatureRange = homeassistantColorTemperatureRange(cfg)
+		device.States["color.temperatureK"] = config.StateMapping{Template: `{{ if .color_temp }}{{ if or (not .color_mode) (eq (printf "%v" .color_mode) "color_temp") }}{{ miredToKelvin .color_temp }}{{ end }}{{ end }}`}
+	}
+	switch {
+	case rgb && colorTemp:
+		device.Commands[colorCommand] = config.CommandConfig{Template: `{{ if .Params.color.temperature }}{"state":"ON","color_temp":{{ kelvinToMired .Params.color.temperature }}}{{ else }}{"state":"ON","color":{{ json (spectrumToRgb .Params.color.spectrumRGB) }}}{{ end }}`}
+	case rgb:
+		device.Commands[colorCommand] = config.CommandConfig{Template: `{"state":"ON","color":{{ json (spectrumToRgb .Params.color.spectrumRGB) }}}`}
+	case colorTemp:
+		device.Commands[colorCommand] = config.CommandConfig{Template: `{"state":"ON","color_temp":{{ kelvinToMired .Params.color.temperature }}}`}
+	}
+	return device
+}
+
+func homeassistantCover(cfg homeassistantConfig) config.DeviceConfig {
+	deviceType, ok := homeassistantCoverTypes[cfg.string("device_class", "")]
+	if !ok {
+		deviceType = "action.devices.types.BLINDS"
+	}
+	device := newHomeassistantDevice(cfg, deviceType, openCloseTrait)
+
+	closed, open := cfg.float("position_closed", 0), cfg.float("position_open", 100)
+	if topic := cfg.string("set_position_topic", ""); topic != "" {
+		device.Commands[openCloseCommand] = config.CommandConfig{
+			Topic:    topic,
+			Template: fmt.Sprintf("{{ scale .Params.openPercent 0 100 %v %v | round }}", closed, open),
+		}
+	} else {
+		device.Attributes.DiscreteOnlyOpenClose = true
+		device.Commands[openCloseCommand] = config.CommandConfig{
+			Template: fmt.Sprintf("{{ if eq (round .Params.openPercent) 0 }}%s{{ else }}%s{{ end }}", templateLiteral(cfg.string("payload_close", "CLOSE")), templateLiteral(cfg.string("payload_open", "OPEN"))),
+		}
+	}
+	if device.Commands[openCloseCommand].Topic == "" && device.Topic == "" {
+		delete(device.Commands, openCloseCommand)
+		device.Attributes.QueryOnlyOpenClose = true
+	}
+
+	if cfg.string("position_topic", "") != "" {
+		addHomeassistantState(&device, cfg, "openPercent", "position_topic", "position_template", config.StateMapping{Min: closed, Max: open})
+	} else {
+		addHomeassistantState(&device, cfg, "openPercent", "state_topic", "value_template", config.StateMapping{
+			Values: map[string]interface{}{cfg.string("state_open", "open"): 100, cfg.string("state_closed", "closed"): 0},
+		})
+	}
+	return device
+}
+
+func homeassistantFan(cfg homeassistantConfig) config.DeviceConfig {
+	device := newHomeassistantDevice(cfg, "action.devices.types.FAN", onOffTrait)
+	addHomeassistantOnOff(&device, cfg)
+
+	if topic := cfg.string("percentage_command_topic", ""); topic != "" {
+		speedMax := cfg.float("speed_range_max", 100)
+		device.Traits = append(device.Traits, fanSpeedTrait)
+		device.Attributes.SupportsFanSpeedPercent = true
+		device.Commands[fanSpeedCommand] = config.CommandConfig{
+			Topic:    topic,
+			Template: fmt.Sprintf("{{ scale .Params.fanSpeedPercent 0 100 0 %v | round }}", speedMax),
+		}
+		addHomeassistantState(&device, cfg, "currentFanSpeedPercent", "percentage_state_topic", "percentage_value_template", config.StateMapping{Max: speedMax})
+	}
+	return device
+}
+
+func homeassistantClimate(cfg homeassistantConfig) config.DeviceConfig {
+	device := newHomeassistantDevice(cfg, "action.devices.types.THERMOSTAT", temperatureSettingTrait)
+	device.Attributes.ThermostatTemperatureUnit = cfg.string("temperature_unit", "C")
+
+	modes := cfg.strings("modes")
+	if modes == nil {
+		modes = []string{"auto", "off", "cool", "heat", "dry", "fan_only"}
+	}
+	values := map[string]interface{}{}
+	for _, mode := range modes {
+		if googleMode, ok := homeassistantModes[mode]; ok {
+			device.Attributes.AvailableThermostatModes = append(device.Attributes.AvailableThermostatModes, googleMode)
+			values[mode] = googleMode
+		}
+	}
+
+	if topic := cfg.string("mode_command_topic", ""); topic != "" {
+		device.Commands[setModeCommand] = config.CommandConfig{
+			Topic:    topic,
+			Template: `{{ if eq .Params.thermostatMode "heatcool" }}heat_cool{{ else if eq .Params.thermostatMode "fan-only" }}fan_only{{ else }}{{ .Params.thermostatMode }}{{ end }}`,
+		}
+	}
+	if topic := cfg.string("temperature_command_topic", ""); topic != "" {
+		device.Commands[setpointCommand] = config.CommandConfig{
+			Topic:    topic,
+			Template: "{{ .Params.thermostatTemperatureSetpoint }}",
+		}
+	}
+	if len(device.Commands) == 0 {
+		device.Attributes.QueryOnlyTemperatureSetting = true
+	}
+
+	addHomeassistantState(&device, cfg, "thermostatMode", "mode_state_topic", "mode_state_template", config.StateMapping{Values: values})
+	addHomeassistantState(&device, cfg, "thermostatTemperatureSetpoint", "temperature_state_topic", "temperature_state_template", config.StateMapping{})
+	addHomeassistantState(&device, cfg, "thermostatTemperatureAmbient", "current_temperature_topic", "current_temperature_template", config.StateMapping{})
+	return device
+}
+
+func homeassistantLock(cfg homeassistantConfig) config.DeviceConfig {
+	device := newHomeassistantDevice(cfg, "action.devices.types.LOCK", lockUnlockTrait)
+	device.Commands[lockCommand] = config.CommandConfig{
+		Template: fmt.Sprintf("{{ if .Params.lock }}%s{{ else }}%s{{ end }}", templateLiteral(cfg.string("payload_lock", "LOCK")), templateLiteral(cfg.string("payload_unlock", "UNLOCK"))),
+	}
+	addHomeassistantState(&device, cfg, "isLocked", "state_topic", "value_template", config.StateMapping{
+		Values: map[string]interface{}{cfg.string("state_locked", "LOCKED"): true, cfg.string("state_unlocked", "UNLOCKED"): false},
+	})
+	return device
+}
+
+// homeassistantSensor supports temperature and humidity sensors, other sensors have no Google equivalent
+func homeassistantSensor(cfg homeassistantConfig) (config.DeviceConfig, bool) {
+	switch cfg.string("device_class", "") {
+	case "temperature":
+		device := newHomeassistantDevice(cfg, "action.devices.types.SENSOR", temperatureControlTrait)
+		device.Attributes.QueryOnlyTemperatureControl = true
+		device.Attributes.TemperatureRange = &config.SyncTemperatureRange{MinThresholdCelsius: -40, MaxThresholdCelsius: 125}
+		device.Attributes.TemperatureUnitForUX = "C"
+		addHomeassistantState(&device, cfg, "temperatureAmbientCelsius", "state_topic", "value_template", config.StateMapping{})
+		if mapping, ok := device.States["temperatureAmbientCelsius"]; ok && strings.HasSuffix(cfg.string("unit_of_measurement", ""), "F") {
+			// google expects the ambient temperature in celsius
+			device.Attributes.TemperatureUnitForUX = "F"
+			mapping.Template = fahrenheitTemplate(mapping.Field)
+			mapping.Field = ""
+			device.States["temperatureAmbientCelsius"] = mapping
+		}
+		return device, true
+	case "humidity":
+		device := newHomeassistantDevice(cfg, "action.devices.types.SENSOR", humiditySettingTrait)
+		device.Attributes.QueryOnlyHumiditySetting = true
+		addHomeassistantState(&device, cfg, "humidityAmbientPercent", "state_topic", "value_template", config.StateMapping{})
+		return device, true
+	}
+	return config.DeviceConfig{}, false
+}
+
+func newHomeassistantDevice(cfg homeassistantConfig, deviceType string, traits ...string) config.DeviceConfig {
+	return config.DeviceConfig{
+		Type:         deviceType,
+		Traits:       traits,
+		Topic:        cfg.string("command_topic", ""),
+		Subscription: cfg.string("state_topic", ""),
+		Commands:     map[string]config.CommandConfig{},
+		States:       map[string]config.StateMapping{},
+	}
+}
+
+func addHomeassistantOnOff(device *config.DeviceConfig, cfg homeassistantConfig) {
+	payloadOn, payloadOff := cfg.string("payload_on", "ON"), cfg.string("payload_off", "OFF")
+	if device.Topic != "" {
+		device.Commands[onOffCommand] = config.CommandConfig{
+			Template: fmt.Sprintf("{{ if .Params.on }}%s{{ else }}%s{{ end }}", templateLiteral(payloadOn), templateLiteral(payloadOff)),
+		}
+	} else {
+		device.Attributes.QueryOnlyOnOff = true
+	}
+
+	valueTemplate := "value_template"
+	if cfg.string("state_value_template", "") != "" {
+		valueTemplate = "state_value_template"
+	}
+	addHomeassistantState(device, cfg, "on", "state_topic", valueTemplate, config.StateMapping{
+		Values: map[string]interface{}{cfg.string("state_on", payloadOn): true, cfg.string("state_off", payloadOff): false},
+	})
+}
+
+// addHomeassistantState adds the state mapping when the topic is set and the value template is supported
+func addHomeassistantState(device *config.DeviceConfig, cfg homeassistantConfig, state string, topicKey string, templateKey string, mapping config.StateMapping) {
+	topic := cfg.string(topicKey, "")
+	if topic == "" {
+		return
+	}
+
+	field := "value"
+	if valueTemplate := cfg.string(templateKey, ""); templateKey != "" && valueTemplate != "" {
+		var ok bool
+		field, ok = parseValueTemplate(valueTemplate)
+		if !ok {
+			log.Warn("unsupported home assistant value template", "state", state, "template", valueTemplate)
+			return
+		}
+	}
+
+	mapping.Field = field
+	if topic != device.Subscription {
+		mapping.Topic = topic
+	}
+	device.States[state] = mapping
+}
+
+// homeassistantColorTemperatureRange converts the mireds of the light to kelvin, mireds of 0 or less fall back on the defaults
+func homeassistantColorTemperatureRange(cfg homeassistantConfig) config.SyncColorTemperatureRange {
+	minMireds, maxMireds := cfg.float("min_mireds", 153), cfg.float("max_mireds", 500)
+	if minMireds <= 0 {
+		minMireds = 153
+	}
+	if maxMireds <= 0 {
+		maxMireds = 500
+	}
+	return config.SyncColorTemperatureRange{
+		TemperatureMinK: int(math.Round(1000000 / maxMireds)),
+		TemperatureMaxK: int(math.Round(1000000 / minMireds)),
+	}
+}
+
+var valueTemplatePath = regexp.MustCompile(`^value_json((?:\.\w+|\[\s*'[^']*'\s*\]|\[\s*"[^"]*"\s*\])*)$`)
+var valueTemplateKey = regexp.MustCompile(`\.(\w+)|\[\s*'([^']*)'\s*\]|\[\s*"([^"]*)"\s*\]`)
+
+// parseValueTemplate converts simple jinja value templates like `{{ value_json.state }}` to the field of a state mapping,
+// filters like `| int` are ignored
+func parseValueTemplate(valueTemplate string) (string, bool) {
+	expression := strings.TrimSpace(valueTemplate)
+	if !strings.HasPrefix(expression, "{{") || !strings.HasSuffix(expression, "}}") {
+		return "", false
+	}
+	expression = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(expression, "{{"), "}}"))
+	expression, _, _ = strings.Cut(expression, "|")
+	expression = strings.TrimSpace(expression)
+
+	if expression == "value" {
+		return "value", true
+	}
+	match := valueTemplatePath.FindStringSubmatch(expression)
+	if match == nil || match[1] == "" {
+		return "", false
+	}
+
+	var keys []string
+	for _, key := range valueTemplateKey.FindAllStringSubmatch(match[1], -1) {
+		keys = append(keys, key[1]+key[2]+key[3])
+	}
+	return strings.Join(keys, "."), true
+}
+
+// templateLiteral quotes a discovered value as a string literal of a template, so it can't change the template
+func templateLiteral(value string) string {
+	return fmt.Sprintf("{{ %q }}", value)
+}
+
+// templateKeys quotes the keys of a field as arguments of the index function of a template
+func templateKeys(field string) string {
+	var keys []string
+	for _, key := range strings.Split(field, ".") {
+		keys = append(keys, fmt.Sprintf("%q", key))
+	}
+	return strings.Join(keys, " ")
+}
+
+func containsAny(values []string, searches ...string) bool {
+	return slices.ContainsFunc(searches, func(search string) bool {
+		return slices.Contains(values, search)
+	})
+}
+
+// expandHomeassistantConfig expands abbreviated keys and the `~` base topic
+func expandHomeassistantConfig(message map[string]interface{}) homeassistantConfig {
+	base, _ := message["~"].(string)
+	cfg := homeassistantConfig{}
+	for key, value := range message {
+		if expanded, ok := homeassistantAbbreviations[key]; ok {
+			key = expanded
+		}
+		switch v := value.(type) {
+		case string:
+			if base != "" && strings.HasSuffix(key, "_topic") {
+				if strings.HasPrefix(v, "~") {
+					v = base + strings.TrimPrefix(v, "~")
+				} else if strings.HasSuffix(v, "~") {
+					v = strings.TrimSuffix(v, "~") + base
+				}
+			}
+			value = v
+		case map[string]interface{}:
+			value = map[string]interface{}(expandHomeassistantConfig(v))
+		}
+		cfg[key] = value
+	}
+	return cfg
+}
+
+func (c homeassistantConfig) string(key string, fallback string) string {
+	switch value := c[key].(type) {
+	case string:
+		if value != "" {
+			return value
+		}
+	case float64, bool:
+		return fmt.Sprintf("%v", value)
+	}
+	return fallback
+}
+
+func (c homeassistantConfig) float(key string, fallback float64) float64 {
+	if value, ok := c[key].(float64); ok {
+		return value
+	}
+	return fallback
+}
+
+func (c homeassistantConfig) bool(key string) bool {
+	value, _ := c[key].(bool)
+	return value
+}
+
+func (c homeassistantConfig) strings(key string) []string {
+	values, ok := c[key].([]interface{})
+	if !ok {
+		return nil
+	}
+	var result []string
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func (c homeassistantConfig) device() homeassistantConfig {
+	device, _ := c["device"].(map[string]interface{})
+	return device
+}
@@ -0,0 +1,269 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHomeassistantConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		topic          string
+		payload        string
+		expectedId     string
+		expectedDevice config.DeviceConfig
+		expectedOk     bool
+	}{
+		{
+			name:  "ESPHome switch with abbreviations and base topic",
+			topic: "homeassistant/switch/plug/relay/config",
+			payload: `{"~":"plug/switch/relay","name":"Relay","stat_t":"~/state","cmd_t":"~/command","uniq_id":"plugrelay","dev_cla":"outlet",
+				"dev":{"ids":"a1b2c3","name":"plug","mf":"espressif","mdl":"esp01_1m","sw":"2023.12.5 (ESPHome)","sa":"Kitchen"}}`,
+			expectedId: "plugrelay",
+			expectedDevice: config.DeviceConfig{
+				Name:         "Relay",
+				DefaultNames: []string{"plug"},
+				RoomHint:     "Kitchen",
+				Type:         "action.devices.types.OUTLET",
+				Traits:       []string{"action.devices.traits.OnOff"},
+				Topic:        "plug/switch/relay/command",
+				Subscription: "plug/switch/relay/state",
+				DeviceInfo:   config.SyncDeviceInfo{Manufacturer: "espressif", Model: "esp01_1m", SwVersion: "2023.12.5 (ESPHome)"},
+				Commands: map[string]config.CommandConfig{
+					"action.devices.commands.OnOff": {Template: `{{ if .Params.on }}{{ "ON" }}{{ else }}{{ "OFF" }}{{ end }}`},
+				},
+				States: map[string]config.StateMapping{
+					"on": {Field: "value", Values: map[string]interface{}{"ON": true, "OFF": false}},
+				},
+			},
+			expectedOk: true,
+		},
+		{
+			name:  "Tasmota relay with value template",
+			topic: "homeassistant/switch/A1B2C3_RL_1/config",
+			payload: `{"name":"Tasmota","cmd_t":"cmnd/tasmota_A1B2C3/POWER","stat_t":"tele/tasmota_A1B2C3/STATE","val_tpl":"{{value_json.POWER}}",
+				"pl_off":"OFF","pl_on":"ON","uniq_id":"A1B2C3_RL_1"}`,
+			expectedId: "A1B2C3_RL_1",
+			expectedDevice: config.DeviceConfig{
+				Name:         "Tasmota",
+				Type:         "action.devices.types.SWITCH",
+				Traits:       []string{"action.devices.traits.OnOff"},
+				Topic:        "cmnd/tasmota_A1B2C3/POWER",
+				Subscription: "tele/tasmota_A1B2C3/STATE",
+				Commands: map[string]config.CommandConfig{
+					"action.devices.commands.OnOff": {Template: `{{ if .Params.on }}{{ "ON" }}{{ else }}{{ "OFF" }}{{ end }}`},
+				},
+				States: map[string]config.StateMapping{
+					"on": {Field: "POWER", Values: map[string]interface{}{"ON": true, "OFF": false}},
+				},
+			},
+			expectedOk: true,
+		},
+		{
+			name:  "Default light with brightness on a separate topic",
+			topic: "homeassistant/light/node/dimmer/config",
+			payload: `{"name":"Dimmer","cmd_t":"dimmer/set","stat_t":"dimmer/state","pl_on":"1","pl_off":"0",
+				"bri_cmd_t":"dimmer/brightness/set","bri_stat_t":"dimmer/brightness","bri_scl":100}`,
+			expectedId: "light_node_dimmer",
+			expectedDevice: config.DeviceConfig{
+				Name:         "Dimmer",
+				Type:         "action.devices.types.LIGHT",
+				Traits:       []string{"action.devices.traits.OnOff", "action.devices.traits.Brightness"},
+				Topic:        "dimmer/set",
+				Subscription: "dimmer/state",
+				Commands: map[string]config.CommandConfig{
+					"action.devices.commands.OnOff":              {Template: `{{ if .Params.on }}{{ "1" }}{{ else }}{{ "0" }}{{ end }}`},
+					"action.devices.commands.BrightnessAbsolute": {Topic: "dimmer/brightness/set", Template: "{{ scale .Params.brightness 0 100 0 100 | round }}"},
+				},
+				States: map[string]config.StateMapping{
+					"on":         {Field: "value", Values: map[string]interface{}{"1": true, "0": false}},
+					"brightness": {Field: "value", Max: 100, Topic: "dimmer/brightness"},
+				},
+			},
+			expectedOk: true,
+		},
+		{
+			name:       "Cover with position",
+			topic:      "homeassistant/cover/blind/config",
+			payload:    `{"name":"Blind","dev_cla":"shutter","cmd_t":"blind/set","pos_t":"blind/position","set_pos_t":"blind/position/set"}`,
+			expectedId: "cover_blind",
+			expectedDevice: config.DeviceConfig{
+				Name:     "Blind",
+				Type:     "action.devices.types.SHUTTER",
+				Traits:   []string{"action.devices.traits.OpenClose"},
+				Topic:    "blind/set",
+				Commands: map[string]config.CommandConfig{"action.devices.commands.OpenClose": {Topic: "blind/position/set", Template: "{{ scale .Params.openPercent 0 100 0 100 | round }}"}},
+				States:   map[string]config.StateMapping{"openPercent": {Field: "value", Max: 100, Topic: "blind/position"}},
+			},
+			expectedOk: true,
+		},
+		{
+			name:  "Climate with topics per state",
+			topic: "homeassistant/climate/trv/config",
+			payload: `{"name":"Radiator","modes":["off","heat","heat_cool"],"mode_cmd_t":"trv/mode/set","mode_stat_t":"trv/mode",
+				"temp_cmd_t":"trv/target/set","temp_stat_t":"trv/state","temp_stat_tpl":"{{ value_json['target'] | float }}","curr_temp_t":"trv/state","curr_temp_tpl":"{{ value_json.sensor.temperature }}"}`,
+			expectedId: "climate_trv",
+			expectedDevice: config.DeviceConfig{
+				Name:   "Radiator",
+				Type:   "action.devices.types.THERMOSTAT",
+				Traits: []string{"action.devices.traits.TemperatureSetting"},
+				Attributes: config.SyncAttributes{
+					AvailableThermostatModes:  []string{"off", "heat", "heatcool"},
+					ThermostatTemperatureUnit: "C",
+				},
+				Commands: map[string]config.CommandConfig{
+					"action.devices.commands.ThermostatSetMode":             {Topic: "trv/mode/set", Template: `{{ if eq .Params.thermostatMode "heatcool" }}heat_cool{{ else if eq .Params.thermostatMode "fan-only" }}fan_only{{ else }}{{ .Params.thermostatMode }}{{ end }}`},
+					"action.devices.commands.ThermostatTemperatureSetpoint": {Topic: "trv/target/set", Template: "{{ .Params.thermostatTemperatureSetpoint }}"},
+				},
+				States: map[string]config.StateMapping{
+					"thermostatMode":                {Field: "value", Topic: "trv/mode", Values: map[string]interface{}{"off": "off", "heat": "heat", "heat_cool": "heatcool"}},
+					"thermostatTemperatureSetpoint": {Field: "target", Topic: "trv/state"},
+					"thermostatTemperatureAmbient":  {Field: "sensor.temperature", Topic: "trv/state"},
+				},
+			},
+			expectedOk: true,
+		},
+		{
+			name:       "Humidity sensor",
+			topic:      "homeassistant/sensor/bathroom/humidity/config",
+			payload:    `{"name":"Bathroom humidity","dev_cla":"humidity","stat_t":"bathroom/sensor","val_tpl":"{{ value_json.humidity }}","unit_of_meas":"%"}`,
+			expectedId: "sensor_bathroom_humidity",
+			expectedDevice: config.DeviceConfig{
+				Name:         "Bathroom humidity",
+				Type:         "action.devices.types.SENSOR",
+				Traits:       []string{"action.devices.traits.HumiditySetting"},
+				Subscription: "bathroom/sensor",
+				Attributes:   config.SyncAttributes{QueryOnlyHumiditySetting: true},
+				Commands:     map[string]config.CommandConfig{},
+				States:       map[string]config.StateMapping{"humidityAmbientPercent": {Field: "humidity"}},
+			},
+			expectedOk: true,
+		},
+		{
+			name:       "Unsupported sensor",
+			topic:      "homeassistant/sensor/node/power/config",
+			payload:    `{"name":"Power","dev_cla":"power","stat_t":"node/power"}`,
+			expectedOk: false,
+		},
+		{
+			name:       "Unsupported component",
+			topic:      "homeassistant/binary_sensor/door/config",
+			payload:    `{"name":"Door","stat_t":"door/state"}`,
+			expectedOk: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device, ok, err := parseHomeassistantConfig("homeassistant", test.topic, []byte(test.payload))
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedOk, ok)
+			if test.expectedOk {
+				assert.Equal(t, test.expectedId, device.id)
+				assert.Equal(t, test.expectedDevice, device.device)
+			}
+		})
+	}
+}
+
+func TestParseHomeassistantJsonLight(t *testing.T) {
+	device, ok, err := parseHomeassistantConfig("homeassistant", "homeassistant/light/bulb/config",
+		[]byte(`{"schema":"json","name":"Bulb","cmd_t":"bulb/set","stat_t":"bulb","brightness":true,"sup_clrm":["rgb","color_temp"],"min_mirs":154,"max_mirs":370}`))
+
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []string{"action.devices.traits.OnOff", "action.devices.traits.Brightness", "action.devices.traits.ColorSetting"}, device.device.Traits)
+	assert.Equal(t, "rgb", device.device.Attributes.ColorModel)
+	assert.Equal(t, config.SyncColorTemperatureRange{TemperatureMinK: 2703, TemperatureMaxK: 6494}, device.device.Attributes.ColorTemperatureRange)
+	assert.Equal(t, `{"state":"ON","brightness":{{ scale .Params.brightness 0 100 0 255 | round }}}`, device.device.Commands["action.devices.commands.BrightnessAbsolute"].Template)
+	assert.Contains(t, device.device.States, "color.spectrumRgb")
+	assert.Contains(t, device.device.States, "color.temperatureK")
+}
+
+func TestHomeassistantColorTemperatureRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      homeassistantConfig
+		expected config.SyncColorTemperatureRange
+	}{
+		{"Mireds of the light", homeassistantConfig{"min_mireds": 154.0, "max_mireds": 370.0}, config.SyncColorTemperatureRange{TemperatureMinK: 2703, TemperatureMaxK: 6494}},
+		{"Default mireds", homeassistantConfig{}, config.SyncColorTemperatureRange{TemperatureMinK: 2000, TemperatureMaxK: 6536}},
+		{"Zero mireds fall back on the defaults", homeassistantConfig{"min_mireds": 0.0, "max_mireds": 0.0}, config.SyncColorTemperatureRange{TemperatureMinK: 2000, TemperatureMaxK: 6536}},
+		{"Negative mireds fall back on the defaults", homeassistantConfig{"min_mireds": -1.0, "max_mireds": 370.0}, config.SyncColorTemperatureRange{TemperatureMinK: 2703, TemperatureMaxK: 6536}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, homeassistantColorTemperatureRange(test.cfg))
+		})
+	}
+}
+
+func TestParseHomeassistantPayloadsAreLiterals(t *testing.T) {
+	device, ok, err := parseHomeassistantConfig("homeassistant", "homeassistant/switch/plug/config",
+		[]byte(`{"name":"Plug","cmd_t":"plug/set","pl_on":"{{ .Config }}","pl_off":"}}"}`))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	message := executeTemplate(t, device.device.Commands["action.devices.commands.OnOff"].Template, map[string]interface{}{"on": true})
+
+	assert.Equal(t, "{{ .Config }}", message)
+}
+
+// executeTemplate renders the command template with the params
+func executeTemplate(t *testing.T, text string, params map[string]interface{}) string {
+	tmpl, err := template.New("command").Parse(text)
+	require.NoError(t, err)
+	var message strings.Builder
+	require.NoError(t, tmpl.Execute(&message, map[string]interface{}{"Params": params}))
+	return message.String()
+}
+
+func TestParseValueTemplate(t *testing.T) {
+	tests := []struct {
+		template      string
+		expectedField string
+		expectedOk    bool
+	}{
+		{template: "{{ value }}", expectedField: "value", expectedOk: true},
+		{template: "{{value_json.POWER}}", expectedField: "POWER", expectedOk: true},
+		{template: "{{ value_json.sensor.temperature | float }}", expectedField: "sensor.temperature", expectedOk: true},
+		{template: `{{ value_json['state'] }}`, expectedField: "state", expectedOk: true},
+		{template: `{{ value_json["ENERGY"].Power | round(1) }}`, expectedField: "ENERGY.Power", expectedOk: true},
+		{template: "{{ value_json }}", expectedOk: false},
+		{template: "{% if value_json.on %}ON{% endif %}", expectedOk: false},
+		{template: "{{ value_json.state == 'on' }}", expectedOk: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			field, ok := parseValueTemplate(test.template)
+
+			assert.Equal(t, test.expectedOk, ok)
+			assert.Equal(t, test.expectedField, field)
+		})
+	}
+}
+
+func TestHomeassistantDiscoveryRemove(t *testing.T) {
+	listener := &discoveryListenerMock{devices: map[string]config.DeviceConfig{}}
+	discovery := newHomeassistantDiscovery("homeassistant", config.DiscoverySource{Exclude: []string{"Garage*"}}, listener)
+
+	discovery.handle("homeassistant/lock/door/config", []byte(`{"name":"Door","cmd_t":"door/set","stat_t":"door/state"}`))
+	discovery.handle("homeassistant/lock/garage/config", []byte(`{"name":"Garage door","cmd_t":"garage/set","stat_t":"garage/state"}`))
+
+	assert.Equal(t, []string{"lock_door"}, keys(listener.devices))
+	assert.Equal(t, map[string]config.StateMapping{
+		"isLocked": {Field: "value", Values: map[string]interface{}{"LOCKED": true, "UNLOCKED": false}},
+	}, listener.devices["lock_door"].States)
+
+	discovery.handle("homeassistant/lock/door/config", []byte{})
+
+	assert.Empty(t, listener.devices)
+}
@@ -1,10 +1,16 @@
 package mqtt
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/mrlauy/ghome-mqtt/config"
 	log "log/slog"
+	"net/http"
+	"slices"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -13,73 +19,350 @@ import (
 var publishTimeout = 1 * time.Second
 
 type Mqtt struct {
-	client mqtt.Client
+	client             mqtt.Client
+	mutex              sync.Mutex
+	listeners          map[string][]stateListener
+	routes             map[string]mqtt.MessageHandler // subscriptions besides the state listeners, e.g. discovery
+	connectionListener func(connected bool)
+	baseTopic          string
+	statusTopic        string
+	eventTopic         string
+	info               *BridgeInfo // published again after a reconnect
+	queue              *queue      // messages that couldn't be published, nil when the queue is disabled
+}
+
+type stateListener struct {
+	device   string
+	qos      byte
+	callback func(string, map[string]interface{})
 }
 
 func NewMqtt(cfg config.MqttConfig) (*Mqtt, error) {
+	m := &Mqtt{
+		baseTopic:   baseTopic(cfg.BaseTopic),
+		statusTopic: statusTopic(baseTopic(cfg.BaseTopic), cfg.StatusTopic),
+		eventTopic:  eventTopic(baseTopic(cfg.BaseTopic), cfg.EventTopic),
+	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", cfg.Host, cfg.Port))
-	opts.SetClientID("ghome-client")
+	opts.SetClientID(clientId(cfg))
 	opts.SetUsername(cfg.Username)
 	opts.SetPassword(cfg.Password)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(cfg.MaxReconnectInterval)
+	if cfg.KeepAlive > 0 {
+		opts.SetKeepAlive(cfg.KeepAlive)
+	}
+	opts.SetWill(m.statusTopic, offline, 1, true)
 
-	if cfg.Tls {
-		return nil, fmt.Errorf("TLS not yet supported")
+	brokers := brokerUrls(cfg)
+	for _, broker := range brokers {
+		opts.AddBroker(broker)
+	}
+	if cfg.Tls || slices.ContainsFunc(brokers, isSecure) {
+		tlsConfig, err := newTlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if len(cfg.Headers) > 0 {
+		headers := http.Header{}
+		for name, value := range cfg.Headers {
+			headers.Set(name, value)
+		}
+		opts.SetHTTPHeaders(headers)
 	}
 
 	opts.SetDefaultPublishHandler(messagePubHandler)
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = connectLostHandler
+	opts.OnConnect = m.onConnect
+	opts.OnConnectionLost = m.onConnectionLost
+	opts.OnReconnecting = reconnectingHandler
 
-	client := mqtt.NewClient(opts)
+	if cfg.ProtocolVersion == 5 {
+		m.client = newClient5(opts, cfg, responseTopic(m.baseTopic, opts.ClientID))
+	} else {
+		opts.SetProtocolVersion(uint(cfg.ProtocolVersion))
+		m.client = mqtt.NewClient(opts)
+	}
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
 		return nil, token.Error()
 	}
 
-	return &Mqtt{
-		client: client,
-	}, nil
+	if cfg.QueueSize > 0 {
+		m.queue = newQueue(cfg)
+		go m.queue.run(m.sendQueued)
+	}
+	return m, nil
 }
 
-func (m *Mqtt) RegisterStateChangeListener(device string, topic string, callback func(string, map[string]interface{})) error {
-	log.Info("subscribe to topic", "device", device, "topic", topic)
-	callbackHandler := func(client mqtt.Client, msg mqtt.Message) {
-		log.Info("message published", "device", device, "topic", msg.Topic(), "message", msg.Payload())
+// clientId returns the configured client id, or a random one so bridges on the same broker don't disconnect each other
+func clientId(cfg config.MqttConfig) string {
+	if cfg.ClientId != "" {
+		return cfg.ClientId
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return "ghome-mqtt-" + hex.EncodeToString(suffix)
+}
 
-		payload := make(map[string]interface{})
-		err := json.Unmarshal(msg.Payload(), &payload)
-		if err != nil {
-			log.Error("fail to marshal incoming message", "device", device, "topic", topic, err)
-			return
+// OnConnectionChange calls the listener when the connection to the broker is lost and when it's restored
+func (m *Mqtt) OnConnectionChange(listener func(connected bool)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.connectionListener = listener
+}
+
+// onConnect publishes the bridge is online and resubscribes the topics of all listeners and routes,
+// the clean session of a reconnect has no subscriptions
+func (m *Mqtt) onConnect(client mqtt.Client) {
+	m.mutex.Lock()
+	subscriptions := map[string]mqtt.MessageHandler{}
+	qos := map[string]byte{}
+	for topic := range m.listeners {
+		subscriptions[topic] = m.dispatch(topic)
+		qos[topic] = m.listenerQos(topic)
+	}
+	for topic, handler := range m.routes {
+		subscriptions[topic] = handler
+	}
+	listener := m.connectionListener
+	info := m.info
+	m.mutex.Unlock()
+
+	log.Info("mqtt client connected", "subscriptions", len(subscriptions))
+	m.Publish(m.statusTopic, online, 1, true)
+	if info != nil {
+		m.publishBridgeInfo(*info)
+	}
+	for _, topic := range sortedTopics(subscriptions) {
+		if token := client.Subscribe(topic, qos[topic], subscriptions[topic]); token.Wait() && token.Error() != nil {
+			log.Error("failed to resubscribe", "topic", topic, "error", token.Error())
 		}
+	}
+
+	if listener != nil {
+		listener(true)
+	}
+	if m.queue != nil {
+		m.queue.signal()
+	}
+}
+
+func (m *Mqtt) onConnectionLost(client mqtt.Client, err error) {
+	log.Warn("mqtt client connection lost", "error", err)
+
+	m.mutex.Lock()
+	listener := m.connectionListener
+	m.mutex.Unlock()
+	if listener != nil {
+		listener(false)
+	}
+}
+
+func sortedTopics(subscriptions map[string]mqtt.MessageHandler) []string {
+	topics := make([]string, 0, len(subscriptions))
+	for topic := range subscriptions {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// subscribe subscribes the handler to the topic, the topic is resubscribed after a reconnect
+func (m *Mqtt) subscribe(topic string, handler mqtt.MessageHandler) error {
+	m.mutex.Lock()
+	if m.routes == nil {
+		m.routes = map[string]mqtt.MessageHandler{}
+	}
+	m.routes[topic] = handler
+	m.mutex.Unlock()
+
+	if token := m.client.Subscribe(topic, 0, handler); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to subscribe to %s: %v", topic, token.Error())
+	}
+	return nil
+}
+
+// RegisterStateChangeListener subscribes the device to the topic, devices can share a topic.
+// A shared topic is subscribed with the highest qos of its devices.
+func (m *Mqtt) RegisterStateChangeListener(device string, topic string, qos byte, callback func(string, map[string]interface{})) error {
+	log.Info("subscribe to topic", "device", device, "topic", topic, "qos", qos)
+
+	m.mutex.Lock()
+	if m.listeners == nil {
+		m.listeners = map[string][]stateListener{}
+	}
+	subscribed := len(m.listeners[topic]) > 0
+	upgrade := subscribed && qos > m.listenerQos(topic)
+	m.listeners[topic] = append(m.listeners[topic], stateListener{device: device, qos: qos, callback: callback})
+	m.mutex.Unlock()
+
+	if subscribed && !upgrade {
+		return nil
+	}
+
+	if token := m.client.Subscribe(topic, qos, m.dispatch(topic)); token.Wait() && token.Error() != nil {
+		log.Error("failed to subscribe", "device", device, "topic", topic, "error", token.Error())
+		m.RemoveStateChangeListener(device, topic)
+		return token.Error()
+	}
+	return nil
+}
 
-		callback(device, payload)
+// RemoveStateChangeListener removes the device from the topic, unsubscribes when no device is left
+func (m *Mqtt) RemoveStateChangeListener(device string, topic string) error {
+	m.mutex.Lock()
+	listeners := slices.DeleteFunc(m.listeners[topic], func(listener stateListener) bool {
+		return listener.device == device
+	})
+	if len(listeners) > 0 {
+		m.listeners[topic] = listeners
+		m.mutex.Unlock()
+		return nil
 	}
+	delete(m.listeners, topic)
+	m.mutex.Unlock()
 
-	if token := m.client.Subscribe(topic, 0, callbackHandler); token.Wait() && token.Error() != nil {
-		log.Error("failed to subscribe", "device", device, "topic", topic, token.Error())
+	log.Info("unsubscribe from topic", "device", device, "topic", topic)
+	if token := m.client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 	return nil
 }
 
+// listenerQos is the highest qos of the devices listening to the topic, the caller holds the mutex
+func (m *Mqtt) listenerQos(topic string) byte {
+	var qos byte
+	for _, listener := range m.listeners[topic] {
+		qos = max(qos, listener.qos)
+	}
+	return qos
+}
+
+// dispatch passes the messages of a subscription to all devices listening to it
+func (m *Mqtt) dispatch(topic string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		m.mutex.Lock()
+		listeners := slices.Clone(m.listeners[topic])
+		m.mutex.Unlock()
+
+		for _, listener := range listeners {
+			log.Info("message published", "device", listener.device, "topic", msg.Topic(), "message", msg.Payload())
+			listener.callback(listener.device, parsePayload(msg.Payload()))
+		}
+	}
+}
+
+// parsePayload decodes a json object payload, other payloads like `ON` or `21.5` are available as `value`
+func parsePayload(message []byte) map[string]interface{} {
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(message, &payload); err == nil {
+		return payload
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(message, &value); err != nil {
+		value = string(message)
+	}
+	return map[string]interface{}{"value": value}
+}
+
+// requester is a client that supports request/response, only the MQTT 5 client does
+type requester interface {
+	request(ctx context.Context, topic string, payload []byte) ([]byte, error)
+}
+
+// CanRequest returns whether the client supports Request
+func (m *Mqtt) CanRequest() bool {
+	_, ok := m.client.(requester)
+	return ok
+}
+
+// Request publishes the message with a response topic and correlation data and waits for the response, this needs MQTT 5
+func (m *Mqtt) Request(topic string, message string, timeout time.Duration) (map[string]interface{}, error) {
+	client, ok := m.client.(requester)
+	if !ok {
+		return nil, fmt.Errorf("request/response needs protocolVersion 5")
+	}
+
+	log.Info("send mqtt request", "topic", topic, "message", message)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	response, err := client.request(ctx, topic, []byte(message))
+	if err != nil {
+		return nil, err
+	}
+	return parsePayload(response), nil
+}
+
 func (m *Mqtt) SendMessage(topic string, message string) {
-	log.Info("send mqtt message", "topic", topic, "message", message)
-	token := m.client.Publish(topic, 0, false, message)
+	m.Publish(topic, message, 0, false)
+}
+
+// Publish sends the message best-effort, it's lost when the broker can't be reached
+func (m *Mqtt) Publish(topic string, message string, qos byte, retain bool) error {
+	log.Info("send mqtt message", "topic", topic, "message", message, "qos", qos, "retain", retain)
+	err := m.send(topic, message, qos, retain)
+	if err != nil {
+		log.Error("failed to publish message", "topic", topic, "message", message, "error", err)
+	}
+	return err
+}
+
+// PublishCommand sends the command, when the broker can't be reached it's queued to be sent later.
+// It returns whether the command is queued, and an error when the command is lost.
+func (m *Mqtt) PublishCommand(topic string, message string, qos byte, retain bool) (bool, error) {
+	log.Info("send mqtt command", "topic", topic, "message", message, "qos", qos, "retain", retain)
+	// commands wait behind the queued commands to keep them in order
+	if m.queue == nil || m.queue.depth() == 0 {
+		err := m.send(topic, message, qos, retain)
+		if err == nil {
+			return false, nil
+		}
+		if m.queue == nil {
+			log.Error("failed to publish command", "topic", topic, "message", message, "error", err)
+			return false, err
+		}
+		log.Warn("failed to publish command, queue it", "topic", topic, "message", message, "error", err)
+	}
+
+	if err := m.queue.add(topic, message, qos, retain); err != nil {
+		log.Error("failed to queue command", "topic", topic, "message", message, "error", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// send publishes the message and waits for the broker up to the publish timeout
+func (m *Mqtt) send(topic string, message string, qos byte, retain bool) error {
+	if !m.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to the broker")
+	}
+	token := m.client.Publish(topic, qos, retain, message)
 	if !token.WaitTimeout(publishTimeout) {
-		log.Error("failed to publish message due to timeout", "topic", topic, "message", message, "token-error", token.Error())
+		return fmt.Errorf("publish timed out after %s", publishTimeout)
 	}
+	return token.Error()
 }
 
-var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Info("received message", "topic", msg.Topic(), "message", msg.Payload())
+func (m *Mqtt) sendQueued(message queuedMessage) error {
+	return m.send(message.topic, message.message, message.qos, message.retain)
 }
 
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	log.Debug("mqtt client connected")
+// QueueDepth returns the number of messages waiting to be sent
+func (m *Mqtt) QueueDepth() int {
+	if m.queue == nil {
+		return 0
+	}
+	return m.queue.depth()
+}
+
+var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	log.Info("received message", "topic", msg.Topic(), "message", msg.Payload())
 }
 
-var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
-	log.Debug("mqtt client connect lost", err)
+var reconnectingHandler mqtt.ReconnectHandler = func(client mqtt.Client, opts *mqtt.ClientOptions) {
+	log.Info("mqtt client reconnecting")
 }
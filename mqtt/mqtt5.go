@@ -0,0 +1,383 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// timeout5 is how long a subscribe, unsubscribe or acknowledged publish of the MQTT 5 client takes at most
+var timeout5 = 10 * time.Second
+
+// maxReconnectDelay5 caps the reconnect delay, the MQTT 5 client waits the same delay before every attempt
+const maxReconnectDelay5 = 10 * time.Second
+
+// client5 is the MQTT 5 client behind the interface of the MQTT 3 client, so the bridge works the same on both.
+// Publishes carry the configured user properties, and the messages that aren't retained the message expiry.
+type client5 struct {
+	cfg              autopaho.ClientConfig
+	router           *paho.StandardRouter
+	userProperties   paho.UserProperties
+	messageExpiry    *uint32
+	responseTopic    string // topic the responses of requests are published on
+	onConnect        mqtt.OnConnectHandler
+	onConnectionLost mqtt.ConnectionLostHandler
+
+	mutex     sync.Mutex
+	manager   *autopaho.ConnectionManager
+	stop      context.CancelFunc // stops the connection manager
+	connected bool
+	requests  map[string]chan []byte // pending requests by correlation data
+}
+
+// newClient5 creates an MQTT 5 client with the same options as the MQTT 3 client
+func newClient5(opts *mqtt.ClientOptions, cfg config.MqttConfig, responseTopic string) *client5 {
+	c := &client5{
+		router:           paho.NewStandardRouter(),
+		responseTopic:    responseTopic,
+		onConnect:        opts.OnConnect,
+		onConnectionLost: opts.OnConnectionLost,
+		requests:         map[string]chan []byte{},
+	}
+	for name, value := range cfg.UserProperties {
+		c.userProperties.Add(name, value)
+	}
+	if cfg.MessageExpiry > 0 {
+		expiry := uint32(cfg.MessageExpiry.Seconds())
+		c.messageExpiry = &expiry
+	}
+	if opts.DefaultPublishHandler != nil {
+		c.router.DefaultHandler(c.handler(opts.DefaultPublishHandler))
+	}
+	c.router.RegisterHandler(responseTopic, c.handleResponse)
+
+	c.cfg = autopaho.ClientConfig{
+		ServerUrls:                    opts.Servers,
+		TlsCfg:                        opts.TLSConfig,
+		KeepAlive:                     uint16(opts.KeepAlive),
+		CleanStartOnInitialConnection: opts.CleanSession,
+		ConnectRetryDelay:             min(opts.MaxReconnectInterval, maxReconnectDelay5),
+		ConnectUsername:               opts.Username,
+		ConnectPassword:               []byte(opts.Password),
+		OnConnectionUp:                c.connectionUp,
+		ClientConfig: paho.ClientConfig{
+			ClientID: opts.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(received paho.PublishReceived) (bool, error) {
+					c.router.Route(received.Packet.Packet())
+					return true, nil
+				},
+			},
+			OnClientError: c.connectionDown,
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				c.connectionDown(fmt.Errorf("disconnected by the broker with reason %d", disconnect.ReasonCode))
+			},
+		},
+	}
+	if len(opts.HTTPHeaders) > 0 {
+		c.cfg.WebSocketCfg = &autopaho.WebSocketConfig{
+			Header: func(*url.URL, *tls.Config) http.Header { return opts.HTTPHeaders },
+		}
+	}
+	if opts.WillEnabled {
+		c.cfg.SetWillMessage(opts.WillTopic, opts.WillPayload, opts.WillQos, opts.WillRetained)
+	}
+	return c
+}
+
+// connectionUp subscribes the response topic before the bridge resubscribes its own topics
+func (c *client5) connectionUp(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+	c.mutex.Lock()
+	c.connected = true
+	c.mutex.Unlock()
+
+	subscribe := &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: c.responseTopic, QoS: 1}}}
+	if _, err := c.call(func(ctx context.Context) (interface{}, error) { return manager.Subscribe(ctx, subscribe) }); err != nil {
+		log.Error("failed to subscribe to the response topic", "topic", c.responseTopic, "error", err)
+	}
+	if c.onConnect != nil {
+		c.onConnect(c)
+	}
+}
+
+func (c *client5) connectionDown(err error) {
+	c.mutex.Lock()
+	connected := c.connected
+	c.connected = false
+	c.mutex.Unlock()
+
+	if connected && c.onConnectionLost != nil {
+		c.onConnectionLost(c, err)
+	}
+}
+
+// Connect returns an error when none of the brokers accept the first connection, later connections are retried
+func (c *client5) Connect() mqtt.Token {
+	return newToken5(func() error {
+		attempts := make(chan error, len(c.cfg.ServerUrls))
+		cfg := c.cfg
+		cfg.OnConnectError = func(err error) {
+			log.Warn("mqtt client failed to connect", "error", err)
+			select {
+			case attempts <- err:
+			default:
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		manager, err := autopaho.NewConnection(ctx, cfg)
+		if err != nil {
+			cancel()
+			return err
+		}
+		c.mutex.Lock()
+		c.manager = manager
+		c.stop = cancel
+		c.mutex.Unlock()
+
+		connected := make(chan error, 1)
+		go func() { connected <- manager.AwaitConnection(ctx) }()
+		for range c.cfg.ServerUrls {
+			select {
+			case err := <-connected:
+				return err
+			case err = <-attempts:
+			}
+		}
+		cancel()
+		return err
+	})
+}
+
+func (c *client5) Disconnect(quiesce uint) {
+	manager := c.connection()
+	if manager == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	_ = manager.Disconnect(ctx)
+	c.stop()
+	c.connectionDown(nil)
+}
+
+func (c *client5) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+func (c *client5) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+func (c *client5) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	publish := &paho.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retained,
+		Payload:    payloadBytes(payload),
+		Properties: c.properties(retained),
+	}
+	return newToken5(func() error {
+		_, err := c.call(func(ctx context.Context) (interface{}, error) { return c.connection().Publish(ctx, publish) })
+		return err
+	})
+}
+
+func (c *client5) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *client5) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	subscribe := &paho.Subscribe{}
+	for topic, qos := range filters {
+		c.AddRoute(topic, callback)
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	return newToken5(func() error {
+		_, err := c.call(func(ctx context.Context) (interface{}, error) { return c.connection().Subscribe(ctx, subscribe) })
+		return err
+	})
+}
+
+func (c *client5) Unsubscribe(topics ...string) mqtt.Token {
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+	}
+	return newToken5(func() error {
+		_, err := c.call(func(ctx context.Context) (interface{}, error) {
+			return c.connection().Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		})
+		return err
+	})
+}
+
+// AddRoute replaces the handler of the topic, like the router of the MQTT 3 client
+func (c *client5) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.router.UnregisterHandler(topic)
+	c.router.RegisterHandler(topic, c.handler(callback))
+}
+
+func (c *client5) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// request publishes the payload with a response topic and correlation data and waits for the response
+func (c *client5) request(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	correlation := make([]byte, 8)
+	_, _ = rand.Read(correlation)
+	response := make(chan []byte, 1)
+
+	c.mutex.Lock()
+	c.requests[string(correlation)] = response
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.requests, string(correlation))
+		c.mutex.Unlock()
+	}()
+
+	properties := c.properties(false)
+	properties.ResponseTopic = c.responseTopic
+	properties.CorrelationData = correlation
+	publish := &paho.Publish{Topic: topic, QoS: 1, Payload: payload, Properties: properties}
+
+	manager := c.connection()
+	if manager == nil {
+		return nil, autopaho.ConnectionDownError
+	}
+	if _, err := manager.Publish(ctx, publish); err != nil {
+		return nil, err
+	}
+	select {
+	case data := <-response:
+		return data, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no response to the request on %s: %v", topic, ctx.Err())
+	}
+}
+
+func (c *client5) handleResponse(publish *paho.Publish) {
+	if publish.Properties == nil {
+		return
+	}
+	c.mutex.Lock()
+	response, ok := c.requests[string(publish.Properties.CorrelationData)]
+	c.mutex.Unlock()
+	if !ok {
+		log.Warn("received response without a pending request", "topic", publish.Topic)
+		return
+	}
+	select {
+	case response <- publish.Payload:
+	default:
+	}
+}
+
+func (c *client5) properties(retained bool) *paho.PublishProperties {
+	properties := &paho.PublishProperties{User: c.userProperties}
+	if !retained {
+		properties.MessageExpiry = c.messageExpiry
+	}
+	return properties
+}
+
+func (c *client5) handler(callback mqtt.MessageHandler) paho.MessageHandler {
+	return func(publish *paho.Publish) {
+		callback(c, &message5{publish: publish})
+	}
+}
+
+func (c *client5) connection() *autopaho.ConnectionManager {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.manager
+}
+
+// call runs the operation on the connection with a timeout, it fails right away without a connection
+func (c *client5) call(operation func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if c.connection() == nil {
+		return nil, autopaho.ConnectionDownError
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout5)
+	defer cancel()
+	return operation(ctx)
+}
+
+func payloadBytes(payload interface{}) []byte {
+	switch value := payload.(type) {
+	case []byte:
+		return value
+	case string:
+		return []byte(value)
+	default:
+		return []byte(fmt.Sprint(value))
+	}
+}
+
+// token5 completes when the operation of the MQTT 5 client is done
+type token5 struct {
+	done chan struct{}
+	err  error
+}
+
+func newToken5(operation func() error) *token5 {
+	t := &token5{done: make(chan struct{})}
+	go func() {
+		t.err = operation()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *token5) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *token5) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *token5) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *token5) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// message5 is a message received by the MQTT 5 client
+type message5 struct {
+	publish *paho.Publish
+}
+
+func (m *message5) Duplicate() bool   { return m.publish.Duplicate() }
+func (m *message5) Qos() byte         { return m.publish.QoS }
+func (m *message5) Retained() bool    { return m.publish.Retain }
+func (m *message5) Topic() string     { return m.publish.Topic }
+func (m *message5) MessageID() uint16 { return m.publish.PacketID }
+func (m *message5) Payload() []byte   { return m.publish.Payload }
+func (m *message5) Ack()              {}
@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMqtt5(t *testing.T) {
+	broker, url := newBroker(t)
+	commands := make(chan packets.Packet, 1)
+	require.NoError(t, broker.Subscribe("zigbee2mqtt/lamp/set", 1, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		commands <- pk
+	}))
+	require.NoError(t, broker.Subscribe("zigbee2mqtt/lamp/get", 2, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		go broker.InjectPacket(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish},
+			TopicName:   pk.Properties.ResponseTopic,
+			Payload:     []byte(`{"state":"ON"}`),
+			Properties:  packets.Properties{CorrelationData: pk.Properties.CorrelationData},
+		})
+	}))
+
+	m, err := NewMqtt(config.MqttConfig{
+		Brokers:         []string{url},
+		ClientId:        "bridge",
+		ProtocolVersion: 5,
+		UserProperties:  map[string]string{"source": "ghome"},
+		MessageExpiry:   time.Minute,
+	})
+	require.NoError(t, err)
+	defer m.Close()
+
+	states := make(chan map[string]interface{}, 1)
+	require.NoError(t, m.RegisterStateChangeListener("lamp", "zigbee2mqtt/+", 1, func(device string, payload map[string]interface{}) {
+		states <- payload
+	}))
+	require.NoError(t, broker.Publish("zigbee2mqtt/lamp", []byte(`{"state":"OFF"}`), false, 0))
+	assert.Equal(t, map[string]interface{}{"state": "OFF"}, receive(t, states))
+
+	m.Publish("zigbee2mqtt/lamp/set", `{"state":"ON"}`, 1, false)
+	command := receive(t, commands)
+	assert.Equal(t, `{"state":"ON"}`, string(command.Payload))
+	assert.Equal(t, []packets.UserProperty{{Key: "source", Val: "ghome"}}, command.Properties.User)
+	assert.Equal(t, uint32(60), command.Properties.MessageExpiryInterval)
+
+	assert.True(t, m.CanRequest())
+	response, err := m.Request("zigbee2mqtt/lamp/get", `{"state":""}`, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"state": "ON"}, response)
+}
+
+func TestRequestNeedsMqtt5(t *testing.T) {
+	m := Mqtt{client: &mqttClientMock{}}
+
+	assert.False(t, m.CanRequest())
+	_, err := m.Request("zigbee2mqtt/lamp/get", `{"state":""}`, time.Second)
+
+	assert.EqualError(t, err, "request/response needs protocolVersion 5")
+}
+
+// newBroker starts an MQTT broker on a free port and returns its url
+func newBroker(t *testing.T) (*server.Server, string) {
+	broker := server.New(&server.Options{InlineClient: true})
+	require.NoError(t, broker.AddHook(new(auth.AllowHook), nil))
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	require.NoError(t, broker.AddListener(listener))
+	require.NoError(t, broker.Serve())
+	t.Cleanup(func() { _ = broker.Close() })
+	return broker, "tcp://" + listener.Address()
+}
+
+func receive[V any](t *testing.T, values chan V) V {
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(time.Second):
+		t.Fatal("nothing received")
+		var value V
+		return value
+	}
+}
@@ -1,8 +1,16 @@
 package mqtt
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
 	"testing"
 
+	"github.com/mrlauy/ghome-mqtt/config"
+
+	"github.com/stretchr/testify/assert"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
@@ -14,22 +22,168 @@ func TestSendMessage(t *testing.T) {
 	mqtt.SendMessage("device/test", `{"state":"on"}`)
 }
 
+func TestSharedSubscription(t *testing.T) {
+	client := &mqttClientMock{subscriptions: map[string]mqtt.MessageHandler{}}
+	m := Mqtt{client: client}
+
+	states := map[string]map[string]interface{}{}
+	callback := func(device string, payload map[string]interface{}) {
+		states[device] = payload
+	}
+	assert.NoError(t, m.RegisterStateChangeListener("left", "zigbee2mqtt/switch", 0, callback))
+	assert.NoError(t, m.RegisterStateChangeListener("right", "zigbee2mqtt/switch", 0, callback))
+	assert.Len(t, client.subscriptions, 1)
+
+	client.subscriptions["zigbee2mqtt/switch"](client, &messageMock{topic: "zigbee2mqtt/switch", payload: []byte(`{"state_left":"ON"}`)})
+	assert.Equal(t, map[string]map[string]interface{}{
+		"left":  {"state_left": "ON"},
+		"right": {"state_left": "ON"},
+	}, states)
+
+	assert.NoError(t, m.RemoveStateChangeListener("left", "zigbee2mqtt/switch"))
+	assert.Len(t, client.subscriptions, 1)
+	assert.NoError(t, m.RemoveStateChangeListener("right", "zigbee2mqtt/switch"))
+	assert.Empty(t, client.subscriptions)
+}
+
+func TestResubscribeOnConnect(t *testing.T) {
+	client := &mqttClientMock{subscriptions: map[string]mqtt.MessageHandler{}}
+	m := Mqtt{client: client}
+	var connected []bool
+	m.OnConnectionChange(func(value bool) { connected = append(connected, value) })
+
+	callback := func(device string, payload map[string]interface{}) {}
+	assert.NoError(t, m.RegisterStateChangeListener("lamp", "zigbee2mqtt/lamp", 0, callback))
+	assert.NoError(t, m.RegisterStateChangeListener("plug", "zigbee2mqtt/plug", 0, callback))
+	assert.NoError(t, m.subscribe("zigbee2mqtt/bridge/devices", func(client mqtt.Client, msg mqtt.Message) {}))
+
+	m.onConnectionLost(client, errors.New("broker gone"))
+	client.subscriptions = map[string]mqtt.MessageHandler{}
+	m.onConnect(client)
+
+	assert.Len(t, client.subscriptions, 3)
+	assert.Contains(t, client.subscriptions, "zigbee2mqtt/lamp")
+	assert.Contains(t, client.subscriptions, "zigbee2mqtt/plug")
+	assert.Contains(t, client.subscriptions, "zigbee2mqtt/bridge/devices")
+	assert.Equal(t, []bool{false, true}, connected)
+}
+
+func TestSubscriptionQos(t *testing.T) {
+	client := &mqttClientMock{subscriptions: map[string]mqtt.MessageHandler{}}
+	m := Mqtt{client: client}
+
+	callback := func(device string, payload map[string]interface{}) {}
+	assert.NoError(t, m.RegisterStateChangeListener("left", "zigbee2mqtt/switch", 0, callback))
+	assert.NoError(t, m.RegisterStateChangeListener("right", "zigbee2mqtt/switch", 1, callback))
+	assert.NoError(t, m.RegisterStateChangeListener("other", "zigbee2mqtt/switch", 0, callback))
+	assert.Equal(t, []subscription{{"zigbee2mqtt/switch", 0}, {"zigbee2mqtt/switch", 1}}, client.subscribed)
+
+	client.subscribed = nil
+	m.onConnect(client)
+	assert.Equal(t, []subscription{{"zigbee2mqtt/switch", 1}}, client.subscribed)
+}
+
+func TestClientId(t *testing.T) {
+	assert.Equal(t, "bridge", clientId(config.MqttConfig{ClientId: "bridge"}))
+
+	generated := clientId(config.MqttConfig{})
+	assert.Regexp(t, `^ghome-mqtt-[0-9a-f]{8}$`, generated)
+	assert.NotEqual(t, generated, clientId(config.MqttConfig{}))
+}
+
 type mqttClientMock struct {
+	mutex         sync.Mutex
+	disconnected  bool
+	subscriptions map[string]mqtt.MessageHandler
+	subscribed    []subscription
+	published     []publishedMessage
+}
+
+type subscription struct {
+	topic string
+	qos   byte
+}
+
+type publishedMessage struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
 }
 
 func (m *mqttClientMock) IsConnected() bool       { return true }
-func (m *mqttClientMock) IsConnectionOpen() bool  { return true }
+func (m *mqttClientMock) IsConnectionOpen() bool  { return !m.disconnected }
 func (m *mqttClientMock) Connect() mqtt.Token     { return &mqtt.DummyToken{} }
 func (m *mqttClientMock) Disconnect(quiesce uint) {}
 func (m *mqttClientMock) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.published = append(m.published, publishedMessage{topic: topic, payload: fmt.Sprint(payload), qos: qos, retain: retained})
 	return &mqtt.DummyToken{}
 }
+func (m *mqttClientMock) publishedMessages() []publishedMessage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return slices.Clone(m.published)
+}
 func (m *mqttClientMock) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	if m.subscriptions != nil {
+		m.subscriptions[topic] = callback
+	}
+	m.subscribed = append(m.subscribed, subscription{topic: topic, qos: qos})
 	return &mqtt.DummyToken{}
 }
 func (m *mqttClientMock) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
 	return &mqtt.DummyToken{}
 }
-func (m *mqttClientMock) Unsubscribe(topics ...string) mqtt.Token             { return &mqtt.DummyToken{} }
+func (m *mqttClientMock) Unsubscribe(topics ...string) mqtt.Token {
+	for _, topic := range topics {
+		delete(m.subscriptions, topic)
+	}
+	return &mqtt.DummyToken{}
+}
 func (m *mqttClientMock) AddRoute(topic string, callback mqtt.MessageHandler) {}
 func (m *mqttClientMock) OptionsReader() mqtt.ClientOptionsReader             { return mqtt.ClientOptionsReader{} }
+
+type messageMock struct {
+	topic   string
+	payload []byte
+}
+
+func (m *messageMock) Duplicate() bool   { return false }
+func (m *messageMock) Qos() byte         { return 0 }
+func (m *messageMock) Retained() bool    { return false }
+func (m *messageMock) Topic() string     { return m.topic }
+func (m *messageMock) MessageID() uint16 { return 0 }
+func (m *messageMock) Payload() []byte   { return m.payload }
+func (m *messageMock) Ack()              {}
+
+func TestParsePayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		expected map[string]interface{}
+	}{
+		{
+			name:     "Json object",
+			message:  `{"state":"ON","brightness":254}`,
+			expected: map[string]interface{}{"state": "ON", "brightness": 254.0},
+		},
+		{
+			name:     "Plain text",
+			message:  `ON`,
+			expected: map[string]interface{}{"value": "ON"},
+		},
+		{
+			name:     "Json value",
+			message:  `21.5`,
+			expected: map[string]interface{}{"value": 21.5},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, parsePayload([]byte(test.message)))
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// queuedMessage is a message that couldn't be published, it's sent again until it expires
+type queuedMessage struct {
+	id      uint64
+	topic   string
+	message string
+	qos     byte
+	retain  bool
+	expires time.Time // zero when the message doesn't expire
+}
+
+// queue holds the messages that couldn't be published while the broker is gone, they're sent in order
+type queue struct {
+	mutex            sync.Mutex
+	messages         []queuedMessage
+	next             uint64 // id of the next message
+	size             int
+	expiry           time.Duration
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	wake             chan struct{}
+	stop             chan struct{}
+}
+
+func newQueue(cfg config.MqttConfig) *queue {
+	return &queue{
+		size:             cfg.QueueSize,
+		expiry:           cfg.QueueExpiry,
+		retryInterval:    cfg.RetryInterval,
+		maxRetryInterval: max(cfg.MaxRetryInterval, cfg.RetryInterval),
+		wake:             make(chan struct{}, 1),
+		stop:             make(chan struct{}),
+	}
+}
+
+// add queues the message, it fails when the queue is full
+func (q *queue) add(topic string, message string, qos byte, retain bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.dropExpired()
+	if len(q.messages) >= q.size {
+		return fmt.Errorf("queue is full, %d messages are waiting", len(q.messages))
+	}
+	q.next++
+	queued := queuedMessage{id: q.next, topic: topic, message: message, qos: qos, retain: retain}
+	if q.expiry > 0 {
+		queued.expires = time.Now().Add(q.expiry)
+	}
+	q.messages = append(q.messages, queued)
+	q.signal()
+	return nil
+}
+
+// signal wakes the queue to send the messages right away, e.g. after a reconnect
+func (q *queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// depth returns the number of messages waiting, without the expired messages
+func (q *queue) depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.dropExpired()
+	return len(q.messages)
+}
+
+// dropExpired removes the expired messages, the caller holds the mutex
+func (q *queue) dropExpired() {
+	now := time.Now()
+	q.messages = slices.DeleteFunc(q.messages, func(message queuedMessage) bool {
+		if message.expired(now) {
+			log.Warn("drop expired queued message", "topic", message.topic, "message", message.message)
+			return true
+		}
+		return false
+	})
+}
+
+func (m queuedMessage) expired(now time.Time) bool {
+	return !m.expires.IsZero() && now.After(m.expires)
+}
+
+// run sends the queued messages when it's woken, and retries with a backoff until they're sent.
+// Only the retries back off, a wake after a reconnect starts again from the retry interval.
+func (q *queue) run(send func(message queuedMessage) error) {
+	delay := q.retryInterval
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-q.wake:
+			delay = q.retryInterval
+		case <-retry:
+		case <-q.stop:
+			return
+		}
+
+		retry = nil
+		if err := q.flush(send); err != nil {
+			log.Warn("failed to send queued messages", "depth", q.depth(), "retry", delay, "error", err)
+			retry = time.After(delay)
+			delay = min(delay*2, q.maxRetryInterval)
+			continue
+		}
+		delay = q.retryInterval
+	}
+}
+
+// flush sends the queued messages in order until one fails, expired messages are dropped
+func (q *queue) flush(send func(message queuedMessage) error) error {
+	for {
+		q.mutex.Lock()
+		if len(q.messages) == 0 {
+			q.mutex.Unlock()
+			return nil
+		}
+		message := q.messages[0]
+		q.mutex.Unlock()
+
+		if message.expired(time.Now()) {
+			log.Warn("drop expired queued message", "topic", message.topic, "message", message.message)
+		} else if err := send(message); err != nil {
+			return err
+		}
+
+		// the message is already gone when it expired while it was sent
+		q.mutex.Lock()
+		if len(q.messages) > 0 && q.messages[0].id == message.id {
+			q.messages = q.messages[1:]
+		}
+		q.mutex.Unlock()
+	}
+}
+
+func (q *queue) close() {
+	close(q.stop)
+}
@@ -0,0 +1,121 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishQueued(t *testing.T) {
+	client := &mqttClientMock{disconnected: true}
+	m := Mqtt{client: client, queue: newQueue(config.MqttConfig{QueueSize: 2, QueueExpiry: time.Minute})}
+
+	queued, err := m.PublishCommand("zigbee2mqtt/lamp/set", `{"state":"ON"}`, 1, false)
+	require.NoError(t, err)
+	assert.True(t, queued)
+	client.disconnected = false
+	queued, err = m.PublishCommand("zigbee2mqtt/plug/set", `{"state":"OFF"}`, 0, false)
+	require.NoError(t, err)
+	assert.True(t, queued, "commands wait behind the queued commands")
+	_, err = m.PublishCommand("zigbee2mqtt/fan/set", `{"state":"ON"}`, 0, false)
+	assert.EqualError(t, err, "queue is full, 2 messages are waiting")
+	assert.Equal(t, 2, m.QueueDepth())
+	assert.Empty(t, client.published)
+
+	require.NoError(t, m.queue.flush(m.sendQueued))
+
+	assert.Equal(t, []publishedMessage{
+		{topic: "zigbee2mqtt/lamp/set", payload: `{"state":"ON"}`, qos: 1},
+		{topic: "zigbee2mqtt/plug/set", payload: `{"state":"OFF"}`},
+	}, client.published)
+	assert.Equal(t, 0, m.QueueDepth())
+	queued, err = m.PublishCommand("zigbee2mqtt/fan/set", `{"state":"ON"}`, 0, false)
+	require.NoError(t, err)
+	assert.False(t, queued)
+}
+
+func TestPublishNotQueued(t *testing.T) {
+	m := Mqtt{client: &mqttClientMock{disconnected: true}, queue: newQueue(config.MqttConfig{QueueSize: 2})}
+
+	err := m.Publish("ghome-mqtt/bridge/response/devices", `{"status":"ok"}`, 0, false)
+
+	assert.EqualError(t, err, "not connected to the broker")
+	assert.Equal(t, 0, m.QueueDepth())
+}
+
+func TestPublishWithoutQueue(t *testing.T) {
+	m := Mqtt{client: &mqttClientMock{disconnected: true}}
+
+	queued, err := m.PublishCommand("zigbee2mqtt/lamp/set", `{"state":"ON"}`, 0, false)
+
+	assert.False(t, queued)
+	assert.EqualError(t, err, "not connected to the broker")
+	assert.Equal(t, 0, m.QueueDepth())
+}
+
+func TestQueueExpiry(t *testing.T) {
+	q := newQueue(config.MqttConfig{QueueSize: 10, QueueExpiry: time.Millisecond})
+	require.NoError(t, q.add("zigbee2mqtt/lamp/set", `{"state":"ON"}`, 0, false))
+	time.Sleep(5 * time.Millisecond)
+
+	var sent []queuedMessage
+	require.NoError(t, q.flush(func(message queuedMessage) error {
+		sent = append(sent, message)
+		return nil
+	}))
+
+	assert.Empty(t, sent)
+	assert.Equal(t, 0, q.depth())
+}
+
+func TestQueueRetry(t *testing.T) {
+	q := newQueue(config.MqttConfig{QueueSize: 10, RetryInterval: time.Millisecond, MaxRetryInterval: 4 * time.Millisecond})
+	attempts := make(chan time.Time, 10)
+	go q.run(func(message queuedMessage) error {
+		attempts <- time.Now()
+		if len(attempts) < 3 {
+			return errors.New("not connected to the broker")
+		}
+		return nil
+	})
+	defer q.close()
+
+	require.NoError(t, q.add("zigbee2mqtt/lamp/set", `{"state":"ON"}`, 0, false))
+
+	assert.Eventually(t, func() bool { return q.depth() == 0 }, time.Second, time.Millisecond)
+	assert.Len(t, attempts, 3)
+}
+
+func TestQueueWakeResetsBackoff(t *testing.T) {
+	q := newQueue(config.MqttConfig{QueueSize: 10, RetryInterval: 10 * time.Millisecond, MaxRetryInterval: 10 * time.Second})
+	attempts := make(chan time.Time, 100)
+	go q.run(func(message queuedMessage) error {
+		attempts <- time.Now()
+		return errors.New("not connected to the broker")
+	})
+	defer q.close()
+
+	require.NoError(t, q.add("zigbee2mqtt/lamp/set", `{"state":"ON"}`, 0, false))
+	for i := 0; i < 5; i++ {
+		receive(t, attempts)
+	}
+
+	// the retries backed off to 160ms, the retry after the wake starts again from 10ms
+	q.signal()
+	woken := receive(t, attempts)
+	retried := receive(t, attempts)
+	assert.Less(t, retried.Sub(woken), 150*time.Millisecond)
+}
+
+func TestQueueDepthWithoutExpired(t *testing.T) {
+	q := newQueue(config.MqttConfig{QueueSize: 1, QueueExpiry: time.Millisecond})
+	require.NoError(t, q.add("zigbee2mqtt/lamp/set", `{"state":"ON"}`, 0, false))
+	time.Sleep(5 * time.Millisecond)
+
+	assert.Equal(t, 0, q.depth())
+	require.NoError(t, q.add("zigbee2mqtt/plug/set", `{"state":"ON"}`, 0, false), "expired messages don't fill the queue")
+}
@@ -0,0 +1,393 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	tasmotaTopic = "tasmota/discovery"
+
+	tasmotaRelay = 1
+	tasmotaLight = 2
+
+	// light subtypes of `lt_st`
+	tasmotaDimmer = 1
+	tasmotaCT     = 2
+	tasmotaRGB    = 3
+	tasmotaRGBW   = 4
+	tasmotaRGBCW  = 5
+)
+
+// tasmotaConfig is the retained message of a device on `tasmota/discovery/<mac>/config`
+type tasmotaConfig struct {
+	DeviceName    string         `json:"dn"`
+	FriendlyNames []*string      `json:"fn"`
+	Hostname      string         `json:"hn"`
+	Mac           string         `json:"mac"`
+	Model         string         `json:"md"`
+	Software      string         `json:"sw"`
+	Topic         string         `json:"t"`
+	FullTopic     string         `json:"ft"`
+	Prefixes      []string       `json:"tp"`
+	Relays        []int          `json:"rl"`
+	LightSubtype  int            `json:"lt_st"`
+	SetOptions    map[string]int `json:"so"`
+}
+
+// tasmotaSensors is the retained message of a device on `tasmota/discovery/<mac>/sensors`
+type tasmotaSensors struct {
+	Sensors map[string]interface{} `json:"sn"`
+}
+
+// DiscoverTasmota subscribes to the native discovery of Tasmota and passes the relays, lights and sensors to the listener
+func (m *Mqtt) DiscoverTasmota(source config.DiscoverySource, profiles map[string]config.DeviceConfig, listener DiscoveryListener) error {
+	prefix := source.Topic
+	if prefix == "" {
+		prefix = tasmotaTopic
+	}
+	discovery := newTasmotaDiscovery(source, profiles, listener)
+	callbackHandler := func(client mqtt.Client, msg mqtt.Message) {
+		topic, payload := msg.Topic(), msg.Payload()
+		discovery.dispatch(func() {
+			discovery.handle(topic, payload)
+		})
+	}
+
+	for _, topic := range []string{prefix + "/+/config", prefix + "/+/sensors"} {
+		log.Info("discover tasmota devices", "topic", topic)
+		if err := m.subscribe(topic, callbackHandler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tasmotaNode collects the config and sensors messages of a device, both are needed for the sensors
+type tasmotaNode struct {
+	config  *tasmotaConfig
+	sensors *tasmotaSensors
+	devices []string
+}
+
+type tasmotaDiscovery struct {
+	*discovery
+	profiles map[string]config.DeviceConfig
+	mutex    sync.Mutex
+	nodes    map[string]*tasmotaNode
+}
+
+func newTasmotaDiscovery(source config.DiscoverySource, profiles map[string]config.DeviceConfig, listener DiscoveryListener) *tasmotaDiscovery {
+	return &tasmotaDiscovery{
+		discovery: newDiscovery("tasmota", source, listener),
+		profiles:  profiles,
+		nodes:     map[string]*tasmotaNode{},
+	}
+}
+
+// handle updates the node of the message, an empty config message removes all devices of the node.
+// The listener is called without holding the mutex.
+func (d *tasmotaDiscovery) handle(topic string, payload []byte) {
+	mac := path.Base(path.Dir(topic))
+	discovered, previous, ok := d.updateNode(mac, topic, payload)
+	if !ok {
+		return
+	}
+
+	var ids []string
+	for _, device := range discovered {
+		if d.add(device) {
+			ids = append(ids, device.id)
+		}
+	}
+	for _, id := range previous {
+		if !slices.Contains(ids, id) {
+			d.remove(id)
+		}
+	}
+
+	d.mutex.Lock()
+	if node, ok := d.nodes[mac]; ok {
+		node.devices = ids
+	}
+	d.mutex.Unlock()
+}
+
+// updateNode stores the message in the node, it returns the devices of the node and the ids of the devices it had
+func (d *tasmotaDiscovery) updateNode(mac string, topic string, payload []byte) ([]discoveredDevice, []string, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	node, ok := d.nodes[mac]
+	if !ok {
+		node = &tasmotaNode{}
+		d.nodes[mac] = node
+	}
+
+	switch path.Base(topic) {
+	case "config":
+		node.config = nil
+		if len(payload) > 0 {
+			var cfg tasmotaConfig
+			if err := json.Unmarshal(payload, &cfg); err != nil {
+				log.Error("failed to parse tasmota config", "topic", topic, "error", err)
+				return nil, nil, false
+			}
+			node.config = &cfg
+		}
+	case "sensors":
+		node.sensors = nil
+		if len(payload) > 0 {
+			var sensors tasmotaSensors
+			if err := json.Unmarshal(payload, &sensors); err != nil {
+				log.Error("failed to parse tasmota sensors", "topic", topic, "error", err)
+				return nil, nil, false
+			}
+			node.sensors = &sensors
+		}
+	default:
+		return nil, nil, false
+	}
+
+	var discovered []discoveredDevice
+	if node.config != nil {
+		discovered = parseTasmotaDevices(d.profiles, *node.config, node.sensors)
+	}
+	if node.config == nil && node.sensors == nil {
+		delete(d.nodes, mac)
+	}
+	return discovered, node.devices, true
+}
+
+func parseTasmotaDevices(profiles map[string]config.DeviceConfig, cfg tasmotaConfig, sensors *tasmotaSensors) []discoveredDevice {
+	powers := 0
+	for _, relay := range cfg.Relays {
+		if relay != 0 {
+			powers++
+		}
+	}
+
+	var discovered []discoveredDevice
+	for index, relay := range cfg.Relays {
+		var profile, kind string
+		switch relay {
+		case tasmotaRelay:
+			profile, kind = "tasmota-relay", "RL"
+		case tasmotaLight:
+			profile, kind = "tasmota-dimmer", "LI"
+		default:
+			continue
+		}
+
+		device, err := config.ApplyProfile(config.DeviceConfig{
+			Profile:      profile,
+			FriendlyName: cfg.Topic,
+			Name:         cfg.friendlyName(index),
+			DeviceInfo: config.SyncDeviceInfo{
+				Manufacturer: "Tasmota",
+				Model:        cfg.Model,
+				SwVersion:    cfg.Software,
+			},
+		}, profiles)
+		if err != nil {
+			log.Error("failed to apply profile to tasmota device", "device", cfg.Topic, "error", err)
+			continue
+		}
+
+		power := "POWER"
+		if powers > 1 {
+			power = fmt.Sprintf("POWER%d", index+1)
+		}
+		device.Topic = cfg.commandTopic(power)
+		device.Subscription = cfg.statTopic("RESULT")
+		if cfg.SetOptions["4"] == 1 {
+			// SetOption4 publishes the result on a topic per command
+			device.Subscription = cfg.statTopic(power)
+			device.States["on"] = config.StateMapping{Field: "value", Values: map[string]interface{}{"ON": true, "OFF": false}}
+		} else {
+			device.States["on"] = config.StateMapping{Field: power, Values: map[string]interface{}{"ON": true, "OFF": false}}
+		}
+
+		if relay == tasmotaLight {
+			applyTasmotaLight(&device, cfg)
+		}
+
+		discovered = append(discovered, discoveredDevice{
+			id:     fmt.Sprintf("%s_%s_%d", cfg.Mac, kind, index+1),
+			name:   device.Name,
+			device: device,
+		})
+	}
+
+	if sensors != nil {
+		discovered = append(discovered, parseTasmotaSensors(cfg, *sensors)...)
+	}
+	return discovered
+}
+
+// applyTasmotaLight adjusts the dimmer profile to the light subtype, color commands use a backlog to pick the command
+func applyTasmotaLight(device *config.DeviceConfig, cfg tasmotaConfig) {
+	if cfg.SetOptions["4"] == 1 {
+		// results on topics per command aren't supported for lights
+		removeTrait(device, brightnessTrait, brightnessCommand, "brightness")
+		return
+	}
+
+	device.Commands[brightnessCommand] = config.CommandConfig{Topic: cfg.commandTopic("Dimmer"), Template: "{{ .Params.brightness }}"}
+	if cfg.LightSubtype < tasmotaDimmer {
+		removeTrait(device, brightnessTrait, brightnessCommand, "brightness")
+	}
+
+	rgb := cfg.LightSubtype >= tasmotaRGB
+	ct := cfg.LightSubtype == tasmotaCT || cfg.LightSubtype == tasmotaRGBCW
+	if !rgb && !ct {
+		return
+	}
+
+	device.Traits = append(device.Traits, colorSettingTrait)
+	backlog := config.CommandConfig{Topic: cfg.commandTopic("Backlog")}
+	switch {
+	case rgb && ct:
+		backlog.Template = "{{ if .Params.color.temperature }}CT {{ kelvinToMired .Params.color.temperature }}{{ else }}Color {{ spectrumToHex .Params.color.spectrumRGB }}{{ end }}"
+	case rgb:
+		backlog.Template = "Color {{ spectrumToHex .Params.color.spectrumRGB }}"
+	default:
+		backlog.Template = "CT {{ kelvinToMired .Params.color.temperature }}"
+	}
+	device.Commands[colorCommand] = backlog
+
+	if rgb {
+		device.Attributes.ColorModel = "rgb"
+		if cfg.SetOptions["17"] == 0 {
+			// SetOption17 reports the color as decimal values instead of hex
+			device.States["color.spectrumRgb"] = config.StateMapping{Template: "{{ if .Color }}{{ hexToSpectrum .Color }}{{ end }}"}
+		}
+	}
+	if ct {
+		// tasmota supports 153-500 mireds
+		device.Attributes.ColorTemperatureRange = config.SyncColorTemperatureRange{TemperatureMinK: 2000, TemperatureMaxK: 6500}
+		device.States["color.temperatureK"] = config.StateMapping{Template: "{{ if .CT }}{{ miredToKelvin .CT }}{{ end }}"}
+	}
+}
+
+// parseTasmotaSensors creates a temperature or humidity sensor for every sensor that reports these values on `tele/<topic>/SENSOR`
+func parseTasmotaSensors(cfg tasmotaConfig, sensors tasmotaSensors) []discoveredDevice {
+	fahrenheit := sensors.Sensors["TempUnit"] == "F"
+
+	var names []string
+	for name := range sensors.Sensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var discovered []discoveredDevice
+	for _, name := range names {
+		values, ok := sensors.Sensors[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if _, ok := values["Temperature"]; ok {
+			device := config.DeviceConfig{
+				Name:         fmt.Sprintf("%s %s temperature", cfg.DeviceName, name),
+				Type:         "action.devices.types.SENSOR",
+				Traits:       []string{temperatureControlTrait},
+				Subscription: cfg.teleTopic("SENSOR"),
+				Attributes: config.SyncAttributes{
+					QueryOnlyTemperatureControl: true,
+					TemperatureRange:            &config.SyncTemperatureRange{MinThresholdCelsius: -40, MaxThresholdCelsius: 125},
+					TemperatureUnitForUX:        "C",
+				},
+				States: map[string]config.StateMapping{
+					"temperatureAmbientCelsius": {Field: name + ".Temperature"},
+				},
+			}
+			if fahrenheit {
+				device.Attributes.TemperatureUnitForUX = "F"
+				device.States["temperatureAmbientCelsius"] = config.StateMapping{Template: fahrenheitTemplate(name + ".Temperature")}
+			}
+			discovered = append(discovered, tasmotaSensor(cfg, name, "Temperature", device))
+		}
+
+		if _, ok := values["Humidity"]; ok {
+			discovered = append(discovered, tasmotaSensor(cfg, name, "Humidity", config.DeviceConfig{
+				Name:         fmt.Sprintf("%s %s humidity", cfg.DeviceName, name),
+				Type:         "action.devices.types.SENSOR",
+				Traits:       []string{humiditySettingTrait},
+				Subscription: cfg.teleTopic("SENSOR"),
+				Attributes:   config.SyncAttributes{QueryOnlyHumiditySetting: true},
+				States: map[string]config.StateMapping{
+					"humidityAmbientPercent": {Field: name + ".Humidity"},
+				},
+			}))
+		}
+	}
+	return discovered
+}
+
+func tasmotaSensor(cfg tasmotaConfig, sensor string, value string, device config.DeviceConfig) discoveredDevice {
+	device.DeviceInfo = config.SyncDeviceInfo{Manufacturer: "Tasmota", Model: cfg.Model, SwVersion: cfg.Software}
+	return discoveredDevice{
+		id:     fmt.Sprintf("%s_%s_%s", cfg.Mac, sensor, value),
+		name:   device.Name,
+		device: device,
+	}
+}
+
+func (c tasmotaConfig) friendlyName(index int) string {
+	if index < len(c.FriendlyNames) && c.FriendlyNames[index] != nil && *c.FriendlyNames[index] != "" {
+		return *c.FriendlyNames[index]
+	}
+	if c.DeviceName != "" {
+		return c.DeviceName
+	}
+	return c.Topic
+}
+
+func (c tasmotaConfig) commandTopic(command string) string {
+	return c.fullTopic(0) + command
+}
+
+func (c tasmotaConfig) statTopic(command string) string {
+	return c.fullTopic(1) + command
+}
+
+func (c tasmotaConfig) teleTopic(command string) string {
+	return c.fullTopic(2) + command
+}
+
+// fullTopic expands the full topic of the device, e.g. `%prefix%/%topic%/`, with the cmnd, stat or tele prefix
+func (c tasmotaConfig) fullTopic(prefix int) string {
+	prefixes := []string{"cmnd", "stat", "tele"}
+	if prefix < len(c.Prefixes) {
+		prefixes[prefix] = c.Prefixes[prefix]
+	}
+	fullTopic := c.FullTopic
+	if fullTopic == "" {
+		fullTopic = "%prefix%/%topic%/"
+	}
+
+	mac := c.Mac
+	if len(mac) > 6 {
+		mac = mac[len(mac)-6:]
+	}
+	topic := strings.NewReplacer(
+		"%prefix%", prefixes[prefix],
+		"%topic%", c.Topic,
+		"%hostname%", c.Hostname,
+		"%id%", mac,
+	).Replace(fullTopic)
+	if !strings.HasSuffix(topic, "/") {
+		topic += "/"
+	}
+	return topic
+}
@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tasmotaDualConfig = `{"ip":"10.0.0.40","dn":"Dual","fn":["Hall","Porch",null,null],"hn":"tasmota-0A1B2C-6956","mac":"DC4F220A1B2C","md":"Sonoff Dual R2",
+	"ty":0,"if":0,"ofln":"Offline","onln":"Online","state":["OFF","ON","TOGGLE","HOLD"],"sw":"13.2.0","t":"tasmota_0A1B2C","ft":"%prefix%/%topic%/",
+	"tp":["cmnd","stat","tele"],"rl":[1,1,0,0],"lt_st":0,"so":{"4":0,"17":0},"ver":1}`
+
+const tasmotaBulbConfig = `{"dn":"Bulb","fn":["Bulb"],"hn":"tasmota-bulb","mac":"A4CF12000001","md":"Generic RGBCCT","sw":"13.2.0","t":"bulb",
+	"ft":"%prefix%/%topic%/","tp":["cmnd","stat","tele"],"rl":[2,0,0,0],"lt_st":5,"so":{"4":0,"17":0},"ver":1}`
+
+const tasmotaSensorsMessage = `{"sn":{"Time":"2024-01-01T12:00:00","AM2301":{"Temperature":21.5,"Humidity":40.1,"DewPoint":7.6},"TempUnit":"C"},"ver":1}`
+
+func TestParseTasmotaDevices(t *testing.T) {
+	listener := &discoveryListenerMock{devices: map[string]config.DeviceConfig{}}
+	discovery := newTasmotaDiscovery(config.DiscoverySource{}, nil, listener)
+
+	discovery.handle("tasmota/discovery/DC4F220A1B2C/config", []byte(tasmotaDualConfig))
+
+	require.ElementsMatch(t, []string{"DC4F220A1B2C_RL_1", "DC4F220A1B2C_RL_2"}, keys(listener.devices))
+	porch := listener.devices["DC4F220A1B2C_RL_2"]
+	assert.Equal(t, "Porch", porch.Name)
+	assert.Equal(t, "cmnd/tasmota_0A1B2C/POWER2", porch.Topic)
+	assert.Equal(t, "stat/tasmota_0A1B2C/RESULT", porch.Subscription)
+	assert.Equal(t, config.SyncDeviceInfo{Manufacturer: "Tasmota", Model: "Sonoff Dual R2", SwVersion: "13.2.0"}, porch.DeviceInfo)
+	assert.Equal(t, config.StateMapping{Field: "POWER2", Values: map[string]interface{}{"ON": true, "OFF": false}}, porch.States["on"])
+
+	discovery.handle("tasmota/discovery/DC4F220A1B2C/sensors", []byte(tasmotaSensorsMessage))
+
+	require.ElementsMatch(t, []string{"DC4F220A1B2C_RL_1", "DC4F220A1B2C_RL_2", "DC4F220A1B2C_AM2301_Temperature", "DC4F220A1B2C_AM2301_Humidity"}, keys(listener.devices))
+	temperature := listener.devices["DC4F220A1B2C_AM2301_Temperature"]
+	assert.Equal(t, "tele/tasmota_0A1B2C/SENSOR", temperature.Subscription)
+	assert.Equal(t, []string{"action.devices.traits.TemperatureControl"}, temperature.Traits)
+	assert.Equal(t, map[string]config.StateMapping{"temperatureAmbientCelsius": {Field: "AM2301.Temperature"}}, temperature.States)
+
+	discovery.handle("tasmota/discovery/DC4F220A1B2C/config", []byte{})
+
+	assert.Empty(t, listener.devices)
+}
+
+func TestParseTasmotaLight(t *testing.T) {
+	tests := []struct {
+		name             string
+		subtype          int
+		expectedTraits   []string
+		expectedCommands []string
+	}{
+		{
+			name:             "Dimmer",
+			subtype:          tasmotaDimmer,
+			expectedTraits:   []string{"action.devices.traits.OnOff", "action.devices.traits.Brightness"},
+			expectedCommands: []string{"action.devices.commands.OnOff", "action.devices.commands.BrightnessAbsolute"},
+		},
+		{
+			name:             "RGBCCT",
+			subtype:          tasmotaRGBCW,
+			expectedTraits:   []string{"action.devices.traits.OnOff", "action.devices.traits.Brightness", "action.devices.traits.ColorSetting"},
+			expectedCommands: []string{"action.devices.commands.OnOff", "action.devices.commands.BrightnessAbsolute", "action.devices.commands.ColorAbsolute"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			discovered := parseTasmotaDevices(nil, tasmotaConfig{DeviceName: "Bulb", Mac: "A4CF12000001", Topic: "bulb", Relays: []int{2}, LightSubtype: test.subtype}, nil)
+
+			require.Len(t, discovered, 1)
+			device := discovered[0].device
+			assert.Equal(t, "A4CF12000001_LI_1", discovered[0].id)
+			assert.Equal(t, "cmnd/bulb/POWER", device.Topic)
+			assert.Equal(t, test.expectedTraits, device.Traits)
+			assert.ElementsMatch(t, test.expectedCommands, keys(device.Commands))
+			assert.Equal(t, "cmnd/bulb/Dimmer", device.Commands["action.devices.commands.BrightnessAbsolute"].Topic)
+		})
+	}
+}
+
+func TestParseTasmotaBulbConfig(t *testing.T) {
+	listener := &discoveryListenerMock{devices: map[string]config.DeviceConfig{}}
+	discovery := newTasmotaDiscovery(config.DiscoverySource{}, nil, listener)
+
+	discovery.handle("tasmota/discovery/A4CF12000001/config", []byte(tasmotaBulbConfig))
+
+	bulb := listener.devices["A4CF12000001_LI_1"]
+	assert.Equal(t, "rgb", bulb.Attributes.ColorModel)
+	assert.Equal(t, config.CommandConfig{
+		Topic:    "cmnd/bulb/Backlog",
+		Template: "{{ if .Params.color.temperature }}CT {{ kelvinToMired .Params.color.temperature }}{{ else }}Color {{ spectrumToHex .Params.color.spectrumRGB }}{{ end }}",
+	}, bulb.Commands["action.devices.commands.ColorAbsolute"])
+	assert.Contains(t, bulb.States, "color.spectrumRgb")
+	assert.Contains(t, bulb.States, "color.temperatureK")
+}
+
+func TestTasmotaFullTopic(t *testing.T) {
+	cfg := tasmotaConfig{Topic: "plug", Hostname: "tasmota-plug", Mac: "DC4F220A1B2C", FullTopic: "tasmota/%id%/%prefix%", Prefixes: []string{"cmd", "st", "tl"}}
+
+	assert.Equal(t, "tasmota/0A1B2C/cmd/POWER", cfg.commandTopic("POWER"))
+	assert.Equal(t, "tasmota/0A1B2C/st/RESULT", cfg.statTopic("RESULT"))
+	assert.Equal(t, "tasmota/0A1B2C/tl/SENSOR", cfg.teleTopic("SENSOR"))
+}
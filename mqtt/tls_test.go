@@ -0,0 +1,217 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMqttTls(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCertificate(t, nil, "ca")
+	otherCa := newCertificate(t, nil, "other-ca")
+	server := newCertificate(t, ca, "broker.local")
+	client := newCertificate(t, ca, "ghome-client")
+
+	caFile := writePem(t, dir, "ca.pem", ca.cert)
+	otherCaFile := writePem(t, dir, "other-ca.pem", otherCa.cert)
+	certFile := writePem(t, dir, "client.pem", client.cert)
+	keyFile := writePem(t, dir, "client.key", client.key)
+
+	tests := []struct {
+		name       string
+		clientAuth bool
+		cfg        config.MqttConfig
+		err        string
+	}{
+		{
+			name: "pinned ca",
+			cfg:  config.MqttConfig{CaFile: caFile, ServerName: "broker.local"},
+		},
+		{
+			name: "other ca",
+			cfg:  config.MqttConfig{CaFile: otherCaFile, ServerName: "broker.local"},
+			err:  "certificate signed by unknown authority",
+		},
+		{
+			name: "server name mismatch",
+			cfg:  config.MqttConfig{CaFile: caFile},
+			err:  "cannot validate certificate for 127.0.0.1",
+		},
+		{
+			name: "insecure skip verify",
+			cfg:  config.MqttConfig{InsecureSkipVerify: true},
+		},
+		{
+			name:       "client certificate",
+			clientAuth: true,
+			cfg:        config.MqttConfig{CaFile: caFile, ServerName: "broker.local", CertFile: certFile, KeyFile: keyFile},
+		},
+		{
+			name:       "missing client certificate",
+			clientAuth: true,
+			cfg:        config.MqttConfig{CaFile: caFile, ServerName: "broker.local"},
+			err:        "certificate required",
+		},
+		{
+			name: "missing key file",
+			cfg:  config.MqttConfig{CaFile: caFile, CertFile: certFile},
+			err:  "client certificate needs both a cert file and a key file",
+		},
+		{
+			name: "invalid ca file",
+			cfg:  config.MqttConfig{CaFile: keyFile},
+			err:  "no certificates found in CA file",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host, port := listenTls(t, server, ca, test.clientAuth)
+			cfg := test.cfg
+			cfg.Host, cfg.Port, cfg.Tls = host, port, true
+
+			m, err := NewMqtt(cfg)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, m.client.IsConnected())
+			m.client.Disconnect(0)
+		})
+	}
+}
+
+type certificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	keyPair tls.Certificate
+}
+
+// newCertificate creates a self-signed CA without parent, or a certificate for the name signed by the parent
+func newCertificate(t *testing.T, parent *certificate, name string) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &certificate{
+		cert:    cert,
+		key:     key,
+		keyPair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+func writePem(t *testing.T, dir string, name string, value interface{}) string {
+	var block *pem.Block
+	switch value := value.(type) {
+	case *x509.Certificate:
+		block = &pem.Block{Type: "CERTIFICATE", Bytes: value.Raw}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(value)
+		require.NoError(t, err)
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	}
+
+	filename := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(filename, pem.EncodeToMemory(block), 0600))
+	return filename
+}
+
+// listenTls starts a TLS listener that accepts the MQTT connect of the client
+func listenTls(t *testing.T, server *certificate, ca *certificate, clientAuth bool) (string, int) {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{server.keyPair}}
+	if clientAuth {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go acceptConnect(conn)
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return host, portNumber
+}
+
+// acceptConnect reads the CONNECT packet, accepts it with a CONNACK and ignores the rest of the connection
+func acceptConnect(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadByte(); err != nil {
+		return
+	}
+	length, multiplier := 0, 1
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		length += int(b&127) * multiplier
+		multiplier *= 128
+		if b&128 == 0 {
+			break
+		}
+	}
+	if _, err := io.CopyN(io.Discard, reader, int64(length)); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{0x20, 0x02, 0x00, 0x00}); err != nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, reader)
+}
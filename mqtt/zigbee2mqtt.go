@@ -0,0 +1,236 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mrlauy/ghome-mqtt/config"
+	log "log/slog"
+	"math"
+	"slices"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	onOffTrait        = "action.devices.traits.OnOff"
+	brightnessTrait   = "action.devices.traits.Brightness"
+	colorSettingTrait = "action.devices.traits.ColorSetting"
+
+	onOffCommand      = "action.devices.commands.OnOff"
+	brightnessCommand = "action.devices.commands.BrightnessAbsolute"
+	colorCommand      = "action.devices.commands.ColorAbsolute"
+	setpointCommand   = "action.devices.commands.ThermostatTemperatureSetpoint"
+	lockCommand       = "action.devices.commands.LockUnlock"
+)
+
+// zigbee2mqttProfiles maps the generic exposes of zigbee2mqtt to a profile
+var zigbee2mqttProfiles = map[string]string{
+	"light":   "zigbee2mqtt-light",
+	"switch":  "zigbee2mqtt-plug",
+	"cover":   "zigbee2mqtt-cover",
+	"climate": "zigbee2mqtt-thermostat",
+	"lock":    "zigbee2mqtt-lock",
+}
+
+var thermostatModes = []string{"off", "heat", "cool", "on", "heatcool", "auto", "fan-only", "purifier", "eco", "dry"}
+
+type zigbee2mqttDevice struct {
+	IeeeAddress        string                 `json:"ieee_address"`
+	Type               string                 `json:"type"`
+	FriendlyName       string                 `json:"friendly_name"`
+	Supported          bool                   `json:"supported"`
+	Disabled           bool                   `json:"disabled"`
+	InterviewCompleted bool                   `json:"interview_completed"`
+	SoftwareBuildId    string                 `json:"software_build_id"`
+	Definition         *zigbee2mqttDefinition `json:"definition"`
+}
+
+type zigbee2mqttDefinition struct {
+	Model       string              `json:"model"`
+	Vendor      string              `json:"vendor"`
+	Description string              `json:"description"`
+	Exposes     []zigbee2mqttExpose `json:"exposes"`
+}
+
+type zigbee2mqttExpose struct {
+	Type     string              `json:"type"`
+	Name     string              `json:"name"`
+	Property string              `json:"property"`
+	Endpoint string              `json:"endpoint"`
+	Features []zigbee2mqttExpose `json:"features"`
+	Values   []string            `json:"values"`
+	ValueMin *float64            `json:"value_min"`
+	ValueMax *float64            `json:"value_max"`
+	ValueOn  interface{}         `json:"value_on"`
+	ValueOff interface{}         `json:"value_off"`
+}
+
+// DiscoverZigbee2mqtt subscribes to the device list of zigbee2mqtt and passes every supported device to the listener
+func (m *Mqtt) DiscoverZigbee2mqtt(source config.DiscoverySource, profiles map[string]config.DeviceConfig, listener DiscoveryListener) error {
+	baseTopic := source.Topic
+	if baseTopic == "" {
+		baseTopic = "zigbee2mqtt"
+	}
+	discovery := newDiscovery("zigbee2mqtt", source, listener)
+
+	topic := baseTopic + "/bridge/devices"
+	log.Info("discover zigbee2mqtt devices", "topic", topic)
+	callbackHandler := func(client mqtt.Client, msg mqtt.Message) {
+		var devices []zigbee2mqttDevice
+		err := json.Unmarshal(msg.Payload(), &devices)
+		if err != nil {
+			log.Error("failed to parse zigbee2mqtt devices", "topic", msg.Topic(), "error", err)
+			return
+		}
+
+		discovery.dispatch(func() {
+			discovery.update(parseZigbee2mqttDevices(baseTopic, profiles, devices))
+		})
+	}
+
+	if err := m.subscribe(topic, callbackHandler); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseZigbee2mqttDevices(baseTopic string, profiles map[string]config.DeviceConfig, devices []zigbee2mqttDevice) []discoveredDevice {
+	var discovered []discoveredDevice
+	for _, device := range devices {
+		if device.Type == "Coordinator" || device.Definition == nil || !device.Supported || device.Disabled || !device.InterviewCompleted {
+			continue
+		}
+
+		for _, expose := range device.Definition.Exposes {
+			profile, ok := zigbee2mqttProfiles[expose.Type]
+			if !ok {
+				continue
+			}
+
+			deviceConfig, err := config.ApplyProfile(config.DeviceConfig{
+				Profile:      profile,
+				FriendlyName: device.FriendlyName,
+				Name:         zigbee2mqttName(device.FriendlyName, expose.Endpoint),
+				DeviceInfo: config.SyncDeviceInfo{
+					Manufacturer: device.Definition.Vendor,
+					Model:        device.Definition.Model,
+					SwVersion:    device.SoftwareBuildId,
+				},
+			}, profiles)
+			if err != nil {
+				log.Error("failed to apply profile to zigbee2mqtt device", "device", device.FriendlyName, "error", err)
+				continue
+			}
+			deviceConfig.Topic = fmt.Sprintf("%s/%s/set", baseTopic, device.FriendlyName)
+			deviceConfig.Subscription = fmt.Sprintf("%s/%s", baseTopic, device.FriendlyName)
+			deviceConfig.DefaultNames = []string{device.Definition.Description}
+			applyZigbee2mqttFeatures(&deviceConfig, expose)
+
+			id := device.IeeeAddress
+			if expose.Endpoint != "" {
+				id = fmt.Sprintf("%s_%s", id, expose.Endpoint)
+			}
+			discovered = append(discovered, discoveredDevice{
+				id:     id,
+				name:   device.FriendlyName,
+				device: deviceConfig,
+			})
+		}
+	}
+	return discovered
+}
+
+// applyZigbee2mqttFeatures adjusts the traits, attributes, commands and states of the profile to the features the device exposes
+func applyZigbee2mqttFeatures(device *config.DeviceConfig, expose zigbee2mqttExpose) {
+	features := map[string]zigbee2mqttExpose{}
+	for _, feature := range expose.Features {
+		features[feature.Name] = feature
+	}
+
+	if state, ok := features["state"]; ok && state.Property != "state" {
+		on, off := fmt.Sprintf("%v", state.ValueOn), fmt.Sprintf("%v", state.ValueOff)
+		if expose.Type == "lock" {
+			device.Commands[lockCommand] = config.CommandConfig{Template: fmt.Sprintf(`{ %s:{{ if .Params.lock }}%s{{ else }}%s{{ end -}} }`, jsonLiteral(state.Property), jsonLiteral(on), jsonLiteral(off))}
+			device.States["isLocked"] = config.StateMapping{Field: state.Property, Values: map[string]interface{}{on: true, off: false}}
+		} else {
+			device.Commands[onOffCommand] = config.CommandConfig{Template: fmt.Sprintf(`{ %s:{{ if .Params.on }}%s{{ else }}%s{{ end -}} }`, jsonLiteral(state.Property), jsonLiteral(on), jsonLiteral(off))}
+			device.States["on"] = config.StateMapping{Field: state.Property, Values: map[string]interface{}{on: true, off: false}}
+		}
+	}
+
+	switch expose.Type {
+	case "light":
+		brightness, hasBrightness := features["brightness"]
+		if !hasBrightness {
+			removeTrait(device, brightnessTrait, brightnessCommand, "brightness")
+		} else if brightness.Property != "brightness" {
+			device.Commands[brightnessCommand] = config.CommandConfig{Template: fmt.Sprintf(`{ %s:{{ scale .Params.brightness 0 100 0 254 | round -}} }`, jsonLiteral(brightness.Property))}
+			device.States["brightness"] = config.StateMapping{Field: brightness.Property, Max: 254}
+		}
+
+		_, hasXy := features["color_xy"]
+		_, hasHs := features["color_hs"]
+		colorTemp, hasColorTemp := features["color_temp"]
+		if !hasXy && !hasHs {
+			device.Attributes.ColorModel = ""
+			delete(device.States, "color.spectrumRgb")
+		}
+		if !hasColorTemp {
+			device.Attributes.ColorTemperatureRange = config.SyncColorTemperatureRange{}
+			delete(device.States, "color.temperatureK")
+		} else if colorTemp.ValueMin != nil && colorTemp.ValueMax != nil && *colorTemp.ValueMin > 0 {
+			device.Attributes.ColorTemperatureRange = config.SyncColorTemperatureRange{
+				TemperatureMinK: int(math.Round(1000000 / *colorTemp.ValueMax)),
+				TemperatureMaxK: int(math.Round(1000000 / *colorTemp.ValueMin)),
+			}
+		}
+		if !hasXy && !hasHs && !hasColorTemp {
+			removeTrait(device, colorSettingTrait, colorCommand)
+		}
+	case "climate":
+		if systemMode, ok := features["system_mode"]; ok {
+			device.Attributes.AvailableThermostatModes = slices.DeleteFunc(slices.Clone(systemMode.Values), func(mode string) bool {
+				return !slices.Contains(thermostatModes, mode)
+			})
+		}
+		if _, ok := features["current_heating_setpoint"]; !ok {
+			if setpoint, ok := features["occupied_heating_setpoint"]; ok {
+				device.Commands[setpointCommand] = config.CommandConfig{Template: fmt.Sprintf(`{ %s:{{ .Params.thermostatTemperatureSetpoint -}} }`, jsonLiteral(setpoint.Property))}
+				device.States["thermostatTemperatureSetpoint"] = config.StateMapping{Field: setpoint.Property}
+			}
+		}
+	case "cover":
+		if _, ok := features["position"]; !ok {
+			device.Attributes.DiscreteOnlyOpenClose = true
+			device.Commands["action.devices.commands.OpenClose"] = config.CommandConfig{Template: `{"state":"{{ if .Params.openPercent }}OPEN{{ else }}CLOSE{{ end }}"}`}
+			device.States["openPercent"] = config.StateMapping{Field: "state", Values: map[string]interface{}{"OPEN": 100, "CLOSE": 0}}
+		}
+	}
+}
+
+func removeTrait(device *config.DeviceConfig, trait string, command string, states ...string) {
+	device.Traits = slices.DeleteFunc(slices.Clone(device.Traits), func(t string) bool {
+		return t == trait
+	})
+	delete(device.Commands, command)
+	for _, state := range states {
+		delete(device.States, state)
+	}
+}
+
+// zigbee2mqttName turns a friendly name like `living/lamp` into a name for Google like `living lamp`
+func zigbee2mqttName(friendlyName string, endpoint string) string {
+	name := strings.NewReplacer("/", " ", "_", " ").Replace(friendlyName)
+	if endpoint != "" {
+		name = fmt.Sprintf("%s %s", name, endpoint)
+	}
+	return name
+}
+
+// jsonLiteral encodes a discovered value as json in a template literal, so it can't change the message or the template,
+// the space before it is trimmed because `{{{` doesn't parse
+func jsonLiteral(value string) string {
+	data, _ := json.Marshal(value)
+	return fmt.Sprintf("{{- %q }}", data)
+}
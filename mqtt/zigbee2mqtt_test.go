@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mrlauy/ghome-mqtt/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const zigbee2mqttBridgeDevices = `[
+  {"ieee_address":"0x00124b0000000000","type":"Coordinator","friendly_name":"Coordinator","supported":true,"interview_completed":true},
+  {
+    "ieee_address":"0x000b57fffe000001","type":"Router","friendly_name":"living/lamp","supported":true,"interview_completed":true,"software_build_id":"2.3.086",
+    "definition":{"model":"LED1545G12","vendor":"IKEA","description":"TRADFRI bulb E26/E27, white spectrum","exposes":[
+      {"type":"light","features":[
+        {"type":"binary","name":"state","property":"state","value_on":"ON","value_off":"OFF"},
+        {"type":"numeric","name":"brightness","property":"brightness","value_min":0,"value_max":254},
+        {"type":"numeric","name":"color_temp","property":"color_temp","value_min":250,"value_max":454}
+      ]},
+      {"type":"numeric","name":"linkquality","property":"linkquality"}
+    ]}
+  },
+  {
+    "ieee_address":"0x00158d0000000002","type":"Router","friendly_name":"double_switch","supported":true,"interview_completed":true,
+    "definition":{"model":"QBKG03LM","vendor":"Aqara","description":"Smart wall switch (no neutral, double rocker)","exposes":[
+      {"type":"switch","endpoint":"left","features":[{"type":"binary","name":"state","property":"state_left","value_on":"ON","value_off":"OFF"}]},
+      {"type":"switch","endpoint":"right","features":[{"type":"binary","name":"state","property":"state_right","value_on":"ON","value_off":"OFF"}]}
+    ]}
+  },
+  {
+    "ieee_address":"0x00158d0000000003","type":"EndDevice","friendly_name":"door_sensor","supported":true,"interview_completed":true,
+    "definition":{"model":"MCCGQ11LM","vendor":"Aqara","description":"Door and window sensor","exposes":[
+      {"type":"binary","name":"contact","property":"contact","value_on":false,"value_off":true}
+    ]}
+  }
+]`
+
+func TestParseZigbee2mqttDevices(t *testing.T) {
+	var devices []zigbee2mqttDevice
+	require.NoError(t, json.Unmarshal([]byte(zigbee2mqttBridgeDevices), &devices))
+
+	discovered := parseZigbee2mqttDevices("z2m", nil, devices)
+
+	require.Len(t, discovered, 3)
+
+	lamp := discovered[0]
+	assert.Equal(t, "0x000b57fffe000001", lamp.id)
+	assert.Equal(t, "living/lamp", lamp.name)
+	assert.Equal(t, "living lamp", lamp.device.Name)
+	assert.Equal(t, "z2m/living/lamp/set", lamp.device.Topic)
+	assert.Equal(t, "z2m/living/lamp", lamp.device.Subscription)
+	assert.Equal(t, "action.devices.types.LIGHT", lamp.device.Type)
+	assert.Equal(t, []string{"action.devices.traits.OnOff", "action.devices.traits.Brightness", "action.devices.traits.ColorSetting"}, lamp.device.Traits)
+	assert.Equal(t, "", lamp.device.Attributes.ColorModel)
+	assert.Equal(t, config.SyncColorTemperatureRange{TemperatureMinK: 2203, TemperatureMaxK: 4000}, lamp.device.Attributes.ColorTemperatureRange)
+	assert.Equal(t, config.SyncDeviceInfo{Manufacturer: "IKEA", Model: "LED1545G12", SwVersion: "2.3.086"}, lamp.device.DeviceInfo)
+	assert.NotContains(t, lamp.device.States, "color.spectrumRgb")
+
+	left := discovered[1]
+	assert.Equal(t, "0x00158d0000000002_left", left.id)
+	assert.Equal(t, "double switch left", left.device.Name)
+	assert.Equal(t, "action.devices.types.OUTLET", left.device.Type)
+	assert.Equal(t, `{"state_left":"OFF"}`, executeTemplate(t, left.device.Commands["action.devices.commands.OnOff"].Template, map[string]interface{}{"on": false}))
+	assert.Equal(t, "state_left", left.device.States["on"].Field)
+	assert.Equal(t, "0x00158d0000000002_right", discovered[2].id)
+
+	// the built-in profile is left untouched
+	assert.Equal(t, "state", config.Profiles["zigbee2mqtt-plug"].States["on"].Field)
+	assert.Contains(t, config.Profiles["zigbee2mqtt-light"].States, "color.spectrumRgb")
+}
+
+func TestDiscoveryFilterAndOverrides(t *testing.T) {
+	listener := &discoveryListenerMock{devices: map[string]config.DeviceConfig{}}
+	discovery := newDiscovery("test", config.DiscoverySource{
+		Exclude: []string{"garden/*"},
+		Overrides: map[string]config.DeviceConfig{
+			"living/lamp": {Name: "reading lamp", RoomHint: "living room"},
+		},
+	}, listener)
+
+	discovery.update([]discoveredDevice{
+		{id: "0x01", name: "living/lamp", device: config.DeviceConfig{Name: "living lamp", Type: "action.devices.types.LIGHT"}},
+		{id: "0x02", name: "garden/pump", device: config.DeviceConfig{Name: "garden pump"}},
+		{id: "0x03", name: "hall", device: config.DeviceConfig{Name: "hall"}},
+	})
+
+	assert.Equal(t, map[string]config.DeviceConfig{
+		"0x01": {Name: "reading lamp", RoomHint: "living room", Type: "action.devices.types.LIGHT"},
+		"0x03": {Name: "hall"},
+	}, listener.devices)
+
+	discovery.update([]discoveredDevice{
+		{id: "0x01", name: "living/lamp", device: config.DeviceConfig{Name: "living lamp"}},
+	})
+
+	assert.Equal(t, []string{"0x01"}, keys(listener.devices))
+}
+
+type discoveryListenerMock struct {
+	devices map[string]config.DeviceConfig
+}
+
+func (l *discoveryListenerMock) AddDevice(id string, device config.DeviceConfig) {
+	l.devices[id] = device
+}
+
+func (l *discoveryListenerMock) RemoveDevice(id string) {
+	delete(l.devices, id)
+}
+
+func keys[V any](values map[string]V) []string {
+	var ids []string
+	for id := range values {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestZigbee2mqttValuesAreLiterals(t *testing.T) {
+	device := config.DeviceConfig{Commands: map[string]config.CommandConfig{}, States: map[string]config.StateMapping{}}
+	applyZigbee2mqttFeatures(&device, zigbee2mqttExpose{Type: "switch", Features: []zigbee2mqttExpose{
+		{Name: "state", Property: `state"}}`, ValueOn: `{{ .Config }}`, ValueOff: "OFF"},
+	}})
+
+	message := executeTemplate(t, device.Commands["action.devices.commands.OnOff"].Template, map[string]interface{}{"on": true})
+
+	assert.JSONEq(t, `{"state\"}}":"{{ .Config }}"}`, message)
+}